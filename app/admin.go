@@ -0,0 +1,492 @@
+// Admin console, under /admin/ (restricted to app admins in app.yaml). Lists,
+// filters, edits, deletes, and exports entities of any kind in the types map,
+// using reflection. Every mutation is recorded as an AdminAuditEntry.
+
+package app
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Number of entities per page in the admin console.
+const kAdminPageSize = 50
+
+// Kinds that cannot be edited or deleted from the admin console.
+var readOnlyKinds = []string{"AdminAuditEntry", "Migration"}
+
+type AdminRow struct {
+	Key       string // encoded key
+	KeyString string // human-readable key
+	Values    []string
+}
+
+// A (possibly nested) struct field, e.g. "ReminderPolicy.Mode".
+type AdminField struct {
+	Name  string
+	Value string // as accepted by parseAdminValue
+}
+
+func getKindNames() []string {
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the admin's email, for audit entries.
+func getAdminEmail(c *Context) string {
+	if u := user.Current(c.Aec()); u != nil {
+		return u.Email
+	}
+	return "unknown"
+}
+
+// Accepts an encoded key, or "Kind:id" for root entities, where id is an int
+// if it parses as one, and a string otherwise (e.g. "UserId:foo@example.com").
+func parseAdminKey(s string, c *Context) (*datastore.Key, error) {
+	s = strings.TrimSpace(s)
+	if parts := strings.SplitN(s, ":", 2); len(parts) == 2 && types[parts[0]] != nil {
+		if id, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			return datastore.NewKey(c.Aec(), parts[0], "", id, nil), nil
+		}
+		return datastore.NewKey(c.Aec(), parts[0], parts[1], 0, nil), nil
+	}
+	return datastore.DecodeKey(s)
+}
+
+// Renders a value for display. Times are shown in the viewer's time zone.
+func renderAdminValue(v interface{}, c *Context) string {
+	// If v is a time.Time and it's not the Unix epoch, render it in the viewer's
+	// time zone.
+	if t, ok := v.(time.Time); ok {
+		loc := c.Location()
+		if t.Equal(time.Unix(0, 0)) {
+			loc = time.UTC
+		}
+		return fmt.Sprint(t.In(loc))
+	}
+	// If v is a byte slice, render it in hex.
+	if b, ok := v.([]byte); ok {
+		return fmt.Sprintf("%x", b)
+	}
+	res := fmt.Sprintf("%+q", fmt.Sprint(v))
+	return res[1 : len(res)-1] // strip quotes
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Formats a field value for edit forms and exports. Inverse of parseAdminValue.
+func formatAdminValue(v reflect.Value) string {
+	switch {
+	case v.Type() == timeType:
+		return v.Interface().(time.Time).UTC().Format(time.RFC3339Nano)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return hex.EncodeToString(v.Bytes())
+	case v.Kind() == reflect.Slice:
+		strs := make([]string, v.Len())
+		for i := range strs {
+			strs[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(strs, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Sets v, which must be settable, from s.
+func parseAdminValue(v reflect.Value, s string) error {
+	if v.Type() == timeType {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		res := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := parseAdminValue(elem, part); err != nil {
+				return err
+			}
+			res = reflect.Append(res, elem)
+		}
+		v.Set(res)
+	default:
+		return fmt.Errorf("Cannot parse value of type %v", v.Type())
+	}
+	return nil
+}
+
+// Returns the fields of the given struct value, flattening nested structs
+// (other than time.Time) the same way the datastore does.
+func getAdminFields(s reflect.Value, prefix string) []AdminField {
+	fields := []AdminField{}
+	for i := 0; i < s.NumField(); i++ {
+		name := prefix + s.Type().Field(i).Name
+		if f := s.Field(i); f.Kind() == reflect.Struct && f.Type() != timeType {
+			fields = append(fields, getAdminFields(f, name+".")...)
+		} else {
+			fields = append(fields, AdminField{Name: name, Value: formatAdminValue(f)})
+		}
+	}
+	return fields
+}
+
+// Returns the (possibly nested) field of struct value s with the given name.
+func getAdminField(s reflect.Value, name string) (reflect.Value, error) {
+	for _, part := range strings.Split(name, ".") {
+		if s.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("Invalid field: %q", name)
+		}
+		s = s.FieldByName(part)
+		if !s.IsValid() {
+			return reflect.Value{}, fmt.Errorf("Invalid field: %q", name)
+		}
+	}
+	return s, nil
+}
+
+// Returns the query for the list and export pages. Params: "t" (kind), and
+// optionally "f" and "v" (field and value for an equality filter) and "o" (field
+// to order by, with "-" prefix for descending).
+func makeAdminQuery(r *http.Request) (*datastore.Query, error) {
+	typeName := r.FormValue("t")
+	if types[typeName] == nil {
+		return nil, fmt.Errorf("Invalid kind: %q", typeName)
+	}
+	q := datastore.NewQuery(typeName)
+	if field := r.FormValue("f"); field != "" {
+		v, err := getAdminField(reflect.ValueOf(makeNew(typeName)).Elem(), field)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseAdminValue(v, r.FormValue("v")); err != nil {
+			return nil, err
+		}
+		q = q.Filter(field+" =", v.Interface())
+	}
+	if order := r.FormValue("o"); order != "" {
+		q = q.Order(order)
+	}
+	return q, nil
+}
+
+// Appends an audit entry for the given change. Should be called in the same
+// (cross-group) transaction as the change.
+func putAdminAuditEntry(aec appengine.Context, action string, key *datastore.Key, changes interface{}, c *Context) error {
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	entry := &AdminAuditEntry{
+		Admin:   getAdminEmail(c),
+		Action:  action,
+		Kind:    key.Kind(),
+		Key:     key.Encode(),
+		Date:    time.Now(),
+		Changes: string(b),
+	}
+	_, err = datastore.Put(aec, datastore.NewIncompleteKey(aec, "AdminAuditEntry", nil), entry)
+	return err
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.URL.Path != "/admin/" {
+		Serve404(w)
+		return
+	}
+	data := map[string]interface{}{
+		"kinds":      getKindNames(),
+		"cacheStats": GetCacheStats(),
+	}
+	RenderTemplateOrDie(w, c, "admin-index", data)
+}
+
+func handleAdminList(w http.ResponseWriter, r *http.Request, c *Context) {
+	typeName := r.FormValue("t")
+	q, err := makeAdminQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cursorStr := r.FormValue("cursor"); cursorStr != "" {
+		cursor, err := datastore.DecodeCursor(cursorStr)
+		CheckError(err)
+		q = q.Start(cursor)
+	}
+
+	// Make header row.
+	headers := []string{"Key"}
+	for _, field := range getAdminFields(reflect.ValueOf(makeNew(typeName)).Elem(), "") {
+		headers = append(headers, field.Name)
+	}
+
+	// Make data rows.
+	rows := []AdminRow{}
+	it := q.Limit(kAdminPageSize + 1).Run(c.Aec())
+	nextCursor := ""
+	for {
+		if len(rows) == kAdminPageSize {
+			cursor, err := it.Cursor()
+			CheckError(err)
+			// Check whether there are more results.
+			if _, err := it.Next(makeNew(typeName)); err == nil {
+				nextCursor = cursor.String()
+			}
+			break
+		}
+		val := makeNew(typeName)
+		key, err := it.Next(val)
+		if err == datastore.Done {
+			break
+		} else if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+			// Show what we could load. Stale fields are common after schema changes.
+		} else {
+			CheckError(err)
+		}
+		row := AdminRow{Key: key.Encode(), KeyString: renderAdminValue(key.String(), c)}
+		s := reflect.ValueOf(val).Elem()
+		for _, field := range getAdminFields(s, "") {
+			v, _ := getAdminField(s, field.Name)
+			row.Values = append(row.Values, renderAdminValue(v.Interface(), c))
+		}
+		rows = append(rows, row)
+	}
+
+	v := r.URL.Query()
+	v.Del("cursor")
+	nextPageUrl := ""
+	if nextCursor != "" {
+		v.Set("cursor", nextCursor)
+		nextPageUrl = "/admin/list?" + v.Encode()
+		v.Del("cursor")
+	}
+	data := map[string]interface{}{
+		"kind":        typeName,
+		"kinds":       getKindNames(),
+		"field":       r.FormValue("f"),
+		"value":       r.FormValue("v"),
+		"order":       r.FormValue("o"),
+		"headers":     headers,
+		"rows":        rows,
+		"nextPageUrl": nextPageUrl,
+		"exportQuery": v.Encode(),
+	}
+	RenderTemplateOrDie(w, c, "admin-list", data)
+}
+
+// GET shows an edit form for the entity with the given key; POST updates it.
+func handleAdminEntity(w http.ResponseWriter, r *http.Request, c *Context) {
+	key, err := parseAdminKey(r.FormValue("key"), c)
+	if err != nil || types[key.Kind()] == nil {
+		http.Error(w, fmt.Sprintf("Invalid key: %q", r.FormValue("key")), http.StatusBadRequest)
+		return
+	}
+	readOnly := ContainsString(readOnlyKinds, key.Kind())
+
+	if r.Method == "POST" {
+		Assert(!readOnly, "Kind is read-only: ", key.Kind())
+		changes := map[string][]string{}
+		err := runInTransactionWithCache(c, func(aec appengine.Context, cw *cacheWrites) error {
+			changes = map[string][]string{} // ensure transaction is idempotent
+			val := makeNew(key.Kind())
+			if err := datastore.Get(aec, key, val); err != nil {
+				return err
+			}
+			s := reflect.ValueOf(val).Elem()
+			for _, field := range getAdminFields(s, "") {
+				newValue, ok := r.Form["f."+field.Name]
+				if !ok || newValue[0] == field.Value {
+					continue
+				}
+				v, _ := getAdminField(s, field.Name)
+				if err := parseAdminValue(v, newValue[0]); err != nil {
+					return fmt.Errorf("%s: %v", field.Name, err)
+				}
+				changes[field.Name] = []string{field.Value, newValue[0]}
+			}
+			if len(changes) == 0 {
+				return nil
+			}
+			if _, err := cw.put(aec, key, val); err != nil {
+				return err
+			}
+			return putAdminAuditEntry(aec, "update", key, changes, c)
+		}, makeXG())
+		CheckError(err)
+		c.Log().Info("Admin updated entity", "admin", getAdminEmail(c), "key", key, "changes", changes)
+		http.Redirect(w, r, "/admin/entity?key="+key.Encode(), http.StatusSeeOther)
+		return
+	} else if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	val := makeNew(key.Kind())
+	if err := datastore.Get(c.Aec(), key, val); err == datastore.ErrNoSuchEntity {
+		http.Error(w, fmt.Sprintf("No such entity: %v", key), http.StatusNotFound)
+		return
+	} else if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		CheckError(err)
+	}
+	data := map[string]interface{}{
+		"key":        key.Encode(),
+		"keyString":  key.String(),
+		"kind":       key.Kind(),
+		"kinds":      getKindNames(),
+		"fields":     getAdminFields(reflect.ValueOf(val).Elem(), ""),
+		"readOnly":   readOnly,
+		"confirming": r.URL.Path == "/admin/delete",
+	}
+	if key.Parent() != nil {
+		data["parentKey"] = key.Parent().Encode()
+	}
+	RenderTemplateOrDie(w, c, "admin-entity", data)
+}
+
+// GET shows a confirmation page; POST deletes the entity. Child entities are
+// not deleted.
+func handleAdminDelete(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method == "GET" {
+		handleAdminEntity(w, r, c)
+		return
+	} else if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	key, err := parseAdminKey(r.FormValue("key"), c)
+	CheckError(err)
+	Assert(types[key.Kind()] != nil, "Invalid kind: ", key.Kind())
+	Assert(!ContainsString(readOnlyKinds, key.Kind()), "Kind is read-only: ", key.Kind())
+	err = runInTransactionWithCache(c, func(aec appengine.Context, cw *cacheWrites) error {
+		val := makeNew(key.Kind())
+		if err := datastore.Get(aec, key, val); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return err
+			}
+		}
+		// Record the deleted entity, so that it can be restored by hand.
+		snapshot := map[string]string{}
+		for _, field := range getAdminFields(reflect.ValueOf(val).Elem(), "") {
+			snapshot[field.Name] = field.Value
+		}
+		if err := cw.delete(aec, key); err != nil {
+			return err
+		}
+		return putAdminAuditEntry(aec, "delete", key, snapshot, c)
+	}, makeXG())
+	CheckError(err)
+	c.Log().Info("Admin deleted entity", "admin", getAdminEmail(c), "key", key)
+	http.Redirect(w, r, "/admin/list?t="+key.Kind(), http.StatusSeeOther)
+}
+
+// Exports all entities matching the list page's query, as JSON (default) or
+// CSV ("format=csv"). Values are formatted as in edit forms.
+func handleAdminExport(w http.ResponseWriter, r *http.Request, c *Context) {
+	typeName := r.FormValue("t")
+	q, err := makeAdminQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.FormValue("format")
+	Assert(format == "" || format == "json" || format == "csv", fmt.Sprintf("Invalid format: %q", format))
+
+	var cw *csv.Writer
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", typeName))
+		cw = csv.NewWriter(w)
+		headers := []string{"Key"}
+		for _, field := range getAdminFields(reflect.ValueOf(makeNew(typeName)).Elem(), "") {
+			headers = append(headers, field.Name)
+		}
+		CheckError(cw.Write(headers))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.json\"", typeName))
+		fmt.Fprint(w, "[")
+	}
+	for it, n := q.Run(c.Aec()), 0; ; n++ {
+		val := makeNew(typeName)
+		key, err := it.Next(val)
+		if err == datastore.Done {
+			break
+		} else if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			CheckError(err)
+		}
+		fields := getAdminFields(reflect.ValueOf(val).Elem(), "")
+		if cw != nil {
+			row := []string{key.Encode()}
+			for _, field := range fields {
+				row = append(row, field.Value)
+			}
+			CheckError(cw.Write(row))
+			continue
+		}
+		obj := map[string]string{"Key": key.Encode()}
+		for _, field := range fields {
+			obj[field.Name] = field.Value
+		}
+		b, err := json.Marshal(obj)
+		CheckError(err)
+		if n > 0 {
+			fmt.Fprint(w, ",\n")
+		}
+		w.Write(b)
+	}
+	if cw != nil {
+		cw.Flush()
+		CheckError(cw.Error())
+	} else {
+		fmt.Fprint(w, "]\n")
+	}
+}
@@ -0,0 +1,574 @@
+// JSON REST API, versioned under /api/v1/. Requests authenticate with a
+// personal API token (created in /settings), sent as
+// "Authorization: Bearer <token>". Endpoints:
+//
+//   GET    /api/v1/requests                  list requests (?status=unpaid|paid)
+//   POST   /api/v1/requests                  create requests
+//   GET    /api/v1/requests/<id>             get a request
+//   DELETE /api/v1/requests/<id>             delete a request
+//   POST   /api/v1/requests/<id>/mark-paid   mark as paid ({"undo": true} to undo)
+//   POST   /api/v1/requests/<id>/remind      send a reminder email
+//   GET    /api/v1/profile                   get the user's profile
+//   PATCH  /api/v1/profile                   update the user's profile
+//
+// Errors have the form {"error": {"code": "not_found", "message": "..."}}.
+
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+const kApiTokenPrefix = "tadue_"
+
+// Max size of a JSON request body, in bytes.
+const kMaxApiRequestBytes = 1 << 20
+
+// Max number of requests returned by a single list call.
+const kMaxApiListLimit = 100
+
+type ApiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func newApiError(status int, code, format string, args ...interface{}) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var errApiNotFound = newApiError(http.StatusNotFound, "not_found", "Not found")
+
+func ServeApiJson(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	CheckError(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func ServeApiError(w http.ResponseWriter, err *ApiError) {
+	ServeApiJson(w, err.Status, map[string]interface{}{"error": err})
+}
+
+// Returns a new token string and its hash. Only the hash is stored.
+func GenerateApiToken() (token, tokenHash string) {
+	token = kApiTokenPrefix + base64.URLEncoding.EncodeToString(GenerateSecureRandomString())
+	return token, HashApiToken(token)
+}
+
+// Tokens are random, so unlike passwords, they need no salt.
+func HashApiToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Returns the user's API tokens, keyed by token hash, oldest first.
+func GetApiTokensOrDie(userId int64, c *Context) ([]string, []ApiToken) {
+	hashes, tokens, err := store.GetApiTokens(userId, c)
+	CheckError(err)
+	sort.Sort(&apiTokensByCreationDate{hashes, tokens})
+	return hashes, tokens
+}
+
+type apiTokensByCreationDate struct {
+	hashes []string
+	tokens []ApiToken
+}
+
+func (s *apiTokensByCreationDate) Len() int { return len(s.tokens) }
+func (s *apiTokensByCreationDate) Swap(i, j int) {
+	s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i]
+	s.tokens[i], s.tokens[j] = s.tokens[j], s.tokens[i]
+}
+func (s *apiTokensByCreationDate) Less(i, j int) bool {
+	return s.tokens[i].CreationDate.Before(s.tokens[j].CreationDate)
+}
+
+// Returns the user for the bearer token in the request, or an ApiError.
+func authenticateApiRequest(r *http.Request, c *Context) (int64, *User, *ApiError) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return 0, nil, newApiError(http.StatusUnauthorized, "unauthenticated", "Missing API token")
+	}
+	tokenHash := HashApiToken(strings.TrimSpace(auth[len("Bearer "):]))
+	token, err := store.GetApiToken(tokenHash, c)
+	if err == ErrNoSuchEntity {
+		return 0, nil, newApiError(http.StatusUnauthorized, "unauthenticated", "Invalid API token")
+	}
+	CheckError(err)
+	user := GetUserFromUserIdOrDie(token.UserId, c)
+
+	// Only record usage once per hour, to avoid a datastore write per request.
+	if now := time.Now(); now.Sub(token.LastUsedDate) > time.Hour {
+		token.LastUsedDate = now
+		CheckError(store.PutApiToken(tokenHash, token, c))
+	}
+	return token.UserId, user, nil
+}
+
+type ApiHandlerFunc func(http.ResponseWriter, *http.Request, *Context, *User)
+
+// Like WrapHandler, but authenticates with an API token instead of the session
+// cookie, and reports errors (including panics) as JSON. The context's session
+// is set to the token's user, so that helpers like updatePayRequests work as
+// they do for logged-in users.
+func WrapApiHandler(fn ApiHandlerFunc) http.HandlerFunc {
+	handler := handlerName(fn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		c := &Context{}
+		sw := beginRequest(w, r, handler, c)
+		w = sw
+
+		defer func() {
+			if data := recover(); data != nil {
+				if err, ok := data.(*ApiError); ok {
+					ServeApiError(w, err)
+				} else {
+					c.Log().Error(fmt.Sprint(data))
+					panicsRecovered.Inc(c.Handler())
+					ServeApiError(w, newApiError(http.StatusInternalServerError, "internal", "Internal error"))
+				}
+			}
+			endRequest(r, sw, start, c)
+		}()
+
+		loadTemplatesIfNeeded()
+		// API error messages are not translated.
+		c.SetLocale(locales[0])
+		userId, user, err := authenticateApiRequest(r, c)
+		if err != nil {
+			ServeApiError(w, err)
+			return
+		}
+		c.SetSession(&Session{
+			UserId:    userId,
+			Timestamp: time.Now(),
+			Email:     user.Email,
+			FullName:  user.FullName,
+			Locale:    user.Locale,
+			TimeZone:  user.TimeZone,
+		})
+		fn(w, r, c, user)
+	}
+}
+
+// Decodes the JSON request body into v. An empty body leaves v unchanged.
+func decodeApiBody(r *http.Request, v interface{}) {
+	err := json.NewDecoder(io.LimitReader(r.Body, kMaxApiRequestBytes)).Decode(v)
+	if err != nil && err != io.EOF {
+		panic(newApiError(http.StatusBadRequest, "invalid_json", "Invalid JSON: %v", err))
+	}
+}
+
+// Calls parse, which should use one of the Parse* functions. Turns a panic
+// (i.e. a failed Assert or CheckError) into a 400 error for the given field.
+func parseApiField(field string, parse func()) {
+	defer func() {
+		if data := recover(); data != nil {
+			panic(newApiError(http.StatusBadRequest, "invalid_argument", "Invalid %s", field))
+		}
+	}()
+	parse()
+}
+
+// Returns the name for the given value in one of the string-to-enum maps in
+// data.go (e.g. paymentTypeMap).
+func lookupName(m map[string]int, value int) string {
+	for name, v := range m {
+		if v == value {
+			return name
+		}
+	}
+	return ""
+}
+
+////////////////////////////////////////
+// JSON representations
+
+type ApiReminderPolicy struct {
+	Mode      string  `json:"mode"` // "off", "every", or "offsets"
+	EveryDays int     `json:"everyDays,omitempty"`
+	Offsets   []int64 `json:"offsets,omitempty"`
+	MaxCount  int     `json:"maxCount,omitempty"`
+}
+
+type ApiPayRequest struct {
+	Id               string             `json:"id"`
+	PayerEmail       string             `json:"payerEmail"`
+	Amount           float32            `json:"amount"`
+	Description      string             `json:"description"`
+	PaymentType      string             `json:"paymentType"`
+	CreationDate     time.Time          `json:"creationDate"`
+	DueDate          string             `json:"dueDate,omitempty"` // YYYY-MM-DD
+	IsPaid           bool               `json:"isPaid"`
+	PaymentDate      *time.Time         `json:"paymentDate,omitempty"`
+	ReminderSentDate *time.Time         `json:"reminderSentDate,omitempty"`
+	IsOverdue        bool               `json:"isOverdue"`
+	IsBounced        bool               `json:"isBounced"`
+	ReminderPolicy   *ApiReminderPolicy `json:"reminderPolicy"`
+	PayUrl           string             `json:"payUrl"`
+}
+
+type ApiProfile struct {
+	Email           string             `json:"email"`
+	EmailVerified   bool               `json:"emailVerified"`
+	FullName        string             `json:"fullName"`
+	PayPalEmail     string             `json:"payPalEmail"`
+	Locale          string             `json:"locale"`   // empty means negotiated
+	TimeZone        string             `json:"timeZone"` // IANA name
+	DigestFrequency string             `json:"digestFrequency"`
+	ReminderPolicy  *ApiReminderPolicy `json:"reminderPolicy"`
+}
+
+func makeApiReminderPolicy(policy ReminderPolicy) *ApiReminderPolicy {
+	policy = effectiveReminderPolicy(policy)
+	res := &ApiReminderPolicy{
+		Mode:     lookupName(reminderModeMap, policy.Mode),
+		MaxCount: policy.MaxCount,
+	}
+	switch policy.Mode {
+	case RMEvery:
+		res.EveryDays = policy.EveryDays
+	case RMOffsets:
+		res.Offsets = policy.Offsets
+	}
+	return res
+}
+
+// Reuses ParseReminderPolicy, so that the API accepts exactly what the
+// reminder policy form accepts.
+func parseApiReminderPolicy(p *ApiReminderPolicy) ReminderPolicy {
+	offsets := make([]string, len(p.Offsets))
+	for i, offset := range p.Offsets {
+		offsets[i] = strconv.FormatInt(offset, 10)
+	}
+	maxCount := ""
+	if p.MaxCount > 0 {
+		maxCount = strconv.Itoa(p.MaxCount)
+	}
+	var policy ReminderPolicy
+	parseApiField("reminderPolicy", func() {
+		var ok bool
+		policy, ok = ParseReminderPolicy(
+			p.Mode, strconv.Itoa(p.EveryDays), strings.Join(offsets, ","), maxCount)
+		Assert(ok, "Missing reminder policy")
+	})
+	return policy
+}
+
+func makeApiPayRequest(reqCode string, req *PayRequest, c *Context) *ApiPayRequest {
+	res := &ApiPayRequest{
+		Id:             reqCode,
+		PayerEmail:     req.PayerEmail,
+		Amount:         req.Amount,
+		Description:    req.Description,
+		PaymentType:    lookupName(paymentTypeMap, req.PaymentType),
+		CreationDate:   req.CreationDate,
+		IsPaid:         req.IsPaid,
+		IsOverdue:      isOverdue(req, time.Now()),
+		IsBounced:      !req.IsPaid && isBounced(req),
+		ReminderPolicy: makeApiReminderPolicy(req.ReminderPolicy),
+		PayUrl:         prependHost(makePayUrl(reqCode, ""), c),
+	}
+	if hasDueDate(req) {
+		res.DueDate = req.DueDate.In(requestLocation(req)).Format("2006-01-02")
+	}
+	if req.PaymentDate != time.Unix(0, 0) {
+		res.PaymentDate = &req.PaymentDate
+	}
+	if req.ReminderSentDate != time.Unix(0, 0) {
+		res.ReminderSentDate = &req.ReminderSentDate
+	}
+	return res
+}
+
+func makeApiProfile(user *User) *ApiProfile {
+	return &ApiProfile{
+		Email:           user.Email,
+		EmailVerified:   user.EmailOk,
+		FullName:        user.FullName,
+		PayPalEmail:     user.PayPalEmail,
+		Locale:          user.Locale,
+		TimeZone:        getLocation(user.TimeZone).String(),
+		DigestFrequency: renderDigestFrequency(user.DigestFrequency),
+		ReminderPolicy:  makeApiReminderPolicy(user.ReminderPolicy),
+	}
+}
+
+////////////////////////////////////////
+// Handlers
+
+// Dispatches /api/v1/ requests by path and method.
+func handleApi(w http.ResponseWriter, r *http.Request, c *Context, user *User) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	route := func(methods map[string]func()) {
+		if fn, ok := methods[r.Method]; ok {
+			fn()
+			return
+		}
+		panic(newApiError(http.StatusMethodNotAllowed, "method_not_allowed",
+			"Method %s not allowed", r.Method))
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "profile":
+		route(map[string]func(){
+			"GET":   func() { ServeApiJson(w, http.StatusOK, makeApiProfile(user)) },
+			"PATCH": func() { handleApiUpdateProfile(w, r, c) },
+		})
+	case len(parts) == 1 && parts[0] == "requests":
+		route(map[string]func(){
+			"GET":  func() { handleApiListRequests(w, r, c) },
+			"POST": func() { handleApiCreateRequests(w, r, c, user) },
+		})
+	case len(parts) == 2 && parts[0] == "requests":
+		route(map[string]func(){
+			"GET":    func() { handleApiGetRequest(w, r, c, parts[1]) },
+			"DELETE": func() { handleApiDeleteRequest(w, r, c, parts[1]) },
+		})
+	case len(parts) == 3 && parts[0] == "requests" && parts[2] == "mark-paid":
+		route(map[string]func(){
+			"POST": func() { handleApiMarkAsPaid(w, r, c, parts[1]) },
+		})
+	case len(parts) == 3 && parts[0] == "requests" && parts[2] == "remind":
+		route(map[string]func(){
+			"POST": func() { handleApiSendReminder(w, r, c, user, parts[1]) },
+		})
+	default:
+		panic(errApiNotFound)
+	}
+}
+
+// Returns the logged-in user's non-deleted PayRequest with the given reqCode,
+// or panics with a 404 ApiError.
+func getApiPayRequest(reqCode string, c *Context) *PayRequest {
+	reqKey, err := datastore.DecodeKey(reqCode)
+	if err != nil || reqKey.Kind() != "PayRequest" || reqKey.Parent() == nil {
+		panic(errApiNotFound)
+	}
+	req, err := store.GetPayRequest(reqKey.Parent().IntID(), reqKey.IntID(), c)
+	if err == ErrNoSuchEntity {
+		panic(errApiNotFound)
+	}
+	CheckError(err)
+	if req.PayeeEmail != c.Session().Email || req.DeletionDate != time.Unix(0, 0) {
+		panic(errApiNotFound)
+	}
+	return req
+}
+
+func handleApiListRequests(w http.ResponseWriter, r *http.Request, c *Context) {
+	isPaid := false
+	switch r.FormValue("status") {
+	case "", "unpaid":
+	case "paid":
+		isPaid = true
+	default:
+		panic(newApiError(http.StatusBadRequest, "invalid_argument", "Invalid status"))
+	}
+	limit := kMaxPaymentsToShow
+	if v := r.FormValue("limit"); v != "" {
+		parseApiField("limit", func() { limit = ParsePositiveInt(v) })
+		if limit > kMaxApiListLimit {
+			limit = kMaxApiListLimit
+		}
+	}
+
+	userId := c.Session().UserId
+	reqIds, reqs, err := store.GetPayRequestsByStatus(userId, isPaid, limit, c)
+	CheckError(err)
+	res := make([]*ApiPayRequest, len(reqs))
+	for i := range reqs {
+		res[i] = makeApiPayRequest(MakeReqCode(userId, reqIds[i], c), &reqs[i], c)
+	}
+	ServeApiJson(w, http.StatusOK, map[string]interface{}{"requests": res})
+}
+
+type apiCreateRequestsBody struct {
+	Payers []struct {
+		Email  string  `json:"email"`
+		Amount float32 `json:"amount"`
+	} `json:"payers"`
+	Description    string             `json:"description"`
+	PaymentType    string             `json:"paymentType"` // defaults to "personal"
+	DueDate        string             `json:"dueDate"`     // YYYY-MM-DD, optional
+	ReminderPolicy *ApiReminderPolicy `json:"reminderPolicy"`
+}
+
+// Note similarity to handleRequestPayment().
+func handleApiCreateRequests(w http.ResponseWriter, r *http.Request, c *Context, user *User) {
+	body := &apiCreateRequestsBody{PaymentType: "personal"}
+	decodeApiBody(r, body)
+	if len(body.Payers) == 0 || len(body.Payers) > kMaxPayRequestsPerBatch {
+		panic(newApiError(http.StatusBadRequest, "invalid_argument",
+			"Must have between 1 and %d payers", kMaxPayRequestsPerBatch))
+	}
+
+	var paymentType int
+	parseApiField("paymentType", func() { paymentType = ParsePaymentType(body.PaymentType) })
+	creationDate := time.Now()
+	loc := getLocation(user.TimeZone)
+	var dueDate time.Time
+	parseApiField("dueDate", func() {
+		dueDate = ParseDueDate(body.DueDate, loc)
+		Assert(dueDate.Equal(time.Unix(0, 0)) || calendarDaysBetween(creationDate, dueDate, loc) >= 0,
+			"Due date is in the past: ", dueDate)
+	})
+	reminderPolicy := user.ReminderPolicy
+	if body.ReminderPolicy != nil {
+		reminderPolicy = parseApiReminderPolicy(body.ReminderPolicy)
+	}
+
+	reqs := make([]*PayRequest, len(body.Payers))
+	for i, payer := range body.Payers {
+		req := &PayRequest{
+			Amount:         payer.Amount,
+			PaymentType:    paymentType,
+			Description:    body.Description,
+			CreationDate:   creationDate,
+			DueDate:        dueDate,
+			ReminderPolicy: reminderPolicy,
+		}
+		parseApiField(fmt.Sprintf("payers[%d].email", i), func() { req.PayerEmail = ParseEmail(payer.Email) })
+		if payer.Amount <= 0 {
+			panic(newApiError(http.StatusBadRequest, "invalid_argument", "Invalid payers[%d].amount", i))
+		}
+		reqs[i] = req
+	}
+	reqCodes, err := doCreatePayRequests(user, reqs, c)
+	CheckError(err)
+
+	res := make([]*ApiPayRequest, len(reqs))
+	for i, req := range reqs {
+		res[i] = makeApiPayRequest(reqCodes[i], req, c)
+	}
+	ServeApiJson(w, http.StatusCreated, map[string]interface{}{"requests": res})
+}
+
+func handleApiGetRequest(w http.ResponseWriter, r *http.Request, c *Context, reqCode string) {
+	req := getApiPayRequest(reqCode, c)
+	ServeApiJson(w, http.StatusOK, makeApiPayRequest(reqCode, req, c))
+}
+
+func handleApiDeleteRequest(w http.ResponseWriter, r *http.Request, c *Context, reqCode string) {
+	getApiPayRequest(reqCode, c)
+	_, err := doDelete([]string{reqCode}, false, c)
+	CheckError(err)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleApiMarkAsPaid(w http.ResponseWriter, r *http.Request, c *Context, reqCode string) {
+	body := &struct {
+		Undo bool `json:"undo"`
+	}{}
+	decodeApiBody(r, body)
+	req := getApiPayRequest(reqCode, c)
+	if body.Undo && !req.IsPaid {
+		panic(newApiError(http.StatusConflict, "failed_precondition", "Request is not paid"))
+	}
+	_, err := doMarkAsPaid([]string{reqCode}, body.Undo, true, c)
+	CheckError(err)
+	handleApiGetRequest(w, r, c, reqCode)
+}
+
+// Like the "Send reminder email" button, the email is sent asynchronously, and
+// is skipped if one was sent recently; see handleSendPayRequestEmails.
+func handleApiSendReminder(w http.ResponseWriter, r *http.Request, c *Context, user *User, reqCode string) {
+	req := getApiPayRequest(reqCode, c)
+	if !user.EmailOk {
+		panic(newApiError(http.StatusConflict, "failed_precondition",
+			"Your email address has not been verified"))
+	} else if req.IsPaid {
+		panic(newApiError(http.StatusConflict, "failed_precondition", "Request is already paid"))
+	}
+	CheckError(doEnqueuePayRequestEmails([]string{reqCode}, c))
+	ServeApiJson(w, http.StatusAccepted, makeApiPayRequest(reqCode, req, c))
+}
+
+// All fields are optional; only the given fields are updated. The email
+// address cannot be changed; see handleSettings.
+type apiUpdateProfileBody struct {
+	FullName        *string            `json:"fullName"`
+	PayPalEmail     *string            `json:"payPalEmail"`
+	Locale          *string            `json:"locale"` // "auto" or empty to negotiate
+	TimeZone        *string            `json:"timeZone"`
+	DigestFrequency *string            `json:"digestFrequency"`
+	ReminderPolicy  *ApiReminderPolicy `json:"reminderPolicy"`
+}
+
+// Note similarity to handleSettings().
+func handleApiUpdateProfile(w http.ResponseWriter, r *http.Request, c *Context) {
+	body := &apiUpdateProfileBody{}
+	decodeApiBody(r, body)
+
+	// Parse everything before updating anything.
+	var fullName, payPalEmail, locale, timeZone string
+	var digestFrequency int
+	var reminderPolicy ReminderPolicy
+	if body.FullName != nil {
+		parseApiField("fullName", func() { fullName = ParseFullName(*body.FullName) })
+	}
+	if body.PayPalEmail != nil {
+		parseApiField("payPalEmail", func() { payPalEmail = ParseEmail(*body.PayPalEmail) })
+	}
+	if body.Locale != nil && *body.Locale != "" {
+		parseApiField("locale", func() { locale = ParseLocale(*body.Locale) })
+	}
+	if body.TimeZone != nil {
+		timeZone = ParseTimeZone(*body.TimeZone)
+		if timeZone == "" && *body.TimeZone != "" {
+			panic(newApiError(http.StatusBadRequest, "invalid_argument", "Invalid timeZone"))
+		}
+	}
+	if body.DigestFrequency != nil {
+		parseApiField("digestFrequency", func() {
+			digestFrequency = ParseDigestFrequency(*body.DigestFrequency)
+		})
+	}
+	if body.ReminderPolicy != nil {
+		reminderPolicy = parseApiReminderPolicy(body.ReminderPolicy)
+	}
+
+	var updatedUser *User
+	updateFn := func(user *User) bool {
+		updatedUser = user
+		if body.FullName != nil {
+			user.FullName = fullName
+		}
+		if body.PayPalEmail != nil {
+			user.PayPalEmail = payPalEmail
+		}
+		if body.Locale != nil {
+			user.Locale = locale
+		}
+		if body.TimeZone != nil {
+			user.TimeZone = timeZone
+		}
+		if body.DigestFrequency != nil {
+			user.DigestFrequency = digestFrequency
+		}
+		if body.ReminderPolicy != nil {
+			user.ReminderPolicy = reminderPolicy
+		}
+		return true
+	}
+	CheckError(updateUser(c.Session().UserId, nil, updateFn, c))
+	ServeApiJson(w, http.StatusOK, makeApiProfile(updatedUser))
+}
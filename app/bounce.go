@@ -0,0 +1,226 @@
+// Parses delivery status notifications (RFC 3464) and abuse feedback reports
+// (RFC 5965) for emails sent by Tadue.
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+var errNotDeliveryReport = errors.New("Not a delivery report")
+
+type DeliveryReport struct {
+	IsComplaint bool     // true for feedback reports, false for bounces
+	Recipients  []string // addresses that bounced permanently, or that complained
+	ReqCodes    []string // reqCodes found in the original message, if any
+	ReplyTo     []string // Reply-To addresses of the original message, if any
+	Details     string   // e.g. "5.1.1 (smtp; 550 User unknown)"
+}
+
+// Matches pay urls in the original message, e.g. "/pay?reqCode=...".
+var reqCodeRegexp = regexp.MustCompile(`reqCode=([A-Za-z0-9_\-]+)`)
+
+// Returns errNotDeliveryReport if the message is not a multipart/report.
+func ParseDeliveryReport(r io.Reader) (*DeliveryReport, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/report" {
+		return nil, errNotDeliveryReport
+	}
+	res := &DeliveryReport{}
+	switch strings.ToLower(params["report-type"]) {
+	case "delivery-status":
+	case "feedback-report":
+		res.IsComplaint = true
+	default:
+		return nil, errNotDeliveryReport
+	}
+
+	details := []string{}
+	originalTo := []string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			blocks, err := readHeaderBlocks(part)
+			if err != nil {
+				return nil, err
+			}
+			// The first block has per-message fields; the rest have per-recipient
+			// fields. We only care about permanent failures (status 5.X.X).
+			for i := 1; i < len(blocks); i++ {
+				b := blocks[i]
+				status := b.Get("Status")
+				if strings.ToLower(b.Get("Action")) != "failed" || !strings.HasPrefix(status, "5") {
+					continue
+				}
+				if email := parseReportAddress(b.Get("Final-Recipient")); email != "" {
+					res.Recipients = append(res.Recipients, email)
+					details = append(details, strings.TrimSpace(status+" "+b.Get("Diagnostic-Code")))
+				}
+			}
+		case "message/feedback-report":
+			blocks, err := readHeaderBlocks(part)
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range blocks {
+				for _, v := range b["Original-Rcpt-To"] {
+					if email := parseReportAddress(v); email != "" {
+						res.Recipients = append(res.Recipients, email)
+					}
+				}
+				if v := b.Get("Feedback-Type"); v != "" {
+					details = append(details, v)
+				}
+			}
+		case "message/rfc822", "text/rfc822-headers", "message/rfc822-headers":
+			to, replyTo, reqCodes, err := scanOriginalMessage(part)
+			if err != nil {
+				return nil, err
+			}
+			originalTo = append(originalTo, to...)
+			res.ReplyTo = append(res.ReplyTo, replyTo...)
+			res.ReqCodes = append(res.ReqCodes, reqCodes...)
+		}
+	}
+
+	// Feedback reports often redact Original-Rcpt-To, in which case we fall back
+	// to the recipients of the original message.
+	if res.IsComplaint && len(res.Recipients) == 0 {
+		res.Recipients = originalTo
+	}
+	res.Recipients = dedupStrings(res.Recipients)
+	res.ReqCodes = dedupStrings(res.ReqCodes)
+	res.ReplyTo = dedupStrings(res.ReplyTo)
+	res.Details = strings.Join(details, "; ")
+	return res, nil
+}
+
+// Reads a sequence of header blocks separated by blank lines, as found in
+// message/delivery-status and message/feedback-report parts.
+func readHeaderBlocks(r io.Reader) ([]textproto.MIMEHeader, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	blocks := []textproto.MIMEHeader{}
+	for {
+		h, err := tr.ReadMIMEHeader()
+		if len(h) > 0 {
+			blocks = append(blocks, h)
+		}
+		if err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parses values like "rfc822; john@example.com" or "<john@example.com>".
+// Returns an empty string if the value does not contain a valid address.
+func parseReportAddress(value string) string {
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[i+1:]
+	}
+	value = strings.Trim(strings.TrimSpace(value), "<>")
+	if !emailRegexp.MatchString(value) {
+		return ""
+	}
+	return ParseEmail(value)
+}
+
+// Returns the "To" and "Reply-To" addresses and any reqCodes found in the
+// original message (or just its headers) attached to a report.
+func scanOriginalMessage(r io.Reader) (to, replyTo, reqCodes []string, err error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	text := raw
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if addrs, err := msg.Header.AddressList("To"); err == nil {
+			for _, addr := range addrs {
+				if emailRegexp.MatchString(addr.Address) {
+					to = append(to, ParseEmail(addr.Address))
+				}
+			}
+		}
+		if addrs, err := msg.Header.AddressList("Reply-To"); err == nil {
+			for _, addr := range addrs {
+				replyTo = append(replyTo, addr.Address)
+			}
+		}
+		if body, err := decodeMessageBody(msg.Header, msg.Body); err == nil {
+			text = body
+		}
+	}
+	for _, m := range reqCodeRegexp.FindAllSubmatch(text, -1) {
+		reqCodes = append(reqCodes, string(m[1]))
+	}
+	return to, replyTo, reqCodes, nil
+}
+
+// Returns the decoded text of a message body, concatenating all parts of a
+// multipart body.
+func decodeMessageBody(header mail.Header, body io.Reader) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		res := &bytes.Buffer{}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return res.Bytes(), nil
+			} else if err != nil {
+				return nil, err
+			}
+			// Note: multipart.Reader decodes quoted-printable parts for us.
+			b, err := decodeMessageBody(mail.Header(part.Header), part)
+			if err != nil {
+				return nil, err
+			}
+			res.Write(b)
+		}
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return ioutil.ReadAll(body)
+}
+
+func dedupStrings(strs []string) []string {
+	res := []string{}
+	for _, s := range strs {
+		if !ContainsString(res, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
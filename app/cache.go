@@ -0,0 +1,212 @@
+// Memcache layer for User, UserId, and PayRequest entities, which are read on
+// almost every request (e.g. the payee User on every pay page, IPN, and email
+// task). Reads outside transactions check memcache first, and fill it on a
+// miss unless a writer got there first; writes go through to memcache once
+// they are committed, and deletes remove entities from it. Reads inside
+// transactions must go to the datastore.
+//
+// Two concurrent writers can leave memcache holding the older of two values,
+// so entries expire after kCacheExpirationMinutes. Memcache errors are logged
+// and otherwise ignored.
+//
+// Handlers reach this layer through DatastoreStore (see store.go); only code
+// that writes the datastore directly needs to call into it.
+
+package app
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+type cacheCounters struct {
+	hits, misses int64
+}
+
+// Per-instance hit and miss counters, keyed by kind. The set of keys is the set
+// of cached kinds.
+var cacheCountersMap = map[string]*cacheCounters{
+	"PayRequest": {},
+	"User":       {},
+	"UserId":     {},
+}
+
+type CacheStats struct {
+	Kind   string
+	Hits   int64
+	Misses int64
+}
+
+// Returns the hit and miss counts for this instance, sorted by kind.
+func GetCacheStats() []CacheStats {
+	kinds := []string{}
+	for kind := range cacheCountersMap {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	stats := make([]CacheStats, len(kinds))
+	for i, kind := range kinds {
+		counters := cacheCountersMap[kind]
+		stats[i] = CacheStats{
+			Kind:   kind,
+			Hits:   atomic.LoadInt64(&counters.hits),
+			Misses: atomic.LoadInt64(&counters.misses),
+		}
+	}
+	return stats
+}
+
+func isCachedKind(kind string) bool {
+	_, ok := cacheCountersMap[kind]
+	return ok
+}
+
+func toCacheKey(key *datastore.Key) string {
+	return "entity:" + key.Encode()
+}
+
+func newCacheItem(key *datastore.Key, src interface{}) *memcache.Item {
+	return &memcache.Item{
+		Key:        toCacheKey(key),
+		Object:     src,
+		Expiration: time.Minute * kCacheExpirationMinutes,
+	}
+}
+
+func cacheSet(c *Context, key *datastore.Key, src interface{}) {
+	if err := memcache.Gob.Set(c.Aec(), newCacheItem(key, src)); err != nil {
+		c.Log().Warning("Failed to cache", "key", key, "error", err)
+	}
+}
+
+// Like cacheSet, but does nothing if memcache already holds the entity. Used to
+// fill memcache after a datastore read, since a write that committed after the
+// read may have cached a newer value. This doesn't close the race entirely: if
+// the write commits and its cacheDelete runs between our read and our Add, the
+// Add restores the old value (or, after a delete, the deleted entity), and
+// readers see it until it expires after kCacheExpirationMinutes.
+func cacheAdd(c *Context, key *datastore.Key, src interface{}) {
+	err := memcache.Gob.Add(c.Aec(), newCacheItem(key, src))
+	if err != nil && err != memcache.ErrNotStored {
+		c.Log().Warning("Failed to cache", "key", key, "error", err)
+	}
+}
+
+// Removes the given entities from memcache. Callers that write cached kinds
+// without going through cachePut or a cacheWrites (e.g. the admin console)
+// must call this after the write commits.
+func cacheDelete(c *Context, keys ...*datastore.Key) {
+	cacheKeys := []string{}
+	for _, key := range keys {
+		if isCachedKind(key.Kind()) {
+			cacheKeys = append(cacheKeys, toCacheKey(key))
+		}
+	}
+	if len(cacheKeys) == 0 {
+		return
+	}
+	if err := memcache.DeleteMulti(c.Aec(), cacheKeys); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			for i, err := range merr {
+				if err != nil && err != memcache.ErrCacheMiss {
+					c.Log().Warning("Failed to uncache", "key", cacheKeys[i], "error", err)
+				}
+			}
+		} else {
+			c.Log().Warning("Failed to uncache", "keys", cacheKeys, "error", err)
+		}
+	}
+}
+
+// Like datastore.Get, but checks memcache first. dst must point to a zero
+// value. Must not be called in a transaction.
+func cacheGet(c *Context, key *datastore.Key, dst interface{}) error {
+	counters, ok := cacheCountersMap[key.Kind()]
+	if !ok {
+		return datastore.Get(c.Aec(), key, dst)
+	}
+	_, err := memcache.Gob.Get(c.Aec(), toCacheKey(key), dst)
+	if err == nil {
+		atomic.AddInt64(&counters.hits, 1)
+		return nil
+	}
+	atomic.AddInt64(&counters.misses, 1)
+	if err != memcache.ErrCacheMiss {
+		c.Log().Warning("Failed to get from cache", "key", key, "error", err)
+		// Undo any partial decoding.
+		v := reflect.ValueOf(dst).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
+	if err := datastore.Get(c.Aec(), key, dst); err != nil {
+		return err
+	}
+	cacheAdd(c, key, dst)
+	return nil
+}
+
+// Like datastore.Put, but also writes the entity to memcache. Must not be
+// called in a transaction; use runInTransactionWithCache instead.
+func cachePut(c *Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key, err := datastore.Put(c.Aec(), key, src)
+	if err == nil && isCachedKind(key.Kind()) {
+		cacheSet(c, key, src)
+	}
+	return key, err
+}
+
+// Records the writes made in a transaction, so that they can be applied to
+// memcache if it commits.
+type cacheWrites struct {
+	keys []*datastore.Key
+	srcs []interface{} // nil for deletes
+}
+
+// Like datastore.Put. src must not be modified after this call.
+func (cw *cacheWrites) put(aec appengine.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	key, err := datastore.Put(aec, key, src)
+	if err == nil && isCachedKind(key.Kind()) {
+		cw.keys = append(cw.keys, key)
+		cw.srcs = append(cw.srcs, src)
+	}
+	return key, err
+}
+
+// Like datastore.Delete.
+func (cw *cacheWrites) delete(aec appengine.Context, key *datastore.Key) error {
+	err := datastore.Delete(aec, key)
+	if err == nil && isCachedKind(key.Kind()) {
+		cw.keys = append(cw.keys, key)
+		cw.srcs = append(cw.srcs, nil)
+	}
+	return err
+}
+
+func (cw *cacheWrites) apply(c *Context) {
+	for i, key := range cw.keys {
+		if cw.srcs[i] == nil {
+			cacheDelete(c, key)
+		} else {
+			cacheSet(c, key, cw.srcs[i])
+		}
+	}
+}
+
+// Like datastore.RunInTransaction, but f should make its writes through cw, so
+// that they go through to memcache once the transaction commits.
+func runInTransactionWithCache(c *Context, f func(aec appengine.Context, cw *cacheWrites) error, opts *datastore.TransactionOptions) error {
+	var cw *cacheWrites
+	err := datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+		cw = &cacheWrites{} // ensure transaction is idempotent
+		return f(aec, cw)
+	}, opts)
+	if err == nil {
+		cw.apply(c)
+	}
+	return err
+}
@@ -1,10 +1,76 @@
 package app
 
 const (
-	kSessionCookieLifespan        = 14 // lifespan of session cookie in days
-	kVerifyEmailLifespan          = 2  // lifespan of VerifyEmail request in days
-	kResetPasswordLifespanMinutes = 15 // lifespan of ResetPassword request in minutes
-	kMaxPaymentsToShow            = 20 // max number of payments to show in list
-	kPayRequestEmailCooldown      = 1  // min number of days between pay request emails
-	kAutoPayRequestEmailFrequency = 7  // automatic reminder email frequency in days
+	kSessionCookieLifespan        = 14   // lifespan of session cookie in days
+	kVerifyEmailLifespan          = 2    // lifespan of email verification token in days
+	kResetPasswordLifespanMinutes = 15   // lifespan of password reset token in minutes
+	kMaxPaymentsToShow            = 20   // max number of payments to show in list
+	kMaxPaymentsToScan            = 1000 // max number of payments to scan (and maybe filter out) per page
+	kPayRequestEmailCooldown      = 1    // min number of days between pay request emails
+	kAutoPayRequestEmailFrequency = 7    // automatic reminder email frequency in days
+	kDueSoonDays                  = 3    // days before due date at which reminders escalate
+	kDueSoonEmailFrequency        = 2    // reminder email frequency in days when due soon
+	kOverdueEmailFrequency        = 1    // reminder email frequency in days when overdue
+)
+
+const (
+	kMaxPayRequestsPerBatch = 49   // max number of requests created in one transaction
+	kMaxImportRows          = 1000 // max number of rows in an imported CSV file
+)
+
+// Max number of API tokens per user.
+const kMaxApiTokens = 10
+
+const (
+	kMaxWebhooks                = 5  // max number of webhooks per user
+	kMaxWebhookAttempts         = 8  // max number of automatic delivery attempts
+	kWebhookTimeoutSeconds      = 10 // how long to wait for a webhook response
+	kMaxWebhookDeliveriesToShow = 50 // max number of deliveries to show in log
+)
+
+const (
+	kMaxJanitorDeletes = 5000 // max number of entities of each kind the janitor deletes per run
+	kJanitorBatchSize  = 500  // max number of entities deleted per datastore call
+)
+
+// How long entities stay in memcache; see cache.go.
+const kCacheExpirationMinutes = 60
+
+// Number of entities a data migration processes per task.
+const kMigrationBatchSize = 100
+
+// Number of days shown on the admin dashboard.
+const kDashboardDays = 30
+
+const kEmailSender = "Tadue <noreply@tadue.com>"
+
+// Used for users who have not set a time zone, and for requests they made.
+const kDefaultTimeZone = "America/Los_Angeles"
+
+// A payer's views of the pay page are recorded at most once per this many
+// hours; see doRecordPayPageView.
+const kPayPageViewIntervalHours = 24
+
+// Max length in bytes of a payer's email reply. Longer replies are truncated.
+const kMaxReplyLength = 10000
+
+// Outgoing email. kMailer is one of "appengine", "smtp", or "memory", or empty
+// for "memory" on the dev server and "appengine" otherwise. With "memory",
+// emails are not sent; they can be viewed at /dev/outbox.
+const (
+	kMailer   = ""
+	kSmtpAddr = "localhost:1025" // used if kMailer is "smtp"
+)
+
+// Storage backend for the payment flows; see store.go. kStorage is one of
+// "datastore" or "memory". With "memory", data is kept per instance and lost on
+// restart, so it is only useful for tests.
+const kStorage = "datastore"
+
+// Retention windows for the janitor (see janitor.go), in days. Expired
+// UserTokens are kept for a while, which helps when looking into reports of
+// broken links.
+const (
+	kExpiredTokenRetentionDays      = 7
+	kDeletedPayRequestRetentionDays = 90 // after soft deletion
 )
@@ -4,6 +4,8 @@
 package app
 
 import (
+	"time"
+
 	"appengine"
 )
 
@@ -12,6 +14,10 @@ type Context struct {
 	aec     appengine.Context
 	session *Session
 	flash   string
+	locale  string
+
+	requestId string
+	handler   string
 }
 
 func (c *Context) Get(key interface{}) interface{} {
@@ -40,6 +46,31 @@ func (c *Context) SetAec(aec appengine.Context) {
 	c.aec = aec
 }
 
+func (c *Context) RequestId() string {
+	return c.requestId
+}
+
+func (c *Context) SetRequestId(requestId string) {
+	c.requestId = requestId
+}
+
+func (c *Context) Handler() string {
+	return c.handler
+}
+
+func (c *Context) SetHandler(handler string) {
+	c.handler = handler
+}
+
+// Returns a logger that tags lines with the request ID, handler, and user ID.
+func (c *Context) Log() *Logger {
+	l := NewLogger(c.aec, "requestId", c.requestId, "handler", c.handler)
+	if c.session != nil {
+		l = l.With("userId", c.session.UserId)
+	}
+	return l
+}
+
 func (c *Context) LoggedIn() bool {
 	return c.session != nil
 }
@@ -72,3 +103,25 @@ func (c *Context) Flash() string {
 func (c *Context) SetFlash(flash string) {
 	c.flash = flash
 }
+
+func (c *Context) Locale() string {
+	return c.locale
+}
+
+func (c *Context) SetLocale(locale string) {
+	c.locale = locale
+}
+
+// Returns the logged-in user's time zone, or the default time zone if not
+// logged in.
+func (c *Context) Location() *time.Location {
+	if c.session == nil {
+		return getLocation("")
+	}
+	return getLocation(c.session.TimeZone)
+}
+
+// Translates msg into the locale of the current request.
+func (c *Context) T(msg string, args ...interface{}) string {
+	return Translate(c.locale, msg, args...)
+}
@@ -0,0 +1,331 @@
+// CSV export and import of payment requests. Exported files can be imported
+// again: both use the columns in csvExportHeader, and import ignores the columns
+// it doesn't need.
+
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var csvExportHeader = []string{
+	"id", "created", "payer_email", "amount", "description", "type", "due_date",
+	"status", "paid_date",
+}
+
+// Spreadsheet programs treat cells that start with these characters as
+// formulas, so we prefix such cells with a quote. Descriptions are
+// user-supplied, and payer emails may come from address books.
+func escapeCsvCell(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@") {
+		return "'" + s
+	}
+	return s
+}
+
+// Inverse of escapeCsvCell, so that exported files import cleanly.
+func unescapeCsvCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsAny(s[1:2], "=+-@") {
+		return s[1:]
+	}
+	return s
+}
+
+func formatCsvDate(t time.Time, loc *time.Location) string {
+	if !t.After(time.Unix(0, 0)) {
+		return ""
+	}
+	return t.In(loc).Format("2006-01-02")
+}
+
+type payRequestsByCreationDate struct {
+	reqCodes []string
+	reqs     []PayRequest
+}
+
+func (s *payRequestsByCreationDate) Len() int { return len(s.reqs) }
+func (s *payRequestsByCreationDate) Swap(i, j int) {
+	s.reqCodes[i], s.reqCodes[j] = s.reqCodes[j], s.reqCodes[i]
+	s.reqs[i], s.reqs[j] = s.reqs[j], s.reqs[i]
+}
+func (s *payRequestsByCreationDate) Less(i, j int) bool {
+	return s.reqs[i].CreationDate.Before(s.reqs[j].CreationDate)
+}
+
+// Writes all of the logged-in user's (non-deleted) requests as CSV, oldest
+// first. Optional params: "from" and "to" (YYYY-MM-DD, inclusive, in the user's
+// time zone) filter by creation date; "status" is "all", "paid", or "unpaid".
+func handleExportPayments(w http.ResponseWriter, r *http.Request, c *Context) {
+	if steerThroughLogin(w, r, c) {
+		return
+	}
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+	loc := c.Location()
+	from := ParseDueDate(r.FormValue("from"), loc)
+	to := ParseDueDate(r.FormValue("to"), loc)
+	if to.After(time.Unix(0, 0)) {
+		to = to.AddDate(0, 0, 1) // make exclusive
+	}
+	status := r.FormValue("status")
+	Assert(status == "" || status == "all" || status == "paid" || status == "unpaid",
+		fmt.Sprintf("Invalid status: %q", status))
+
+	// Filter in memory, since users have few enough requests that this is
+	// cheaper than maintaining an index for each combination of filters.
+	reqCodes := []string{}
+	reqs := []PayRequest{}
+	userId := c.Session().UserId
+	allReqIds, allReqs, err := store.GetPayRequests(userId, c)
+	CheckError(err)
+	for i, req := range allReqs {
+		if (status == "paid" && !req.IsPaid) || (status == "unpaid" && req.IsPaid) ||
+			req.CreationDate.Before(from) ||
+			(to.After(time.Unix(0, 0)) && !req.CreationDate.Before(to)) {
+			continue
+		}
+		reqCodes = append(reqCodes, MakeReqCode(userId, allReqIds[i], c))
+		reqs = append(reqs, req)
+	}
+	sort.Sort(&payRequestsByCreationDate{reqCodes, reqs})
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"tadue-%s.csv\"", time.Now().In(loc).Format("2006-01-02")))
+	cw := csv.NewWriter(w)
+	CheckError(cw.Write(csvExportHeader))
+	for i, req := range reqs {
+		status := "unpaid"
+		if req.IsPaid {
+			status = "paid"
+		}
+		CheckError(cw.Write([]string{
+			reqCodes[i],
+			formatCsvDate(req.CreationDate, loc),
+			escapeCsvCell(req.PayerEmail),
+			strconv.FormatFloat(float64(req.Amount), 'f', 2, 32),
+			escapeCsvCell(req.Description),
+			lookupName(paymentTypeMap, req.PaymentType),
+			formatCsvDate(req.DueDate, requestLocation(&req)),
+			status,
+			formatCsvDate(req.PaymentDate, loc),
+		}))
+	}
+	cw.Flush()
+	CheckError(cw.Error())
+}
+
+type ImportRow struct {
+	Line        int // line number in the CSV file
+	PayerEmail  string
+	Amount      string
+	Description string
+	PaymentType string
+	Error       string // empty if the row is valid
+	req         *PayRequest
+}
+
+// Calls parse, which should use one of the Parse* functions, and returns false
+// if it panics.
+func tryParse(parse func()) (ok bool) {
+	defer func() {
+		if data := recover(); data != nil {
+			ok = false
+		}
+	}()
+	parse()
+	return true
+}
+
+// Parses an uploaded CSV file. The first line must be a header naming the
+// columns; "payer_email" and "amount" are required, while "description" and
+// "type" (default "personal") are optional. Returns an error if the file as a
+// whole is invalid; otherwise, each returned row has its own Error.
+func parseImportCsv(r io.Reader, user *User, c *Context) ([]*ImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New(c.T("The file is empty."))
+	} else if err != nil {
+		return nil, errors.New(c.T("The file is not a valid CSV file."))
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"payer_email", "amount"} {
+		if _, ok := cols[name]; !ok {
+			return nil, errors.New(c.T("The file has no %q column.", name))
+		}
+	}
+	get := func(record []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	// Make it so all requests have the same creation date.
+	creationDate := time.Now()
+	rows := []*ImportRow{}
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New(c.T("The file is not a valid CSV file."))
+		}
+		if len(rows) == kMaxImportRows {
+			return nil, errors.New(c.T("The file has more than %d rows.", kMaxImportRows))
+		}
+		row := &ImportRow{
+			Line:        line,
+			PayerEmail:  unescapeCsvCell(get(record, "payer_email")),
+			Amount:      get(record, "amount"),
+			Description: unescapeCsvCell(get(record, "description")),
+			PaymentType: get(record, "type"),
+		}
+		if row.PaymentType == "" {
+			row.PaymentType = "personal"
+		}
+		rows = append(rows, row)
+
+		req := &PayRequest{
+			Description:    row.Description,
+			CreationDate:   creationDate,
+			DueDate:        time.Unix(0, 0),
+			ReminderPolicy: user.ReminderPolicy,
+		}
+		if !tryParse(func() { req.PayerEmail = ParseEmail(row.PayerEmail) }) {
+			row.Error = c.T("Invalid email address.")
+		} else if !tryParse(func() { req.Amount = ParseAmount(row.Amount) }) || req.Amount <= 0 {
+			row.Error = c.T("Invalid amount.")
+		} else if !tryParse(func() { req.PaymentType = ParsePaymentType(row.PaymentType) }) {
+			row.Error = c.T("Invalid payment type.")
+		} else {
+			row.req = req
+		}
+	}
+	if len(rows) == 0 {
+		return nil, errors.New(c.T("The file has no rows."))
+	}
+	return rows, nil
+}
+
+// Formats the given rows as a CSV file that parseImportCsv accepts.
+func formatImportCsv(rows []*ImportRow) string {
+	b := &bytes.Buffer{}
+	cw := csv.NewWriter(b)
+	cw.Write([]string{"payer_email", "amount", "description", "type"})
+	for _, row := range rows {
+		cw.Write([]string{escapeCsvCell(row.PayerEmail), row.Amount, escapeCsvCell(row.Description), row.PaymentType})
+	}
+	cw.Flush()
+	CheckError(cw.Error())
+	return b.String()
+}
+
+// Creates the requests for the given (valid) rows in batches, since
+// doCreatePayRequests is limited to kMaxPayRequestsPerBatch. Each batch is
+// created atomically, in order, so on error the first count rows were created
+// and the rest were not.
+func doImportPayRequests(user *User, rows []*ImportRow, c *Context) (int, error) {
+	reqs := make([]*PayRequest, len(rows))
+	for i, row := range rows {
+		Assert(row.req != nil, "Invalid row: ", row.Line)
+		reqs[i] = row.req
+	}
+	count := 0
+	for len(reqs) > 0 {
+		n := len(reqs)
+		if n > kMaxPayRequestsPerBatch {
+			n = kMaxPayRequestsPerBatch
+		}
+		reqCodes, err := doCreatePayRequests(user, reqs[:n], c)
+		count += len(reqCodes)
+		if err != nil {
+			return count, err
+		}
+		reqs = reqs[n:]
+	}
+	return count, nil
+}
+
+// GET shows the import and export forms. POST with a "file" upload shows a
+// preview of the rows to import; the preview page then POSTs the same CSV data
+// back (as "csv") with "confirm" set to create the requests.
+func handleImportPayments(w http.ResponseWriter, r *http.Request, c *Context) {
+	if steerThroughLogin(w, r, c) {
+		return
+	}
+	data := map[string]interface{}{}
+	if r.Method == "GET" {
+		RenderPageOrDie(w, c, "import-payments", data)
+		return
+	} else if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	user := GetUserFromSessionOrDie(c)
+	csvData := r.FormValue("csv")
+	if csvData == "" {
+		file, _, err := r.FormFile("file")
+		if err == http.ErrMissingFile {
+			data["error"] = c.T("Please choose a file.")
+			RenderPageOrDie(w, c, "import-payments", data)
+			return
+		}
+		CheckError(err)
+		defer file.Close()
+		b, err := ioutil.ReadAll(file)
+		CheckError(err)
+		csvData = string(b)
+	}
+	rows, err := parseImportCsv(strings.NewReader(csvData), user, c)
+	if err != nil {
+		data["error"] = err.Error()
+		RenderPageOrDie(w, c, "import-payments", data)
+		return
+	}
+	numErrors := 0
+	for _, row := range rows {
+		if row.Error != "" {
+			numErrors++
+		}
+	}
+
+	if r.FormValue("confirm") != "" && numErrors == 0 {
+		count, err := doImportPayRequests(user, rows, c)
+		if err == nil {
+			c.Log().Info("Imported PayRequests", "count", count)
+			RedirectWithMessage(w, r, "/payments", c.T("%d payment requests made.", count))
+			return
+		}
+		// Preview just the rows that were not created, so that confirming again
+		// does not create duplicates.
+		c.Log().Error("Failed to import PayRequests", "count", count, "remaining", len(rows)-count, "err", err)
+		data["error"] = c.T("%d payment requests made; the rest failed.", count)
+		rows = rows[count:]
+		csvData = formatImportCsv(rows)
+	}
+	data["rows"] = rows
+	data["numErrors"] = numErrors
+	data["csv"] = csvData
+	data["emailOk"] = user.EmailOk
+	RenderPageOrDie(w, c, "import-payments", data)
+}
@@ -0,0 +1,156 @@
+// Admin dashboard, at /admin/dashboard. Shows daily totals computed from the
+// PayRequests that are unpaid, or were created or paid recently: how many were
+// created and paid, the conversion rate from request to paid, the median time
+// to payment, and the outstanding amount. Unlike the metrics in metrics.go,
+// these cover all instances, and history.
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine/datastore"
+)
+
+type RenderableDashboardDay struct {
+	Date                string
+	Created             int
+	Paid                int // of the requests created that day
+	ConversionRate      string
+	MedianTimeToPayment string // of the requests paid that day
+	Outstanding         string // as of the end of the day
+}
+
+// Accumulates one day's (or the whole period's) totals.
+type dashboardDay struct {
+	start, end     time.Time
+	created, paid  int
+	timesToPayment []time.Duration
+	outstanding    float64
+}
+
+func (d *dashboardDay) add(req *PayRequest) {
+	isPaid := req.IsPaid
+	if !req.CreationDate.Before(d.start) && req.CreationDate.Before(d.end) {
+		d.created++
+		if isPaid {
+			d.paid++
+		}
+	}
+	if isPaid && !req.PaymentDate.Before(d.start) && req.PaymentDate.Before(d.end) {
+		d.timesToPayment = append(d.timesToPayment, req.PaymentDate.Sub(req.CreationDate))
+	}
+	isDeleted := req.DeletionDate != time.Unix(0, 0)
+	if req.CreationDate.Before(d.end) &&
+		(!isPaid || !req.PaymentDate.Before(d.end)) &&
+		(!isDeleted || !req.DeletionDate.Before(d.end)) {
+		d.outstanding += float64(req.Amount)
+	}
+}
+
+func (d *dashboardDay) render(date string) RenderableDashboardDay {
+	res := RenderableDashboardDay{
+		Date:                date,
+		Created:             d.created,
+		Paid:                d.paid,
+		ConversionRate:      "-",
+		MedianTimeToPayment: "-",
+		Outstanding:         renderAmount(float32(d.outstanding)),
+	}
+	if d.created > 0 {
+		res.ConversionRate = fmt.Sprintf("%.1f%%", 100*float64(d.paid)/float64(d.created))
+	}
+	if n := len(d.timesToPayment); n > 0 {
+		times := d.timesToPayment
+		sort.Sort(durationSlice(times))
+		median := times[n/2]
+		if n%2 == 0 {
+			median = (times[n/2-1] + times[n/2]) / 2
+		}
+		res.MedianTimeToPayment = renderTimeToPayment(median)
+	}
+	return res
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Renders d in hours if it is under two days, and in days otherwise.
+func renderTimeToPayment(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%.1f hours", d.Hours())
+	}
+	return fmt.Sprintf("%.1f days", d.Hours()/24)
+}
+
+// Returns the totals for each of the last numDays days in loc, most recent
+// first, and for the whole period. The period's outstanding amount is as of
+// now.
+func getDashboardDaysOrDie(numDays int, loc *time.Location, c *Context) ([]RenderableDashboardDay, RenderableDashboardDay) {
+	now := time.Now().In(loc)
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
+	days := make([]*dashboardDay, numDays)
+	for i := range days {
+		days[i] = &dashboardDay{
+			start: tomorrow.AddDate(0, 0, -i-1),
+			end:   tomorrow.AddDate(0, 0, -i),
+		}
+	}
+	period := &dashboardDay{start: days[numDays-1].start, end: tomorrow}
+
+	// Outstanding amounts depend on requests of any age, but only on those that
+	// are unpaid now or were paid during the period; the rest were paid before
+	// it started. Along with the requests created during the period, these are
+	// all the requests that affect the totals. Unpaid requests that have been
+	// deleted are left out, so they don't count toward earlier days' outstanding
+	// amounts. A request can match more than one query, so we skip the ones
+	// we've seen.
+	queries := []*datastore.Query{
+		makePayRequestQuery(nil, false),
+		datastore.NewQuery("PayRequest").Filter("PaymentDate >=", period.start),
+		datastore.NewQuery("PayRequest").Filter("CreationDate >=", period.start),
+	}
+	seen := map[string]bool{}
+	for _, q := range queries {
+		it := q.Run(c.Aec())
+		for {
+			req := &PayRequest{}
+			key, err := it.Next(req)
+			if err == datastore.Done {
+				break
+			}
+			CheckError(err)
+			if seen[key.Encode()] {
+				continue
+			}
+			seen[key.Encode()] = true
+			for _, day := range days {
+				day.add(req)
+			}
+			period.add(req)
+		}
+	}
+
+	res := make([]RenderableDashboardDay, numDays)
+	for i, day := range days {
+		res[i] = day.render(renderDate(day.start, loc))
+	}
+	return res, period.render(fmt.Sprintf("Last %d days", numDays))
+}
+
+func handleAdminDashboard(w http.ResponseWriter, r *http.Request, c *Context) {
+	days, total := getDashboardDaysOrDie(kDashboardDays, c.Location(), c)
+	data := map[string]interface{}{
+		"kinds":   getKindNames(),
+		"numDays": kDashboardDays,
+		"days":    days,
+		"total":   total,
+	}
+	RenderTemplateOrDie(w, c, "admin-dashboard", data)
+}
@@ -2,6 +2,8 @@ package app
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -26,6 +28,12 @@ type User struct {
 	FullName    string // full name of user
 	PayPalEmail string // paypal account email
 	EmailOk     bool   // true if user has verified their primary email
+	// Default reminder policy for new payment requests.
+	ReminderPolicy  ReminderPolicy
+	DigestFrequency int       // DFOff, DFWeekly, DFMonthly, or 0 for default (weekly)
+	DigestSentDate  time.Time // most recent summary email send date, or unix epoch
+	Locale          string    // preferred locale (e.g. "es"), or empty to negotiate
+	TimeZone        string    // e.g. "Europe/Paris", or empty for kDefaultTimeZone
 }
 
 // Keyed by service name (e.g. "google"), with User as parent.
@@ -44,6 +52,32 @@ const (
 	PTServices
 )
 
+// Summary email frequencies.
+const (
+	_         = iota
+	DFOff     // never send summary emails
+	DFWeekly  // send a summary email every week
+	DFMonthly // send a summary email every month
+)
+
+// Reminder modes.
+const (
+	_         = iota
+	RMOff     // never send automatic reminders
+	RMEvery   // send a reminder every EveryDays days
+	RMOffsets // send a reminder on each of the given days after creation
+)
+
+// Controls when automatic reminder emails are sent. The zero value (e.g. in
+// records written before this struct existed) means "use the default policy",
+// i.e. a reminder every kAutoPayRequestEmailFrequency days.
+type ReminderPolicy struct {
+	Mode      int     // RMOff, RMEvery, RMOffsets, or 0 for default
+	EveryDays int     // days between reminders, for RMEvery
+	Offsets   []int64 // days after creation date, in ascending order, for RMOffsets
+	MaxCount  int     // max number of automatic reminders, or 0 for no limit
+}
+
 // Keyed by int (NewIncompleteKey), with payee User as parent.
 // TODO(sadovsky):
 //  - Add field for currency code (same as in paypal request).
@@ -59,28 +93,168 @@ type PayRequest struct {
 	PaymentDate      time.Time // unix epoch if not yet paid in full
 	DeletionDate     time.Time // unix epoch if not deleted
 	ReminderSentDate time.Time // most recent reminder send date, or unix epoch
+	DueDate          time.Time // start of due date (in TimeZone), or unix epoch
+	OverdueSentDate  time.Time // when payee was told request is overdue, or unix epoch
+	ReminderPolicy   ReminderPolicy
+	ReminderCount    int       // number of automatic reminders sent so far
+	BounceDate       time.Time // when email to payer bounced, or unix epoch
+	PayerLocale      string    // locale for emails to payer, or empty if unknown
+	TimeZone         string    // payee's time zone when request was made; see User
+	PayerTimeZone    string    // time zone for emails to payer, or empty if unknown
 }
 
-// Keyed by secure random number (NewEphemeralKey).
-type VerifyEmail struct {
-	UserId    int64     // user to verify
-	Timestamp time.Time // when this request was made
+// Suppression reasons.
+const (
+	_             = iota
+	SRUnsubscribe // recipient clicked an unsubscribe link
+)
+
+// Keyed by email address string. We never send payment request emails,
+// including reminders, to suppressed addresses. Emails to a user about their
+// own account and payments are not affected.
+type Suppression struct {
+	Reason    int       // SRUnsubscribe
+	Timestamp time.Time // when this address was suppressed
+	Details   string    // for debugging
 }
 
-// Keyed by secure random number (NewEphemeralKey).
-type ResetPassword struct {
-	UserId    int64     // user for which to reset password
-	Timestamp time.Time // when this request was made
+// Commands that payers can send by replying to a payment request email.
+const (
+	_      = iota
+	RCPaid // payer says they have paid
+	RCStop // payer asks us to stop sending reminders
+)
+
+// Keyed by int (NewIncompleteKey), with PayRequest as parent.
+// Currently, comments are only created from payer email replies.
+type Comment struct {
+	Author      string // email of comment author
+	Body        string `datastore:",noindex"`
+	Timestamp   time.Time
+	Command     int       // RCPaid, RCStop, or 0 if none
+	ConfirmDate time.Time // when payee confirmed Command, or unix epoch
 }
 
-////////////////////////////////////////
-// Key factories
+// Payment request event types.
+const (
+	_          = iota
+	ETCreated  // payee made the request
+	ETEmailed  // payment request email sent for the first time
+	ETReminded // reminder email sent
+	ETViewed   // pay page viewed
+	ETPaid     // paid via PayPal or marked as paid; Detail is the method
+	ETUnpaid   // "mark as paid" undone
+	ETDeleted  // payee deleted the request
+	ETRestored // deletion undone
+)
+
+// Who caused a payment request event.
+const (
+	_        = iota
+	EAPayee  // the payee, via the website or API
+	EAPayer  // the payer, e.g. via the pay page
+	EASystem // Tadue itself, e.g. an automatic reminder
+)
 
-func NewEphemeralKey(c appengine.Context, kind string) *datastore.Key {
-	key := fmt.Sprintf("%v-%x", time.Now().Unix(), GenerateSecureRandomString())
-	return datastore.NewKey(c, kind, key, 0, nil)
+// Keyed by int (NewIncompleteKey), with PayRequest as parent. Events form an
+// append-only log; they are never modified or deleted.
+type PayRequestEvent struct {
+	Type   int // ETCreated, ETEmailed, etc.
+	Actor  int // EAPayee, EAPayer, or EASystem
+	Date   time.Time
+	Detail string `datastore:",noindex"` // e.g. payment method, or email recipient
 }
 
+// UserToken purposes.
+const (
+	TPVerifyEmail   = "verify-email"
+	TPResetPassword = "reset-password"
+)
+
+// Keyed by purpose (one of the TP* constants), with User as parent, so that
+// each user has at most one valid token per purpose; issuing a new token
+// overwrites the old one. See tokens.go.
+type UserToken struct {
+	Hash           string // see HashUserToken
+	CreationDate   time.Time
+	ExpirationDate time.Time
+	UsedDate       time.Time // unix epoch if not used
+}
+
+// Keyed by hash of token string (see HashApiToken). The token itself is only
+// shown to the user once, when it is created.
+type ApiToken struct {
+	UserId       int64     // user that this token authenticates as
+	Name         string    // user-supplied label, e.g. "billing script"
+	CreationDate time.Time // when this token was created
+	LastUsedDate time.Time // when this token was last used, or unix epoch
+}
+
+// Keyed by int (NewIncompleteKey). Records a change made via the admin
+// console.
+type AdminAuditEntry struct {
+	Admin   string // email of admin who made the change
+	Action  string // "update", "delete", or "migrate"
+	Kind    string // kind of changed entity
+	Key     string // encoded key of changed entity
+	Date    time.Time
+	Changes string `datastore:",noindex"` // JSON; see handleAdminEntity and handleAdminDelete
+}
+
+// Migration statuses.
+const (
+	MSRunning = "running"
+	MSDone    = "done"
+	MSFailed  = "failed"
+)
+
+// Keyed by migration name (see migrations in migrate.go). Records the state of
+// the latest run of a migration. A migration has been applied if its status is
+// MSDone and it was not a dry run.
+type Migration struct {
+	Version    int
+	Status     string // one of the MS* constants
+	DryRun     bool
+	Admin      string // email of admin who started the run
+	Cursor     string // where the next batch starts
+	Batch      int    // number of batches done
+	Scanned    int    // number of entities scanned
+	Changed    int    // number of entities changed (or, in a dry run, that would be)
+	Error      string `datastore:",noindex"` // set if status is MSFailed
+	StartDate  time.Time
+	UpdateDate time.Time
+	DoneDate   time.Time
+}
+
+// Singleton, keyed by "janitor". Records where the janitor's scans of whole
+// kinds resume; see janitor.go.
+type JanitorState struct {
+	OAuthTokenCursor string `datastore:",noindex"` // empty to start over
+}
+
+// Keyed by int (NewIncompleteKey), with User as parent.
+type Webhook struct {
+	Url          string // endpoint that receives event payloads
+	Secret       string // key for signing payloads; see signWebhookPayload
+	CreationDate time.Time
+}
+
+// Keyed by int (NewIncompleteKey), with Webhook as parent. There is one
+// delivery per event per webhook.
+type WebhookDelivery struct {
+	Event           string // e.g. "request.paid"
+	Payload         []byte `datastore:",noindex"` // JSON body
+	CreationDate    time.Time
+	Attempts        int       // number of delivery attempts so far
+	LastAttemptDate time.Time // unix epoch if not yet attempted
+	StatusCode      int       // HTTP status of last attempt, or 0 if there was none
+	Error           string    `datastore:",noindex"` // error from last attempt, if any
+	DeliveredDate   time.Time // when a 2xx response was received, or unix epoch
+}
+
+////////////////////////////////////////
+// Key factories
+
 func ToUserKey(c appengine.Context, userId int64) *datastore.Key {
 	return datastore.NewKey(c, "User", "", userId, nil)
 }
@@ -89,27 +263,40 @@ func ToUserIdKey(c appengine.Context, email string) *datastore.Key {
 	return datastore.NewKey(c, "UserId", email, 0, nil)
 }
 
+func ToSuppressionKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "Suppression", email, 0, nil)
+}
+
+func ToPayRequestKey(c appengine.Context, userId, reqId int64) *datastore.Key {
+	return datastore.NewKey(c, "PayRequest", "", reqId, ToUserKey(c, userId))
+}
+
+func ToApiTokenKey(c appengine.Context, tokenHash string) *datastore.Key {
+	return datastore.NewKey(c, "ApiToken", tokenHash, 0, nil)
+}
+
 func ToOAuthTokenKey(c appengine.Context, userId int64, service string) *datastore.Key {
 	userKey := ToUserKey(c, userId)
 	return datastore.NewKey(c, "OAuthToken", service, 0, userKey)
 }
 
+func ToWebhookKey(c appengine.Context, userId, webhookId int64) *datastore.Key {
+	return datastore.NewKey(c, "Webhook", "", webhookId, ToUserKey(c, userId))
+}
+
+func ToWebhookDeliveryKey(c appengine.Context, userId, webhookId, deliveryId int64) *datastore.Key {
+	return datastore.NewKey(c, "WebhookDelivery", "", deliveryId, ToWebhookKey(c, userId, webhookId))
+}
+
 ////////////////////////////////////////
 // Simple data getters
 
 func GetUserOrDie(key *datastore.Key, c *Context) *User {
-	user := &User{}
-	CheckError(datastore.Get(c.Aec(), key, user))
-	return user
+	return GetUserFromUserIdOrDie(key.IntID(), c)
 }
 
 func GetUserId(email string, c *Context) (int64, error) {
-	userIdKey := ToUserIdKey(c.Aec(), email)
-	userId := &UserId{}
-	if err := datastore.Get(c.Aec(), userIdKey, userId); err != nil {
-		return 0, err
-	}
-	return userId.UserId, nil
+	return store.GetUserId(email, c)
 }
 
 func GetUserIdOrDie(email string, c *Context) int64 {
@@ -119,12 +306,7 @@ func GetUserIdOrDie(email string, c *Context) int64 {
 }
 
 func GetUserFromUserId(userId int64, c *Context) (*User, error) {
-	userKey := ToUserKey(c.Aec(), userId)
-	user := &User{}
-	if err := datastore.Get(c.Aec(), userKey, user); err != nil {
-		return nil, err
-	}
-	return user, nil
+	return store.GetUser(userId, c)
 }
 
 func GetUserFromUserIdOrDie(userId int64, c *Context) *User {
@@ -156,17 +338,30 @@ func GetUserFromEmailOrDie(email string, c *Context) (int64, *User) {
 	return userId, user
 }
 
-func GetOAuthTokenFromUserId(userId int64, service string, c *Context) (*OAuthToken, error) {
-	tokenKey := ToOAuthTokenKey(c.Aec(), userId, service)
-	token := &OAuthToken{}
-	if err := datastore.Get(c.Aec(), tokenKey, token); err != nil {
-		return nil, err
+////////////////////////////////////////
+// Other util functions
+
+// Returns ErrNoSuchEntity if the given email is not suppressed.
+func GetSuppression(email string, c *Context) (*Suppression, error) {
+	return store.GetSuppression(email, c)
+}
+
+func IsSuppressedOrDie(email string, c *Context) bool {
+	_, err := GetSuppression(email, c)
+	if err == ErrNoSuchEntity {
+		return false
 	}
-	return token, nil
+	CheckError(err)
+	return true
 }
 
-////////////////////////////////////////
-// Other util functions
+// Returns a map from email to Suppression, containing only the given emails
+// that are suppressed.
+func GetSuppressionsOrDie(emails []string, c *Context) map[string]*Suppression {
+	sups, err := store.GetSuppressions(emails, c)
+	CheckError(err)
+	return sups
+}
 
 func GetPayeeUserKey(reqCode string) *datastore.Key {
 	reqKey, err := datastore.DecodeKey(reqCode)
@@ -192,6 +387,79 @@ func ParsePaymentType(paymentTypeStr string) int {
 	return res
 }
 
+var digestFrequencyMap = map[string]int{
+	"off":     DFOff,
+	"weekly":  DFWeekly,
+	"monthly": DFMonthly,
+}
+
+func ParseDigestFrequency(digestFrequencyStr string) int {
+	res := digestFrequencyMap[digestFrequencyStr]
+	Assert(res != 0, fmt.Sprintf("Invalid digestFrequencyStr: %q", digestFrequencyStr))
+	return res
+}
+
+// Returns an empty string if timeZone is empty or unknown (e.g. if the browser
+// could not detect it), meaning that kDefaultTimeZone should be used.
+func ParseTimeZone(timeZone string) string {
+	if timeZone == "" {
+		return ""
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return ""
+	}
+	return timeZone
+}
+
+// Returns an empty string for "auto", meaning that the locale should be
+// negotiated from the Accept-Language header.
+func ParseLocale(locale string) string {
+	if locale == "auto" {
+		return ""
+	}
+	Assert(isSupportedLocale(locale), fmt.Sprintf("Invalid locale: %q", locale))
+	return locale
+}
+
+var reminderModeMap = map[string]int{
+	"off":     RMOff,
+	"every":   RMEvery,
+	"offsets": RMOffsets,
+}
+
+// Parses the reminder policy form fields (see reminder-policy.html).
+// Returns ok=false if reminderMode is "default".
+func ParseReminderPolicy(reminderMode, everyDays, offsets, maxCount string) (policy ReminderPolicy, ok bool) {
+	if reminderMode == "default" {
+		return ReminderPolicy{}, false
+	}
+	policy.Mode = reminderModeMap[reminderMode]
+	Assert(policy.Mode != 0, fmt.Sprintf("Invalid reminderMode: %q", reminderMode))
+	switch policy.Mode {
+	case RMEvery:
+		policy.EveryDays = ParsePositiveInt(everyDays)
+	case RMOffsets:
+		prev := int64(0)
+		for _, offset := range strings.Split(offsets, ",") {
+			v := int64(ParsePositiveInt(strings.TrimSpace(offset)))
+			Assert(v > prev, fmt.Sprintf("Offsets must be in ascending order: %q", offsets))
+			policy.Offsets = append(policy.Offsets, v)
+			prev = v
+		}
+	}
+	if maxCount != "" {
+		policy.MaxCount = ParsePositiveInt(maxCount)
+	}
+	return policy, true
+}
+
+func ParsePositiveInt(value string) int {
+	res, err := strconv.Atoi(value)
+	CheckError(err)
+	Assert(res > 0, fmt.Sprintf("Not a positive int: %q", value))
+	return res
+}
+
 var emailRegexp = regexp.MustCompile(`^\S+@\S+\.\S+$`)
 
 func ParseEmail(email string) string {
@@ -206,6 +474,36 @@ func ParseAmount(amount string) float32 {
 	return float32(amount64)
 }
 
+// Webhook urls must be absolute http or https urls, and must not name an
+// internal host. Hostnames that resolve to internal addresses are caught when
+// delivering; see isWebhookAddrAllowed.
+func ParseWebhookUrl(webhookUrl string) string {
+	u, err := url.Parse(strings.TrimSpace(webhookUrl))
+	CheckError(err)
+	Assert((u.Scheme == "https" || u.Scheme == "http") && u.Host != "",
+		fmt.Sprintf("Invalid webhookUrl: %q", webhookUrl))
+	host := u.Host
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	Assert(host != "localhost" && !strings.HasSuffix(host, ".localhost") &&
+		(ip == nil || isWebhookAddrAllowed(ip)),
+		fmt.Sprintf("Invalid webhookUrl: %q", webhookUrl))
+	return u.String()
+}
+
+// Returns the unix epoch if dueDate is empty.
+func ParseDueDate(dueDate string, loc *time.Location) time.Time {
+	if dueDate == "" {
+		return time.Unix(0, 0)
+	}
+	t, err := time.ParseInLocation("2006-01-02", dueDate, loc)
+	CheckError(err)
+	return t
+}
+
 var fullNameRegexp = regexp.MustCompile(`^(?:\S+ )+\S+$`)
 
 func ParseFullName(fullName string) string {
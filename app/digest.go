@@ -0,0 +1,90 @@
+package app
+
+import (
+	"time"
+)
+
+// Replaces the zero DigestFrequency with the default frequency.
+func effectiveDigestFrequency(frequency int) int {
+	if frequency == 0 {
+		return DFWeekly
+	}
+	return frequency
+}
+
+// Returns the start of the period covered by a summary email sent now, e.g.
+// one week ago for weekly summaries.
+func digestPeriodStart(frequency int, now time.Time) time.Time {
+	switch effectiveDigestFrequency(frequency) {
+	case DFWeekly:
+		return now.AddDate(0, 0, -7)
+	case DFMonthly:
+		return now.AddDate(0, -1, 0)
+	}
+	panic("Invalid frequency")
+}
+
+// Returns true if a summary email should be sent to the given user. Note that
+// we do not check whether the user is owed money here; see
+// handleSendDigestEmail.
+func isDigestDue(user *User, now time.Time) bool {
+	if !user.EmailOk || effectiveDigestFrequency(user.DigestFrequency) == DFOff {
+		return false
+	}
+	since := digestPeriodStart(user.DigestFrequency, now)
+	return calendarDaysBetween(user.DigestSentDate, since, getLocation(user.TimeZone)) >= 0
+}
+
+func renderDigestFrequency(frequency int) string {
+	for name, df := range digestFrequencyMap {
+		if df == effectiveDigestFrequency(frequency) {
+			return name
+		}
+	}
+	panic("Invalid frequency")
+}
+
+// Builds the summary email for the given payee. Returns nil if the payee is
+// not owed any money.
+func makeDigestEmailData(payee *User, unpaid, paid []PayRequest, now time.Time, c *Context) *DigestEmailData {
+	if len(unpaid) == 0 {
+		return nil
+	}
+	data := &DigestEmailData{
+		FullName:    payee.FullName,
+		Frequency:   renderDigestFrequency(payee.DigestFrequency),
+		PaymentsUrl: prependHost("/payments", c),
+		SettingsUrl: prependHost("/settings", c),
+	}
+	loc := getLocation(payee.TimeZone)
+	var totalOwed, totalOverdue float32
+	for i := range unpaid {
+		req := &unpaid[i]
+		item := makeDigestItem(req)
+		item.Date = renderDate(req.CreationDate, loc)
+		if isOverdue(req, now) {
+			item.Date = renderDueDate(req)
+			data.Overdue = append(data.Overdue, item)
+			totalOverdue += req.Amount
+		} else {
+			data.Unpaid = append(data.Unpaid, item)
+		}
+		totalOwed += req.Amount
+	}
+	for i := range paid {
+		item := makeDigestItem(&paid[i])
+		item.Date = renderDate(paid[i].PaymentDate, loc)
+		data.Paid = append(data.Paid, item)
+	}
+	data.TotalOwed = renderAmount(totalOwed)
+	data.TotalOverdue = renderAmount(totalOverdue)
+	return data
+}
+
+func makeDigestItem(req *PayRequest) *DigestItem {
+	return &DigestItem{
+		PayerEmail:  req.PayerEmail,
+		Amount:      renderAmount(req.Amount),
+		Description: req.Description,
+	}
+}
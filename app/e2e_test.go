@@ -0,0 +1,431 @@
+// End-to-end tests for the main user journeys. Each test serves the handlers
+// registered in init() with httptest, in standalone mode, with fakes in place
+// of the outside world: a MemoryStore, a MemoryMailer, and a fake PayPal.
+// Tasks run in-process, in the background; expectEmail waits for them to
+// finish before checking the outbox.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Templates are read relative to the repository root.
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+////////////////////////////////////////
+// fakePayPal
+
+// Stands in for the Adaptive Payments "Pay" endpoint and the IPN validation
+// endpoint. Records Pay requests, and validates every IPN message.
+type fakePayPal struct {
+	mu          sync.Mutex
+	payRequests []url.Values
+	requestIds  []string // from the X-Tadue-Request-Id header of each call
+}
+
+func (p *fakePayPal) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.requestIds = append(p.requestIds, r.Header.Get(kRequestIdHeader))
+	p.mu.Unlock()
+	var res string
+	switch r.URL.String() {
+	case kPayEndpoint:
+		v, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		p.payRequests = append(p.payRequests, v)
+		res = fmt.Sprintf("responseEnvelope.ack=Success&payKey=AP-%d", len(p.payRequests))
+		p.mu.Unlock()
+	case kValidateIpnUrl:
+		res = "VERIFIED"
+	default:
+		return nil, fmt.Errorf("Unexpected request: %s", r.URL)
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(res)),
+		Request:    r,
+	}, nil
+}
+
+func (p *fakePayPal) lastPayRequest(t *testing.T) url.Values {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.payRequests) == 0 {
+		t.Fatalf("No Pay requests")
+	}
+	return p.payRequests[len(p.payRequests)-1]
+}
+
+////////////////////////////////////////
+// testServer
+
+type testServer struct {
+	t      *testing.T
+	server *httptest.Server
+	mailer *MemoryMailer
+	queue  *LocalTaskQueue
+	paypal *fakePayPal
+}
+
+// Replaces the app's globals, so tests must not run in parallel.
+func newTestServer(t *testing.T) *testServer {
+	ts := &testServer{
+		t:      t,
+		server: httptest.NewServer(newStandaloneHandler()),
+		mailer: &MemoryMailer{},
+		// Failed tasks are reported by the test that enqueued them; see
+		// expectEmail.
+		queue:  &LocalTaskQueue{Handler: http.DefaultServeMux, MaxAttempts: 1},
+		paypal: &fakePayPal{},
+	}
+	standalone = &StandaloneConfig{Hostname: strings.TrimPrefix(ts.server.URL, "http://")}
+	store = NewMemoryStore()
+	mailer = ts.mailer
+	taskQueue = ts.queue
+	newAppEngineContext = newStandaloneContext
+	newHttpTransport = func(deadline time.Duration, c *Context) http.RoundTripper {
+		return ts.paypal
+	}
+	return ts
+}
+
+func (ts *testServer) Close() {
+	ts.queue.Wait()
+	ts.server.Close()
+}
+
+// Waits for pending tasks, then checks that exactly one email was sent since
+// the last check, to the given address and with the given subject.
+func (ts *testServer) expectEmail(to, subject string) *SentEmail {
+	emails := ts.takeEmails()
+	if len(emails) != 1 {
+		ts.t.Fatalf("Got %d emails, want 1: %v", len(emails), emails)
+	}
+	email := emails[0]
+	if len(email.To) != 1 || email.To[0] != to || email.Subject != subject {
+		ts.t.Fatalf("Got email to %v with subject %q, want %q and %q", email.To, email.Subject, to, subject)
+	}
+	return email
+}
+
+func (ts *testServer) expectNoEmails() {
+	if emails := ts.takeEmails(); len(emails) != 0 {
+		ts.t.Fatalf("Got %d emails, want none: %v", len(emails), emails)
+	}
+}
+
+func (ts *testServer) takeEmails() []*SentEmail {
+	ts.queue.Wait()
+	emails := ts.mailer.Outbox()
+	ts.mailer.Clear()
+	return emails
+}
+
+// Returns the path and query of the first link in body to the given path.
+func (ts *testServer) findLink(body, path string) string {
+	link := regexp.MustCompile(regexp.QuoteMeta(ts.server.URL+path) + `\S*`).FindString(body)
+	if link == "" {
+		ts.t.Fatalf("No link to %q in: %s", path, body)
+	}
+	return strings.TrimPrefix(link, ts.server.URL)
+}
+
+////////////////////////////////////////
+// testBrowser
+
+// A browser with its own cookies. Does not follow redirects, so that tests can
+// check them.
+type testBrowser struct {
+	ts     *testServer
+	client *http.Client
+}
+
+type testResponse struct {
+	t         *testing.T
+	code      int
+	location  string
+	requestId string
+	body      string
+}
+
+func (ts *testServer) newBrowser() *testBrowser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return &testBrowser{ts, &http.Client{
+		Jar: jar,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+func (b *testBrowser) do(method, path string, params url.Values) *testResponse {
+	r, err := http.NewRequest(method, b.ts.server.URL+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		b.ts.t.Fatal(err)
+	}
+	if method == "POST" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	res, err := b.client.Do(r)
+	if err != nil {
+		b.ts.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		b.ts.t.Fatal(err)
+	}
+	return &testResponse{
+		t:         b.ts.t,
+		code:      res.StatusCode,
+		location:  res.Header.Get("Location"),
+		requestId: res.Header.Get(kRequestIdHeader),
+		body:      string(body),
+	}
+}
+
+func (b *testBrowser) get(path string) *testResponse {
+	return b.do("GET", path, nil)
+}
+
+func (b *testBrowser) post(path string, params url.Values) *testResponse {
+	return b.do("POST", path, params)
+}
+
+// Checks that res redirects to the given path, and returns the page it
+// redirects to, which shows any flash message.
+func (b *testBrowser) follow(res *testResponse, path string) *testResponse {
+	res.expectCode(http.StatusSeeOther)
+	if location := strings.TrimPrefix(res.location, b.ts.server.URL); location != path {
+		b.ts.t.Fatalf("Got redirect to %q, want %q", location, path)
+	}
+	return b.get(path).expectCode(http.StatusOK)
+}
+
+func (res *testResponse) expectCode(code int) *testResponse {
+	if res.code != code {
+		res.t.Fatalf("Got status %d (Location: %q), want %d: %s", res.code, res.location, code, res.body)
+	}
+	return res
+}
+
+func (res *testResponse) expectContains(substrs ...string) *testResponse {
+	for _, substr := range substrs {
+		if !strings.Contains(res.body, substr) {
+			res.t.Fatalf("Response does not contain %q: %s", substr, res.body)
+		}
+	}
+	return res
+}
+
+func (res *testResponse) expectNotContains(substr string) *testResponse {
+	if strings.Contains(res.body, substr) {
+		res.t.Fatalf("Response contains %q: %s", substr, res.body)
+	}
+	return res
+}
+
+////////////////////////////////////////
+// Journeys
+
+const (
+	testPayeeEmail = "pat@example.com"
+	testPayeeName  = "Pat Payee"
+	testPayerEmail = "sam@example.com"
+)
+
+// Signs up the payee and verifies their email address.
+func signUpPayee(ts *testServer) *testBrowser {
+	payee := ts.newBrowser()
+	res := payee.post("/signup", url.Values{
+		"signup-email":      {testPayeeEmail},
+		"signup-password":   {"correct horse"},
+		"signup-name":       {testPayeeName},
+		"signup-copy-email": {"on"},
+		"signup-time-zone":  {"America/New_York"},
+	})
+	payee.follow(res, "/payments?new").expectContains(testPayeeName)
+	email := ts.expectEmail(testPayeeEmail, "Welcome to Tadue")
+
+	res = payee.get(ts.findLink(email.Body, "/account/verif?token="))
+	payee.follow(res, "/").expectContains(fmt.Sprintf("Email address %s has been verified.", testPayeeEmail))
+	return payee
+}
+
+// Requests a payment from the payer, and returns the reqCode and the link from
+// the payment request email.
+func requestPayment(ts *testServer, payee *testBrowser) (string, string) {
+	res := payee.post("/request-payment", url.Values{
+		"payer-email-0": {testPayerEmail},
+		"amount-0":      {"12.50"},
+		"description":   {"Pizza"},
+		"payment-type":  {"personal"},
+		"due-date":      {""},
+		"reminder-mode": {"default"},
+	})
+	payee.follow(res, "/payments").expectContains("Payment request made.", testPayerEmail, "12.50", "Pizza")
+	email := ts.expectEmail(testPayerEmail, "Payment request from "+testPayeeName)
+
+	payPath := ts.findLink(email.Body, "/pay?reqCode=")
+	u, err := url.Parse(payPath)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return u.Query().Get("reqCode"), payPath
+}
+
+func TestPayWithPayPal(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	payee := signUpPayee(ts)
+	_, payPath := requestPayment(ts, payee)
+
+	payer := ts.newBrowser()
+	payer.get(payPath).expectCode(http.StatusOK).expectContains(testPayeeName, "12.50", "Pizza")
+	res := payer.get(payPath + "&method=paypal").expectCode(http.StatusSeeOther)
+	if !strings.HasPrefix(res.location, kPayBaseUrl) || !strings.Contains(res.location, "paykey=AP-1") {
+		t.Fatalf("Got redirect to %q, want PayPal", res.location)
+	}
+	payRequest := ts.paypal.lastPayRequest(t)
+	if got := payRequest.Get("receiverList.receiver(0).email"); got != testPayeeEmail {
+		t.Fatalf("Got receiver %q, want %q", got, testPayeeEmail)
+	}
+	if got := payRequest.Get("receiverList.receiver(0).amount"); got != "12.50" {
+		t.Fatalf("Got amount %q, want %q", got, "12.50")
+	}
+	ts.expectNoEmails()
+
+	// PayPal notifies us of the payment. The notification url's host is
+	// kAppHostnameForPayPal, not the test server.
+	ipnUrl := payRequest.Get("ipnNotificationUrl")
+	i := strings.Index(ipnUrl, "/ipn?")
+	if i < 0 {
+		t.Fatalf("Invalid ipnNotificationUrl: %q", ipnUrl)
+	}
+	ipnPath := ipnUrl[i:]
+
+	// The callbacks carry the ID of the request that sent the payment, so that
+	// one payment can be traced across requests.
+	requestId := res.requestId
+	if requestId == "" || !strings.Contains(ipnPath, "requestId="+requestId) {
+		t.Fatalf("Got ipnNotificationUrl %q, want requestId %q", ipnUrl, requestId)
+	}
+	ipn := url.Values{
+		"status":                  {"COMPLETED"},
+		"sender_email":            {testPayerEmail},
+		"transaction[0].receiver": {testPayeeEmail},
+		"transaction[0].amount":   {"USD 12.50"},
+		"pay_key":                 {"AP-1"},
+	}
+	paypal := ts.newBrowser()
+	if got := paypal.post(ipnPath, ipn).expectCode(http.StatusOK).requestId; got != requestId {
+		t.Fatalf("Got IPN request ID %q, want %q", got, requestId)
+	}
+	ts.expectEmail(testPayeeEmail, "You've been paid by "+testPayerEmail)
+	if got := ts.paypal.requestIds; len(got) != 2 || got[0] != requestId || got[1] != requestId {
+		t.Fatalf("Got PayPal call request IDs %v, want %q", got, requestId)
+	}
+	payee.get("/payments").expectCode(http.StatusOK).expectContains(`class="paid"`)
+
+	// PayPal sometimes sends more than one IPN for a payment.
+	paypal.post(ipnPath, ipn).expectCode(http.StatusOK)
+	ts.expectNoEmails()
+
+	payer.follow(payer.get(payPath), "/").expectContains("Already paid.")
+
+	// The metrics page is admin-only: App Engine requires an admin login for
+	// /admin/ (see app.yaml), and standalone mode does not serve it.
+	ts.newBrowser().get("/admin/metrics").expectCode(http.StatusNotFound)
+
+	// Metrics are global, so other tests may have added to the counts.
+	metrics := &bytes.Buffer{}
+	WriteMetrics(metrics)
+	(&testResponse{t: t, body: metrics.String()}).expectContains(
+		`tadue_pay_requests_created_total{handler="handleRequestPayment"}`,
+		`tadue_paypal_calls_total{call="pay",result="success"}`,
+		`tadue_paypal_calls_total{call="validate_ipn",result="verified"}`,
+		`tadue_payments_total{method="paypal",actor="payer"}`,
+		`tadue_emails_sent_total{kind="payment_done"}`,
+		`tadue_http_request_duration_seconds_bucket{handler="handleIpn",le="+Inf"}`)
+}
+
+func TestPayOffline(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	payee := signUpPayee(ts)
+	_, payPath := requestPayment(ts, payee)
+
+	payer := ts.newBrowser()
+	res := payer.get(payPath + "&method=offline")
+	payer.follow(res, "/").expectContains("Payment marked as complete. Thanks for using Tadue!")
+	ts.expectEmail(testPayeeEmail, "Your payment request was marked as paid by "+testPayerEmail)
+	payee.get("/payments").expectCode(http.StatusOK).expectContains(`class="paid"`)
+}
+
+func TestMarkAsPaidAndUndo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	payee := signUpPayee(ts)
+	reqCode, payPath := requestPayment(ts, payee)
+
+	payee.post("/payments/mark-as-paid", url.Values{"reqCodes": {reqCode}}).
+		expectCode(http.StatusOK).
+		expectContains(`class="paid"`, fmt.Sprintf(`id="undoable-req-codes" type="hidden" value="%s"`, reqCode))
+	payee.post("/payments/mark-as-paid", url.Values{"reqCodes": {reqCode}, "undo": {"true"}}).
+		expectCode(http.StatusOK).
+		expectContains(`class="unpaid"`).
+		expectNotContains(`class="paid"`)
+	// Neither change is emailed to anyone.
+	ts.expectNoEmails()
+
+	// The payer can still pay.
+	ts.newBrowser().get(payPath).expectCode(http.StatusOK).expectContains("12.50")
+}
+
+func TestDeleteAndUndo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	payee := signUpPayee(ts)
+	reqCode, _ := requestPayment(ts, payee)
+
+	payee.post("/payments/delete", url.Values{"reqCodes": {reqCode}}).
+		expectCode(http.StatusOK).
+		expectContains("No payment requests.", fmt.Sprintf(`value="%s"`, reqCode))
+	payee.get("/payments").expectCode(http.StatusOK).expectNotContains(testPayerEmail)
+
+	payee.post("/payments/delete", url.Values{"reqCodes": {reqCode}, "undo": {"true"}}).
+		expectCode(http.StatusOK).
+		expectContains(testPayerEmail)
+	payee.get("/payments").expectCode(http.StatusOK).expectContains(testPayerEmail, `class="unpaid"`)
+	ts.expectNoEmails()
+}
@@ -0,0 +1,83 @@
+package app
+
+// Template data for the emails sent by Tadue. Each email is rendered from a
+// text template (e.g. email-verif.txt) and an HTML template (e.g.
+// email-verif-body in email-verif.html); see ExecuteEmailTemplates.
+
+// Sent to a payer on behalf of a payee.
+// Templates: email-pay-request.
+type PayRequestEmailData struct {
+	PayerEmail            string
+	PayeeEmail            string // payee's paypal email
+	PayeeFullName         string
+	Amount                string
+	Description           string
+	CreationDate          string
+	DueDate               string // empty if request has no due date
+	IsReminder            bool
+	IsOverdue             bool
+	PayUrl                string
+	PayWithPayPalUrl      string
+	PayWithPayPalImageUrl string
+	MarkAsPaidUrl         string
+	UnsubscribeUrl        string
+}
+
+// Sent to a payee to tell them about a change in one of their requests.
+// Templates: email-got-paid, email-marked-as-paid, email-overdue.
+type PayeeNoticeEmailData struct {
+	PayeeFullName string
+	PayerEmail    string
+	Amount        string
+	Description   string
+	DueDate       string // empty if request has no due date
+	PaymentsUrl   string
+}
+
+// Templates: email-verif.
+type VerifEmailData struct {
+	FullName string
+	VerifUrl string
+}
+
+// Templates: email-reset-password.
+type ResetPasswordEmailData struct {
+	FullName string
+	Email    string
+	ResetUrl string
+}
+
+// Sent to a payee when a payer replies to a payment request email.
+// Templates: email-payer-reply.
+type PayerReplyEmailData struct {
+	PayeeFullName string
+	Author        string // email of the payer who replied
+	Body          string
+	Amount        string
+	Description   string
+	DueDate       string // empty if request has no due date
+	SaysPaid      bool   // reply starts with "paid"
+	AsksToStop    bool   // reply starts with "stop"
+	ReplyUrl      string // page where payee can confirm the command
+}
+
+// Sent periodically to payees who are owed money.
+// Templates: email-digest.
+type DigestEmailData struct {
+	FullName     string
+	Frequency    string // "weekly" or "monthly"
+	TotalOwed    string
+	TotalOverdue string
+	Overdue      []*DigestItem // Date is the due date
+	Unpaid       []*DigestItem // not overdue; Date is the request date
+	Paid         []*DigestItem // paid since last summary; Date is the payment date
+	PaymentsUrl  string
+	SettingsUrl  string
+}
+
+type DigestItem struct {
+	PayerEmail  string
+	Amount      string
+	Description string
+	Date        string
+}
@@ -0,0 +1,120 @@
+// Per-request event log (see PayRequestEvent), and the request detail page,
+// which shows it as a timeline.
+
+package app
+
+import (
+	"net/http"
+	"time"
+)
+
+// Returns a sentence describing the given event, from the payee's point of
+// view.
+func renderEvent(event *PayRequestEvent, c *Context) string {
+	switch event.Type {
+	case ETCreated:
+		return c.T("You made this request.")
+	case ETEmailed:
+		return c.T("Payment request emailed to %s.", event.Detail)
+	case ETReminded:
+		if event.Actor == EASystem {
+			return c.T("Automatic reminder emailed to %s.", event.Detail)
+		}
+		return c.T("Reminder emailed to %s.", event.Detail)
+	case ETViewed:
+		return c.T("Payer viewed the payment page.")
+	case ETPaid:
+		if event.Detail == "paypal" {
+			return c.T("Payer paid via PayPal.")
+		} else if event.Actor == EAPayer {
+			return c.T("Payer marked this request as paid.")
+		}
+		return c.T("You marked this request as paid.")
+	case ETUnpaid:
+		return c.T("You marked this request as unpaid.")
+	case ETDeleted:
+		return c.T("You deleted this request.")
+	case ETRestored:
+		return c.T("You restored this request.")
+	}
+	return c.T("Unknown event.")
+}
+
+// Records an ETViewed event, unless the payer already viewed the pay page in the
+// last kPayPageViewIntervalHours. Otherwise reloads, and link prefetches by mail
+// scanners, would flood the timeline.
+func doRecordPayPageView(userId, reqId int64, c *Context) error {
+	latest, err := store.GetLatestPayRequestEvent(userId, reqId, ETViewed, c)
+	if err != nil && err != ErrNoSuchEntity {
+		return err
+	}
+	if err == nil && time.Since(latest.Date) < kPayPageViewIntervalHours*time.Hour {
+		return nil
+	}
+	event := &PayRequestEvent{Type: ETViewed, Actor: EAPayer, Date: time.Now()}
+	return store.AddPayRequestEvent(userId, reqId, event, c)
+}
+
+type RenderableEvent struct {
+	Date        string
+	Time        string
+	Description string
+}
+
+func handlePayRequestDetail(w http.ResponseWriter, r *http.Request, c *Context) {
+	if steerThroughLogin(w, r, c) {
+		return
+	}
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+	reqCode := r.FormValue("key")
+	userId, reqId := ParseReqCode(reqCode)
+	req, err := store.GetPayRequest(userId, reqId, c)
+	if err == ErrNoSuchEntity {
+		Serve404(w)
+		return
+	}
+	CheckError(err)
+	if req.PayeeEmail != c.Session().Email {
+		Serve404(w)
+		return
+	}
+
+	events, err := store.GetPayRequestEvents(userId, reqId, c)
+	CheckError(err)
+	// Requests made before we started logging events have no ETCreated event.
+	if len(events) == 0 || events[0].Type != ETCreated {
+		created := PayRequestEvent{Type: ETCreated, Actor: EAPayee, Date: req.CreationDate}
+		events = append([]PayRequestEvent{created}, events...)
+	}
+	loc := c.Location()
+	rendEvents := make([]RenderableEvent, len(events))
+	for i := range events {
+		rendEvents[i] = RenderableEvent{
+			Date:        renderDate(events[i].Date, loc),
+			Time:        events[i].Date.In(loc).Format("15:04"),
+			Description: renderEvent(&events[i], c),
+		}
+	}
+
+	dueDate := ""
+	if hasDueDate(req) {
+		dueDate = renderDueDate(req)
+	}
+	data := map[string]interface{}{
+		"reqCode":     reqCode,
+		"payerEmail":  req.PayerEmail,
+		"amount":      renderAmount(req.Amount),
+		"description": req.Description,
+		"isPaid":      req.IsPaid,
+		"isDeleted":   req.DeletionDate.After(time.Unix(0, 0)),
+		"dueDate":     dueDate,
+		"dueStatus":   renderDueStatus(c.Locale(), req, time.Now()),
+		"reminders":   renderReminderPolicy(c.Locale(), req.ReminderPolicy),
+		"payUrl":      makePayUrl(reqCode, ""),
+		"events":      rendEvents,
+	}
+	RenderPageOrDie(w, c, "request-detail", data)
+}
@@ -0,0 +1,260 @@
+// Filtering, sorting, and pagination for the payments page. Filter state lives
+// in URL query params (see PaymentsFilter.Values), so that views can be
+// bookmarked, and so that the AJAX actions on the payments page can re-render
+// the same view.
+//
+// The datastore can only apply one inequality filter per query, and it must be
+// on the first sort property. So the datastore applies the status filter, the
+// sort order, and the range filter (date or amount) that matches the sort
+// order; we apply the remaining filters in memory while scanning results.
+
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Sort orders, keyed by URL param value. Each is a list of datastore orders.
+// "status" puts unpaid requests first, similar to an email inbox.
+var paymentsSortMap = map[string][]string{
+	"status":      {"IsPaid", "-CreationDate"},
+	"newest":      {"-CreationDate"},
+	"oldest":      {"CreationDate"},
+	"amount-desc": {"-Amount", "-CreationDate"},
+	"amount-asc":  {"Amount", "-CreationDate"},
+}
+
+type PaymentsFilter struct {
+	Status      string    // "all", "unpaid", or "paid"
+	PayerEmail  string    // empty means any payer
+	From        time.Time // unix epoch means no lower bound
+	To          time.Time // exclusive; unix epoch means no upper bound
+	MinAmount   float32   // 0 means no lower bound
+	MaxAmount   float32   // 0 means no upper bound
+	PaymentType int       // 0 means any type
+	Search      string    // lowercase; matched against description and payer email
+	Sort        string    // key in paymentsSortMap
+	Cursor      string    // where the current page starts; empty for first page
+
+	// Original URL param values, for rendering the filter form.
+	fromStr, toStr string
+}
+
+// Invalid params are ignored rather than reported, since they come from URLs
+// that users may have edited by hand.
+func ParsePaymentsFilter(r *http.Request, loc *time.Location) *PaymentsFilter {
+	f := &PaymentsFilter{
+		Status: "all",
+		From:   time.Unix(0, 0),
+		To:     time.Unix(0, 0),
+		Sort:   "status",
+		Cursor: r.FormValue("cursor"),
+	}
+	if v := r.FormValue("status"); v == "unpaid" || v == "paid" {
+		f.Status = v
+	}
+	if v := strings.TrimSpace(r.FormValue("payer")); v != "" {
+		tryParse(func() { f.PayerEmail = ParseEmail(v) })
+	}
+	if v := r.FormValue("from"); v != "" && tryParse(func() { f.From = ParseDueDate(v, loc) }) {
+		f.fromStr = v
+	}
+	if v := r.FormValue("to"); v != "" && tryParse(func() { f.To = ParseDueDate(v, loc).AddDate(0, 0, 1) }) {
+		f.toStr = v
+	}
+	if v := r.FormValue("min"); v != "" {
+		tryParse(func() { f.MinAmount = ParseAmount(v) })
+	}
+	if v := r.FormValue("max"); v != "" {
+		tryParse(func() { f.MaxAmount = ParseAmount(v) })
+	}
+	if v := r.FormValue("type"); v != "" {
+		tryParse(func() { f.PaymentType = ParsePaymentType(v) })
+	}
+	f.Search = strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if _, ok := paymentsSortMap[r.FormValue("sort")]; ok {
+		f.Sort = r.FormValue("sort")
+	}
+	return f
+}
+
+// Returns the URL params for this filter, without the cursor. Params with
+// default values are omitted.
+func (f *PaymentsFilter) Values() url.Values {
+	v := url.Values{}
+	if f.Status != "all" {
+		v.Set("status", f.Status)
+	}
+	if f.PayerEmail != "" {
+		v.Set("payer", f.PayerEmail)
+	}
+	if f.fromStr != "" {
+		v.Set("from", f.fromStr)
+	}
+	if f.toStr != "" {
+		v.Set("to", f.toStr)
+	}
+	if f.MinAmount != 0 {
+		v.Set("min", strconv.FormatFloat(float64(f.MinAmount), 'f', -1, 32))
+	}
+	if f.MaxAmount != 0 {
+		v.Set("max", strconv.FormatFloat(float64(f.MaxAmount), 'f', -1, 32))
+	}
+	if f.PaymentType != 0 {
+		v.Set("type", lookupName(paymentTypeMap, f.PaymentType))
+	}
+	if f.Search != "" {
+		v.Set("q", f.Search)
+	}
+	if f.Sort != "status" {
+		v.Set("sort", f.Sort)
+	}
+	return v
+}
+
+// Returns true if any filter (not counting sort order or cursor) is active.
+func (f *PaymentsFilter) IsActive() bool {
+	v := f.Values()
+	v.Del("sort")
+	return len(v) > 0
+}
+
+func (f *PaymentsFilter) hasDateRange() bool {
+	return f.From.After(time.Unix(0, 0)) || f.To.After(time.Unix(0, 0))
+}
+
+func (f *PaymentsFilter) hasAmountRange() bool {
+	return f.MinAmount != 0 || f.MaxAmount != 0
+}
+
+// Returns the datastore query for this filter. See the comment at the top of
+// this file for which filters it applies.
+func (f *PaymentsFilter) makeQuery(userKey *datastore.Key) *datastore.Query {
+	q := datastore.NewQuery("PayRequest").Ancestor(userKey).Filter("DeletionDate =", time.Unix(0, 0))
+	// NOTE(sadovsky): Because GAE does not allow Filter("x !="), and also does
+	// not allow Filter("x >") with Order("y") for x != y, we must filter on
+	// IsPaid rather than PaymentDate.
+	if f.Status != "all" {
+		q = q.Filter("IsPaid =", f.Status == "paid")
+	}
+	orders := paymentsSortMap[f.Sort]
+	switch strings.TrimPrefix(orders[0], "-") {
+	case "CreationDate":
+		if f.From.After(time.Unix(0, 0)) {
+			q = q.Filter("CreationDate >=", f.From)
+		}
+		if f.To.After(time.Unix(0, 0)) {
+			q = q.Filter("CreationDate <", f.To)
+		}
+	case "Amount":
+		if f.MinAmount != 0 {
+			q = q.Filter("Amount >=", f.MinAmount)
+		}
+		if f.MaxAmount != 0 {
+			q = q.Filter("Amount <=", f.MaxAmount)
+		}
+	}
+	for _, order := range orders {
+		q = q.Order(order)
+	}
+	return q
+}
+
+// Applies the filters that makeQuery does not.
+func (f *PaymentsFilter) matches(req *PayRequest) bool {
+	if f.PayerEmail != "" && req.PayerEmail != f.PayerEmail {
+		return false
+	}
+	if f.PaymentType != 0 && req.PaymentType != f.PaymentType {
+		return false
+	}
+	if f.hasDateRange() && (req.CreationDate.Before(f.From) ||
+		(f.To.After(time.Unix(0, 0)) && !req.CreationDate.Before(f.To))) {
+		return false
+	}
+	if f.hasAmountRange() && (req.Amount < f.MinAmount ||
+		(f.MaxAmount != 0 && req.Amount > f.MaxAmount)) {
+		return false
+	}
+	if f.Search != "" && !strings.Contains(strings.ToLower(req.Description), f.Search) &&
+		!strings.Contains(req.PayerEmail, f.Search) {
+		return false
+	}
+	return true
+}
+
+// Like the sort order of makeQuery, for sorting requests in memory.
+func (f *PaymentsFilter) less(a, b *PayRequest) bool {
+	for _, order := range paymentsSortMap[f.Sort] {
+		prop := strings.TrimPrefix(order, "-")
+		x, y := a, b
+		if prop != order {
+			x, y = b, a
+		}
+		switch prop {
+		case "IsPaid":
+			if x.IsPaid != y.IsPaid {
+				return !x.IsPaid
+			}
+		case "CreationDate":
+			if !x.CreationDate.Equal(y.CreationDate) {
+				return x.CreationDate.Before(y.CreationDate)
+			}
+		case "Amount":
+			if x.Amount != y.Amount {
+				return x.Amount < y.Amount
+			}
+		default:
+			panic("Unknown sort property: " + prop)
+		}
+	}
+	return false
+}
+
+// Returns up to kMaxPaymentsToShow matching requests starting at f.Cursor,
+// along with the cursor for the next page, which is empty if there are no more
+// results. Used by DatastoreStore.
+func queryPayRequestsPage(userKey *datastore.Key, f *PaymentsFilter, aec appengine.Context) ([]*datastore.Key, []PayRequest, string, error) {
+	q := f.makeQuery(userKey)
+	if f.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(f.Cursor)
+		if err == nil {
+			q = q.Start(cursor)
+		} else {
+			aec.Warningf("Ignoring invalid cursor %q: %v", f.Cursor, err)
+		}
+	}
+
+	reqKeys := []*datastore.Key{}
+	reqs := []PayRequest{}
+	it := q.Run(aec)
+	for scanned := 0; ; scanned++ {
+		if len(reqs) == kMaxPaymentsToShow || scanned == kMaxPaymentsToScan {
+			// There may be more results. If not, the next page will be empty, which
+			// is fine.
+			cursor, err := it.Cursor()
+			if err != nil {
+				return nil, nil, "", err
+			}
+			return reqKeys, reqs, cursor.String(), nil
+		}
+		req := PayRequest{}
+		reqKey, err := it.Next(&req)
+		if err == datastore.Done {
+			return reqKeys, reqs, "", nil
+		} else if err != nil {
+			return nil, nil, "", err
+		}
+		if f.matches(&req) {
+			reqKeys = append(reqKeys, reqKey)
+			reqs = append(reqs, req)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Message catalogs and locale negotiation. Messages are identified by their
+// English text, which is used as-is if a locale has no translation for them.
+// Templates translate messages with the "T" and "TL" functions; Go code uses
+// Context.T or Translate.
+
+package app
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	text_template "text/template"
+
+	"appengine"
+)
+
+// Supported locales. The first one is the default.
+var locales = []string{"en", "es"}
+
+// Maps locale to message catalog. English needs no catalog.
+var catalogs = map[string]map[string]string{
+	"es": catalogEs,
+}
+
+// Names of locales, in their own language, for the settings page.
+var localeNames = map[string]string{
+	"en": "English",
+	"es": "Español",
+}
+
+func isSupportedLocale(locale string) bool {
+	return ContainsString(locales, locale)
+}
+
+// Returns the locale to use for emails to a user with the given preference.
+func effectiveLocale(locale string) string {
+	if !isSupportedLocale(locale) {
+		return locales[0]
+	}
+	return locale
+}
+
+// Translates msg into the given locale. If args are given, msg is used as a
+// fmt format string.
+func Translate(locale, msg string, args ...interface{}) string {
+	if translated, ok := catalogs[locale][msg]; ok {
+		msg = translated
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Translates msg, then turns the text between "[" and "]" into a link to url.
+// Used for sentences that contain a link, since word order varies by locale.
+// If given, style is set as the link's style attribute (e.g. for emails).
+func TranslateWithLink(locale, msg, url string, style ...string) template.HTML {
+	msg = Translate(locale, msg)
+	start, end := strings.Index(msg, "["), strings.LastIndex(msg, "]")
+	if start < 0 || end < start {
+		return template.HTML(template.HTMLEscapeString(msg))
+	}
+	link := fmt.Sprintf(`<a href="%s"`, template.HTMLEscapeString(url))
+	if len(style) > 0 {
+		link += fmt.Sprintf(` style="%s"`, template.HTMLEscapeString(style[0]))
+	}
+	return template.HTML(template.HTMLEscapeString(msg[:start]) + link + ">" +
+		template.HTMLEscapeString(msg[start+1:end]) + "</a>" +
+		template.HTMLEscapeString(msg[end+1:]))
+}
+
+// Returns the supported locale that best matches the given Accept-Language
+// header value, or the default locale if none match. Only the primary language
+// subtag is considered, e.g. "es-MX" matches "es".
+func NegotiateLocale(acceptLanguage string) string {
+	best, bestQ := locales[0], 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		lang = strings.SplitN(lang, "-", 2)[0]
+		q := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if v, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if isSupportedLocale(lang) && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// Uses the logged-in user's preferred locale if set, and otherwise negotiates
+// a locale from the Accept-Language header.
+func chooseLocale(r *http.Request, c *Context) string {
+	if c.LoggedIn() && isSupportedLocale(c.Session().Locale) {
+		return c.Session().Locale
+	}
+	return NegotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+type LocaleOption struct {
+	Locale string
+	Name   string
+}
+
+// Returns supported locales for the settings page, sorted by name.
+func getLocaleOptions() []LocaleOption {
+	res := make([]LocaleOption, len(locales))
+	for i, locale := range locales {
+		res[i] = LocaleOption{Locale: locale, Name: localeNames[locale]}
+	}
+	sort.Sort(localeOptionsByName(res))
+	return res
+}
+
+type localeOptionsByName []LocaleOption
+
+func (s localeOptionsByName) Len() int           { return len(s) }
+func (s localeOptionsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s localeOptionsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+////////////////////////////////////////
+// Templates
+
+// Template sets, keyed by locale. Each set is parsed with its own translation
+// functions, since html/template does not allow changing a template's
+// functions once it has been executed. Loaded by the first request rather than
+// at init time, since standalone mode and tests change the working directory
+// at startup. Guarded by tmplsMu, since the dev server replaces them while
+// other requests may be reading them.
+var tmpls map[string]*template.Template
+var textTmpls map[string]*text_template.Template
+var tmplsMu sync.RWMutex
+var loadTemplatesOnce sync.Once
+
+// On the dev server, reloads templates on every request, so that edits take
+// effect without a restart.
+func loadTemplatesIfNeeded() {
+	if appengine.IsDevAppServer() {
+		setTemplates(loadTemplates())
+		return
+	}
+	loadTemplatesOnce.Do(func() {
+		setTemplates(loadTemplates())
+	})
+}
+
+func setTemplates(htmlSets map[string]*template.Template, textSets map[string]*text_template.Template) {
+	tmplsMu.Lock()
+	defer tmplsMu.Unlock()
+	tmpls, textTmpls = htmlSets, textSets
+}
+
+// Returns the HTML template set for the given locale.
+func getTemplates(locale string) *template.Template {
+	tmplsMu.RLock()
+	defer tmplsMu.RUnlock()
+	return tmpls[locale]
+}
+
+// Returns the text template set for the given locale.
+func getTextTemplates(locale string) *text_template.Template {
+	tmplsMu.RLock()
+	defer tmplsMu.RUnlock()
+	return textTmpls[locale]
+}
+
+func loadTemplates() (map[string]*template.Template, map[string]*text_template.Template) {
+	htmlSets := map[string]*template.Template{}
+	textSets := map[string]*text_template.Template{}
+	for _, locale := range locales {
+		locale := locale
+		t := func(msg string, args ...interface{}) string {
+			return Translate(locale, msg, args...)
+		}
+		tl := func(msg, url string, style ...string) template.HTML {
+			return TranslateWithLink(locale, msg, url, style...)
+		}
+		htmlSets[locale] = template.Must(template.New("").Funcs(
+			template.FuncMap{"T": t, "TL": tl}).ParseGlob("templates/*.html"))
+		textSets[locale] = text_template.Must(text_template.New("").Funcs(
+			text_template.FuncMap{"T": t}).ParseGlob("templates/*.txt"))
+	}
+	return htmlSets, textSets
+}
@@ -0,0 +1,335 @@
+// Spanish message catalog. Keys are the English messages; see i18n.go.
+
+package app
+
+var catalogEs = map[string]string{
+	// Page chrome.
+	"Request payment": "Solicitar pago",
+	"Payments":        "Pagos",
+	"Settings":        "Configuración",
+	"Log out":         "Cerrar sesión",
+	"Sign up":         "Registrarse",
+	"Log in":          "Iniciar sesión",
+	"About":           "Acerca de",
+	"Privacy":         "Privacidad",
+	"Terms":           "Términos",
+	"Help":            "Ayuda",
+	"Home":            "Inicio",
+
+	// Common.
+	"Save":            "Guardar",
+	"Cancel":          "Cancelar",
+	"Submit":          "Enviar",
+	"Email":           "Correo electrónico",
+	"Password":        "Contraseña",
+	"Amount":          "Importe",
+	"Description":     "Descripción",
+	"Due date":        "Fecha de vencimiento",
+	"Amount: %s":      "Importe: %s",
+	"Description: %s": "Descripción: %s",
+	"Due date: %s":    "Fecha de vencimiento: %s",
+	"Overdue":         "Vencido",
+	"Unpaid":          "Sin pagar",
+	"Never":           "Nunca",
+	"Unsubscribe":     "Darse de baja",
+	"Hello %s,":       "Hola, %s:",
+	"Thanks,":         "Gracias,",
+	"The Tadue Team":  "El equipo de Tadue",
+
+	// Change and reset password.
+	"Change Password":  "Cambiar contraseña",
+	"Change password":  "Cambiar contraseña",
+	"Current password": "Contraseña actual",
+	"New password":     "Nueva contraseña",
+	"Confirm password": "Confirmar contraseña",
+	"Reset Password":   "Restablecer contraseña",
+	"Reset password":   "Restablecer contraseña",
+
+	// Emails.
+	"This email was sent by [Tadue], the easy way to request and track payments.": "Este correo fue enviado por [Tadue], la forma fácil de solicitar pagos y darles seguimiento.",
+	"Here is your monthly summary from Tadue.":                                    "Este es tu resumen mensual de Tadue.",
+	"Here is your weekly summary from Tadue.":                                     "Este es tu resumen semanal de Tadue.",
+	"You are owed %s in total.":                                                   "Te deben %s en total.",
+	"Recently paid":                                                               "Pagados recientemente",
+	"To check on all of your payment requests, visit your [payments page].":       "Para revisar todas tus solicitudes de pago, visita tu [página de pagos].",
+	"To change how often you receive these emails, visit your [settings page].":   "Para cambiar la frecuencia de estos correos, visita tu [página de configuración].",
+	"Overdue (%s):":                     "Vencidos (%s):",
+	`%s from %s for "%s", due %s`:       `%s de %s por "%s", vencía el %s`,
+	"Unpaid:":                           "Sin pagar:",
+	`%s from %s for "%s", requested %s`: `%s de %s por "%s", solicitado el %s`,
+	"Recently paid:":                    "Pagados recientemente:",
+	`%s from %s for "%s", paid %s`:      `%s de %s por "%s", pagado el %s`,
+	"To check on all of your payment requests, visit your payments page:":                "Para revisar todas tus solicitudes de pago, visita tu página de pagos:",
+	"To change how often you receive these emails, visit your settings page:":            "Para cambiar la frecuencia de estos correos, visita tu página de configuración:",
+	"We're happy to let you know that %s has paid you.":                                  "Nos alegra informarte que %s te ha pagado.",
+	"We're writing to let you know that %s has claimed to have paid you.":                "Te escribimos para informarte que %s afirma haberte pagado.",
+	"Since they did not pay you via the link we sent them, we cannot verify this claim.": "Como no te pagó a través del enlace que le enviamos, no podemos verificarlo.",
+	"For now, this payment request has been marked as paid, and Tadue will not send any more emails about it. If you believe this is an error, please follow up with %s and resubmit the payment request as needed.": "Por ahora, esta solicitud de pago se ha marcado como pagada y Tadue no enviará más correos sobre ella. Si crees que es un error, comunícate con %s y vuelve a enviar la solicitud de pago si es necesario.",
+	"We're writing to let you know that your payment request to %s is now overdue.":                                                                                  "Te escribimos para informarte que tu solicitud de pago a %s está vencida.",
+	"Tadue will keep reminding %s until the payment is made, according to the reminder schedule of this request. You may also want to follow up with them directly.": "Tadue seguirá enviando recordatorios a %s hasta que se realice el pago, según el calendario de recordatorios de esta solicitud. También puedes comunicarte directamente.",
+	"This is a reminder that %s (%s) requested %s from you via Tadue, and that this payment is now overdue.":                                                         "Te recordamos que %s (%s) te solicitó %s a través de Tadue, y que este pago está vencido.",
+	"This is a reminder that %s (%s) requested %s from you via Tadue.":                                                                                               "Te recordamos que %s (%s) te solicitó %s a través de Tadue.",
+	"%s (%s) has requested %s from you via Tadue.":                                                                                                                   "%s (%s) te ha solicitado %s a través de Tadue.",
+	"Requested on":    "Solicitado el",
+	"Pay with PayPal": "Pagar con PayPal",
+	"Or [view this payment request] on Tadue.":                                                       "O [consulta esta solicitud de pago] en Tadue.",
+	"Once you make this payment, Tadue will stop sending you reminder emails.":                       "Cuando realices este pago, Tadue dejará de enviarte recordatorios.",
+	"If you've already paid through some other means, [click here] to mark the payment as complete.": "Si ya pagaste por otro medio, [haz clic aquí] para marcar el pago como completado.",
+	`You can reply to this email to send a message to %s. If you've already paid, reply with "paid". To stop receiving reminders about this request, reply with "stop".`: `Puedes responder a este correo para enviar un mensaje a %s. Si ya pagaste, responde "paid". Para dejar de recibir recordatorios sobre esta solicitud, responde "stop".`,
+	"Don't want to receive emails from Tadue? [Unsubscribe].":                                                   "¿No quieres recibir correos de Tadue? [Date de baja].",
+	"This request was made on %s, and payment was due on %s.":                                                   "Esta solicitud se hizo el %s y el pago vencía el %s.",
+	"This request was made on %s.":                                                                              "Esta solicitud se hizo el %s.",
+	"Payment is due on %s.":                                                                                     "El pago vence el %s.",
+	"To make your payment, click on the link below (or copy and paste it into your browser):":                   "Para realizar tu pago, haz clic en el siguiente enlace (o cópialo y pégalo en tu navegador):",
+	"If you've already paid through some other means, click on the link below to mark the payment as complete:": "Si ya pagaste por otro medio, haz clic en el siguiente enlace para marcar el pago como completado:",
+	"Don't want to receive emails from Tadue? Unsubscribe here:":                                                "¿No quieres recibir correos de Tadue? Date de baja aquí:",
+	"%s replied to your payment request:":                                                                       "%s respondió a tu solicitud de pago:",
+	"%s says this request has been paid.":                                                                       "%s dice que esta solicitud ya está pagada.",
+	"[Click here] to mark it as paid.":                                                                          "[Haz clic aquí] para marcarla como pagada.",
+	"%s asked Tadue to stop sending reminders.":                                                                 "%s pidió a Tadue que deje de enviar recordatorios.",
+	"[Click here] to stop reminders for this request.":                                                          "[Haz clic aquí] para detener los recordatorios de esta solicitud.",
+	"You can reply to this email to respond to %s directly.":                                                    "Puedes responder a este correo para contestarle directamente a %s.",
+	"%s says this request has been paid. To mark it as paid, click on the link below:":                          "%s dice que esta solicitud ya está pagada. Para marcarla como pagada, haz clic en el siguiente enlace:",
+	"%s asked Tadue to stop sending reminders. To stop reminders for this request, click on the link below:":    "%s pidió a Tadue que deje de enviar recordatorios. Para detener los recordatorios de esta solicitud, haz clic en el siguiente enlace:",
+	"Tadue received a request to reset the password for your account (%s).":                                     "Tadue recibió una solicitud para restablecer la contraseña de tu cuenta (%s).",
+	"If the button doesn't work, copy and paste this link into your browser:":                                   "Si el botón no funciona, copia y pega este enlace en tu navegador:",
+	"If you did not request a password reset, you can safely ignore this email.":                                "Si no solicitaste restablecer tu contraseña, puedes ignorar este correo.",
+	"To reset your password, click on the link below (or copy and paste it into your browser):":                 "Para restablecer tu contraseña, haz clic en el siguiente enlace (o cópialo y pégalo en tu navegador):",
+	"Thank you for creating your Tadue account.":                                                                "Gracias por crear tu cuenta de Tadue.",
+	"Verify email address": "Verificar correo electrónico",
+	"To verify your email address, click on the link below (or copy and paste it into your browser):": "Para verificar tu correo electrónico, haz clic en el siguiente enlace (o cópialo y pégalo en tu navegador):",
+
+	// Email subjects.
+	"Reset your Tadue password":                     "Restablece tu contraseña de Tadue",
+	"Welcome to Tadue":                              "Te damos la bienvenida a Tadue",
+	"Payment request from %s":                       "Solicitud de pago de %s",
+	"Overdue payment request from %s":               "Solicitud de pago vencida de %s",
+	"Reminder of payment request from %s":           "Recordatorio de solicitud de pago de %s",
+	"Your weekly Tadue summary: %s outstanding":     "Tu resumen semanal de Tadue: %s pendiente",
+	"Your monthly Tadue summary: %s outstanding":    "Tu resumen mensual de Tadue: %s pendiente",
+	"You've been paid by %s":                        "%s te ha pagado",
+	"Your payment request was marked as paid by %s": "%s marcó tu solicitud de pago como pagada",
+	"Your payment request to %s is overdue":         "Tu solicitud de pago a %s está vencida",
+	"%s replied to your payment request":            "%s respondió a tu solicitud de pago",
+
+	// Home page.
+	"Tadue makes it easy to collect payments from your friends.": "Tadue facilita cobrarles a tus amigos.",
+	"When you request a payment, Tadue will send the payer a PayPal link, pre-filled with all the payment details. For personal payments, there is no charge.":     "Cuando solicitas un pago, Tadue le envía al pagador un enlace de PayPal con todos los datos del pago. Los pagos personales no tienen costo.",
+	"From there, Tadue will take care of sending periodic reminders and keeping track of whether you've been paid. No more awkward conversations, no more stress!": "A partir de ahí, Tadue se encarga de enviar recordatorios periódicos y de llevar el control de si ya te pagaron. ¡Sin conversaciones incómodas y sin estrés!",
+	"And best of all, it's free!": "Y lo mejor de todo: ¡es gratis!",
+	"Make a payment request":      "Hacer una solicitud de pago",
+
+	// Login and signup.
+	"Log In":                "Iniciar sesión",
+	"Forgot your password?": "¿Olvidaste tu contraseña?",
+	"Sign Up":               "Registrarse",
+	"Full name":             "Nombre completo",
+	"PayPal email":          "Correo de PayPal",
+	"Same as primary email": "Igual que el correo principal",
+	"New user":              "Usuario nuevo",
+	"Existing user":         "Usuario existente",
+
+	// Pay page.
+	"Payment Request":         "Solicitud de pago",
+	"%s, you owe %s (%s) %s.": "%s, le debes a %s (%s) %s.",
+	"All transactions must comply with the [PayPal Acceptable Use Policy].": "Todas las transacciones deben cumplir con la [Política de uso aceptable de PayPal].",
+
+	// Payments page.
+	"Thanks for signing up!": "¡Gracias por registrarte!",
+	"Before you can send payment requests, you'll need to verify your email address.":                      "Antes de enviar solicitudes de pago, tienes que verificar tu correo electrónico.",
+	"A verification link has been sent to %s.":                                                             "Se envió un enlace de verificación a %s.",
+	"Your email address (%s) has not been verified.":                                                       "Tu correo electrónico (%s) no ha sido verificado.",
+	"If you have not received an email containing a verification link, [click here] to request a new one.": "Si no recibiste un correo con el enlace de verificación, [haz clic aquí] para solicitar otro.",
+	"Mark as paid":        "Marcar como pagado",
+	"Send reminder email": "Enviar recordatorio",
+	"Delete":              "Eliminar",
+	"Undo":                "Deshacer",
+	`Note: Your default reminder schedule is "%s".`:                                                       `Nota: tu calendario de recordatorios predeterminado es "%s".`,
+	"When a request has a due date, reminders are sent more often as the due date approaches and passes.": "Cuando una solicitud tiene fecha de vencimiento, los recordatorios se envían con más frecuencia a medida que se acerca y pasa esa fecha.",
+	"You can change your default in [settings], or choose a schedule for each request.":                   "Puedes cambiar tu valor predeterminado en la [configuración] o elegir un calendario para cada solicitud.",
+	"Status":                    "Estado",
+	"Due":                       "Vencimiento",
+	"Request date":              "Fecha de solicitud",
+	"No payment requests.":      "No hay solicitudes de pago.",
+	"[Click here] to make one.": "[Haz clic aquí] para hacer una.",
+	"Email to %s bounced":       "El correo a %s fue rechazado",
+	"fix address":               "corregir dirección",
+	"Reminders: %s":             "Recordatorios: %s",
+
+	// Payment statuses.
+	"Paid on %s":                   "Pagado el %s",
+	"Email bounced":                "Correo rechazado",
+	"Payer opted out of reminders": "El pagador no quiere recordatorios",
+	"Emailed on %s":                "Enviado el %s",
+	"Pending verification":         "Pendiente de verificación",
+	"Due today":                    "Vence hoy",
+	"Due tomorrow":                 "Vence mañana",
+	"Due in %d days":               "Vence en %d días",
+
+	// Reminder policies.
+	"Reminder emails":        "Recordatorios por correo",
+	"Use my default":         "Usar mi valor predeterminado",
+	"Every few days":         "Cada pocos días",
+	"On specific days":       "En días específicos",
+	"Days between reminders": "Días entre recordatorios",
+	"Days after request":     "Días después de la solicitud",
+	"e.g. 3, 7, 14":          "p. ej. 3, 7, 14",
+	"Max reminders":          "Máximo de recordatorios",
+	"No limit":               "Sin límite",
+	"Every day":              "Todos los días",
+	"Every %d days":          "Cada %d días",
+	"%s days after request":  "%s días después de la solicitud",
+	", at most %d times":     ", como máximo %d veces",
+
+	// Reply page.
+	"Reply from %s": "Respuesta de %s",
+	"On %s, %s replied to your payment request for %s (%s):":                     "El %s, %s respondió a tu solicitud de pago por %s (%s):",
+	"You have already confirmed this request.":                                   "Ya confirmaste esta solicitud.",
+	"This payment request has already been paid.":                                "Esta solicitud de pago ya está pagada.",
+	"%s says this request has been paid. Mark it as paid?":                       "%s dice que esta solicitud ya está pagada. ¿Marcarla como pagada?",
+	"Reminders for this payment request have already been stopped.":              "Los recordatorios de esta solicitud de pago ya se detuvieron.",
+	"%s asked Tadue to stop sending reminders. Stop reminders for this request?": "%s pidió a Tadue que deje de enviar recordatorios. ¿Detener los recordatorios de esta solicitud?",
+	"Stop reminders":   "Detener recordatorios",
+	"Back to payments": "Volver a pagos",
+
+	// Request payment page.
+	"Request Payment":                          "Solicitar pago",
+	"Login with Google to enable autocomplete": "Inicia sesión con Google para activar el autocompletado",
+	"Payer's email":                            "Correo del pagador",
+	"Amount (USD)":                             "Importe (USD)",
+	"Add another payer":                        "Agregar otro pagador",
+	"Total":                                    "Total",
+	"Payment type":                             "Tipo de pago",
+	"Personal":                                 "Personal",
+	"Goods":                                    "Bienes",
+	"Services":                                 "Servicios",
+	"Due date (optional)":                      "Fecha de vencimiento (opcional)",
+
+	// Settings page.
+	"Summary emails":  "Correos de resumen",
+	"Weekly":          "Semanal",
+	"Monthly":         "Mensual",
+	"Language":        "Idioma",
+	"Same as browser": "Igual que el navegador",
+	"Time zone":       "Zona horaria",
+	"API tokens":      "Tokens de API",
+	"API tokens let your own scripts use the Tadue API on your behalf. Keep them secret.": "Los tokens de API permiten que tus propios scripts usen la API de Tadue en tu nombre. Mantenlos en secreto.",
+	"Your new API token is shown below. Copy it now; you won't be able to see it again.":  "Este es tu nuevo token de API. Cópialo ahora; no podrás volver a verlo.",
+	"Name":         "Nombre",
+	"Created":      "Creado",
+	"Last used":    "Último uso",
+	"Token name":   "Nombre del token",
+	"Create token": "Crear token",
+	"Webhooks":     "Webhooks",
+	"Webhooks notify your own server whenever one of your payment requests is created, emailed, paid, or deleted.": "Los webhooks avisan a tu propio servidor cada vez que una de tus solicitudes de pago se crea, se envía por correo, se paga o se elimina.",
+	"URL":          "URL",
+	"Delivery log": "Registro de envíos",
+	"Add webhook":  "Agregar webhook",
+
+	// Webhook delivery log page.
+	"Webhook delivery log": "Registro de envíos del webhook",
+	"Signing secret":       "Secreto de firma",
+	`Each delivery has an X-Tadue-Signature header: "sha256=" followed by the hex HMAC-SHA256, keyed by the secret above, of the X-Tadue-Timestamp header, a period, and the request body.`: `Cada envío tiene un encabezado X-Tadue-Signature: "sha256=" seguido del HMAC-SHA256 en hexadecimal, con el secreto anterior como clave, del encabezado X-Tadue-Timestamp, un punto y el cuerpo de la solicitud.`,
+	"Recent deliveries":  "Envíos recientes",
+	"Event":              "Evento",
+	"Attempts":           "Intentos",
+	"Last attempt":       "Último intento",
+	"Delivered":          "Entregado",
+	"Pending":            "Pendiente",
+	"Redeliver":          "Volver a enviar",
+	"No deliveries yet.": "Todavía no hay envíos.",
+	"Back to settings":   "Volver a la configuración",
+
+	// Payments page filters.
+	"Search descriptions and emails": "Buscar en descripciones y correos",
+	"Unpaid first":                   "Pendientes primero",
+	"Newest first":                   "Más recientes primero",
+	"Oldest first":                   "Más antiguas primero",
+	"Largest first":                  "Mayor importe primero",
+	"Smallest first":                 "Menor importe primero",
+	"More filters":                   "Más filtros",
+	"Payer":                          "Pagador",
+	"Any":                            "Cualquiera",
+	"Min amount":                     "Importe mínimo",
+	"Max amount":                     "Importe máximo",
+	"Filter":                         "Filtrar",
+	"Clear filters":                  "Quitar filtros",
+	"No payment requests match these filters.": "Ninguna solicitud de pago coincide con estos filtros.",
+	"First page": "Primera página",
+	"Next page":  "Página siguiente",
+
+	// Request detail page.
+	"Payment request":                    "Solicitud de pago",
+	"Deleted":                            "Eliminada",
+	"Reminders":                          "Recordatorios",
+	"Payment page":                       "Página de pago",
+	"History":                            "Historial",
+	"You made this request.":             "Hiciste esta solicitud.",
+	"Payment request emailed to %s.":     "Se envió la solicitud de pago a %s.",
+	"Automatic reminder emailed to %s.":  "Se envió un recordatorio automático a %s.",
+	"Reminder emailed to %s.":            "Se envió un recordatorio a %s.",
+	"Payer viewed the payment page.":     "El pagador vio la página de pago.",
+	"Payer paid via PayPal.":             "El pagador pagó con PayPal.",
+	"Payer marked this request as paid.": "El pagador marcó esta solicitud como pagada.",
+	"You marked this request as paid.":   "Marcaste esta solicitud como pagada.",
+	"You marked this request as unpaid.": "Marcaste esta solicitud como no pagada.",
+	"You deleted this request.":          "Eliminaste esta solicitud.",
+	"You restored this request.":         "Restauraste esta solicitud.",
+	"Unknown event.":                     "Evento desconocido.",
+
+	// Import and export page.
+	"Import and export": "Importar y exportar",
+	"Preview":           "Vista previa",
+	"%d rows have errors. Please fix them and upload the file again.":         "%d filas tienen errores. Corrígelas y vuelve a subir el archivo.",
+	"Payment request emails will be sent once you verify your email address.": "Los correos de solicitud de pago se enviarán cuando verifiques tu dirección de correo.",
+	"Line":                     "Línea",
+	"Type":                     "Tipo",
+	"Send %d payment requests": "Enviar %d solicitudes de pago",
+	"Import":                   "Importar",
+	`Upload a CSV file whose first line names its columns. The "payer_email" and "amount" columns are required; "description" and "type" (personal, goods, or services) are optional. Files exported below can be imported as is.`: `Sube un archivo CSV cuya primera línea indique los nombres de las columnas. Las columnas "payer_email" y "amount" son obligatorias; "description" y "type" (personal, goods o services) son opcionales. Los archivos exportados a continuación se pueden importar tal cual.`,
+	"Export":       "Exportar",
+	"From":         "Desde",
+	"To":           "Hasta",
+	"All":          "Todas",
+	"Paid":         "Pagadas",
+	"Download CSV": "Descargar CSV",
+	"You can also [import or export] payment requests as CSV files.": "También puedes [importar o exportar] solicitudes de pago como archivos CSV.",
+	"The file is empty.":                "El archivo está vacío.",
+	"The file is not a valid CSV file.": "El archivo no es un archivo CSV válido.",
+	"The file has no %q column.":        "El archivo no tiene la columna %q.",
+	"The file has more than %d rows.":   "El archivo tiene más de %d filas.",
+	"The file has no rows.":             "El archivo no tiene filas.",
+	"Invalid email address.":            "Dirección de correo no válida.",
+	"Invalid amount.":                   "Importe no válido.",
+	"Invalid payment type.":             "Tipo de pago no válido.",
+	"Please choose a file.":             "Elige un archivo.",
+
+	// Unsubscribe page.
+	"%s has been unsubscribed. Tadue will not send any more payment requests or reminders to this address.": "%s se dio de baja. Tadue no enviará más solicitudes de pago ni recordatorios a esta dirección.",
+	"If someone has requested a payment from you, please contact them directly.":                            "Si alguien te solicitó un pago, comunícate directamente con esa persona.",
+	"Stop payment requests and reminders from Tadue to %s?":                                                 "¿Dejar de enviar solicitudes de pago y recordatorios de Tadue a %s?",
+
+	// Flash messages.
+	"%s link sent to %s.":                                       "Se envió el enlace de %s a %s.",
+	"%s link has expired. Please request another.":              "El enlace de %s caducó. Solicita otro.",
+	"%s link has already been used. Please request another.":    "El enlace de %s ya se usó. Solicita otro.",
+	"Password reset":                                            "restablecimiento de contraseña",
+	"Email verification":                                        "verificación de correo",
+	"Already paid.":                                             "Ya está pagado.",
+	"Payment marked as complete. Thanks for using Tadue!":       "El pago se marcó como completado. ¡Gracias por usar Tadue!",
+	"Payment processed successfully. Thanks for using Tadue!":   "El pago se procesó correctamente. ¡Gracias por usar Tadue!",
+	"Payment request made.":                                     "Solicitud de pago realizada.",
+	"We cannot send email to %s.":                               "No podemos enviar correos a %s.",
+	"Invalid unsubscribe link.":                                 "Enlace para darse de baja no válido.",
+	"Payment request marked as paid.":                           "Solicitud de pago marcada como pagada.",
+	"API token deleted.":                                        "Token de API eliminado.",
+	"%d payment requests made.":                                 "Se realizaron %d solicitudes de pago.",
+	"%d payment requests made; the rest failed.":                "Se realizaron %d solicitudes de pago; las demás fallaron.",
+	"Webhook added.":                                            "Webhook agregado.",
+	"Webhook deleted.":                                          "Webhook eliminado.",
+	"Redelivery scheduled. Reload this page to see the result.": "Se programó el reenvío. Vuelve a cargar esta página para ver el resultado.",
+	"Reminders stopped.":                                        "Recordatorios detenidos.",
+	"Password changed successfully.":                            "La contraseña se cambió correctamente.",
+	"Email address %s has been verified.":                       "Se verificó la dirección de correo %s.",
+	"All pending payment requests have been sent.":              "Se enviaron todas las solicitudes de pago pendientes.",
+}
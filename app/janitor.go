@@ -0,0 +1,171 @@
+// Janitor, run daily by cron. Purges expired UserTokens, hard-deletes
+// PayRequests (along with their comments and events) that were soft-deleted
+// long ago, and deletes OAuthTokens whose User no longer exists. Retention
+// windows are set in constants.go. Each run deletes at most kMaxJanitorDeletes
+// entities of each kind; the next run picks up the rest.
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type janitorReport struct {
+	lines []string
+}
+
+func (r *janitorReport) add(format string, args ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+// Returns up to kMaxJanitorDeletes keys matching q, and whether there are more.
+func getJanitorKeysOrDie(q *datastore.Query, c *Context) ([]*datastore.Key, bool) {
+	keys, err := q.KeysOnly().Limit(kMaxJanitorDeletes+1).GetAll(c.Aec(), nil)
+	CheckError(err)
+	if len(keys) > kMaxJanitorDeletes {
+		return keys[:kMaxJanitorDeletes], true
+	}
+	return keys, false
+}
+
+func deleteKeysOrDie(keys []*datastore.Key, c *Context) {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > kJanitorBatchSize {
+			n = kJanitorBatchSize
+		}
+		CheckError(datastore.DeleteMulti(c.Aec(), keys[:n]))
+		keys = keys[n:]
+	}
+}
+
+func moreSuffix(more bool) string {
+	if more {
+		return " (more remain)"
+	}
+	return ""
+}
+
+// Deletes UserTokens that expired before cutoff.
+func purgeExpiredUserTokensOrDie(cutoff time.Time, report *janitorReport, c *Context) {
+	keys, more := getJanitorKeysOrDie(datastore.NewQuery("UserToken").Filter("ExpirationDate <", cutoff), c)
+	deleteKeysOrDie(keys, c)
+	report.add("UserToken: deleted %d tokens that expired before %v%s", len(keys), cutoff, moreSuffix(more))
+}
+
+// Deletes PayRequests that were soft-deleted before cutoff, along with all of
+// their descendants (Comments, PayRequestEvents).
+func purgeDeletedPayRequestsOrDie(cutoff time.Time, report *janitorReport, c *Context) {
+	q := datastore.NewQuery("PayRequest").
+		Filter("DeletionDate >", time.Unix(0, 0)).Filter("DeletionDate <", cutoff)
+	reqKeys, more := getJanitorKeysOrDie(q, c)
+	numReqs, numDescendants := 0, 0
+	for _, reqKey := range reqKeys {
+		err := datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+			req := &PayRequest{}
+			if err := datastore.Get(aec, reqKey, req); err != nil {
+				return err
+			}
+			// Check again, since the request may have been restored since the query.
+			if !req.DeletionDate.After(time.Unix(0, 0)) || !req.DeletionDate.Before(cutoff) {
+				return nil
+			}
+			// Includes reqKey itself.
+			keys, err := datastore.NewQuery("").Ancestor(reqKey).KeysOnly().GetAll(aec, nil)
+			if err != nil {
+				return err
+			}
+			if err := datastore.DeleteMulti(aec, keys); err != nil {
+				return err
+			}
+			numReqs++
+			numDescendants += len(keys) - 1
+			return nil
+		}, nil)
+		CheckError(err)
+		cacheDelete(c, reqKey)
+	}
+	report.add("PayRequest: deleted %d requests soft-deleted before %v, and %d comments and events%s",
+		numReqs, cutoff, numDescendants, moreSuffix(more))
+}
+
+func toJanitorStateKey(aec appengine.Context) *datastore.Key {
+	return datastore.NewKey(aec, "JanitorState", "janitor", 0, nil)
+}
+
+// Deletes OAuthTokens whose parent User does not exist. Orphans can be anywhere
+// in the kind, so each run scans the next kMaxJanitorDeletes tokens, starting
+// where the last run stopped.
+func purgeOrphanedOAuthTokensOrDie(report *janitorReport, c *Context) {
+	stateKey := toJanitorStateKey(c.Aec())
+	state := &JanitorState{}
+	if err := datastore.Get(c.Aec(), stateKey, state); err != datastore.ErrNoSuchEntity {
+		CheckError(err)
+	}
+	q := datastore.NewQuery("OAuthToken").KeysOnly().Limit(kMaxJanitorDeletes)
+	if state.OAuthTokenCursor != "" {
+		cursor, err := datastore.DecodeCursor(state.OAuthTokenCursor)
+		CheckError(err)
+		q = q.Start(cursor)
+	}
+	tokenKeys := []*datastore.Key{}
+	it := q.Run(c.Aec())
+	for {
+		tokenKey, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		CheckError(err)
+		tokenKeys = append(tokenKeys, tokenKey)
+	}
+	more := len(tokenKeys) == kMaxJanitorDeletes
+	state.OAuthTokenCursor = ""
+	if more {
+		cursor, err := it.Cursor()
+		CheckError(err)
+		state.OAuthTokenCursor = cursor.String()
+	}
+
+	userKeys := make([]*datastore.Key, len(tokenKeys))
+	for i, tokenKey := range tokenKeys {
+		userKeys[i] = tokenKey.Parent()
+	}
+	// We only care whether each User exists, so we load them as PropertyLists,
+	// which accept any fields.
+	orphanKeys := []*datastore.Key{}
+	users := make([]datastore.PropertyList, len(userKeys))
+	if err := datastore.GetMulti(c.Aec(), userKeys, users); err != nil {
+		merr, ok := err.(appengine.MultiError)
+		Assert(ok, err)
+		for i, err := range merr {
+			if err == datastore.ErrNoSuchEntity {
+				orphanKeys = append(orphanKeys, tokenKeys[i])
+			} else {
+				CheckError(err)
+			}
+		}
+	}
+	deleteKeysOrDie(orphanKeys, c)
+	_, err := datastore.Put(c.Aec(), stateKey, state)
+	CheckError(err)
+	report.add("OAuthToken: deleted %d orphaned tokens out of %d scanned%s",
+		len(orphanKeys), len(tokenKeys), moreSuffix(more))
+}
+
+func handleRunJanitor(w http.ResponseWriter, r *http.Request, c *Context) {
+	now := time.Now()
+	report := &janitorReport{}
+	purgeExpiredUserTokensOrDie(now.AddDate(0, 0, -kExpiredTokenRetentionDays), report, c)
+	purgeDeletedPayRequestsOrDie(now.AddDate(0, 0, -kDeletedPayRequestRetentionDays), report, c)
+	purgeOrphanedOAuthTokensOrDie(report, c)
+	for _, line := range report.lines {
+		c.Log().Info("Janitor", "report", line)
+	}
+	ServeInfo(w, strings.Join(report.lines, "\n"))
+}
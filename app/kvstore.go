@@ -0,0 +1,745 @@
+// Implements Store on top of a simple versioned key-value backend, which is
+// all that MemoryStore and SqlStore need to provide. Entities are stored as
+// JSON, under string keys of the form "<kind>:<part>:<part>...", where the
+// parts are the ids of the entity's ancestors followed by its own id, so that
+// an ancestor query is a scan over a key prefix.
+//
+// Transactions are optimistic, like datastore transactions: each one records
+// the versions of the entities it reads, and fails to commit if any of them
+// has since changed, in which case RunInTransaction retries it.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kvBackend interface {
+	// Returns the value and version of the given key, or ErrNoSuchEntity.
+	get(key string) ([]byte, int64, error)
+	// Returns the keys and values of all entries whose keys start with prefix,
+	// sorted by key.
+	scan(prefix string) ([]string, [][]byte, error)
+	// Atomically checks that each key in reads still has the given version (0 if
+	// absent), and if so, applies writes, where a nil value means delete. Returns
+	// false if some version has changed.
+	commit(reads map[string]int64, writes map[string][]byte) (bool, error)
+	// Returns a new id, unique across all kinds.
+	allocateId() (int64, error)
+}
+
+type kvTx struct {
+	reads  map[string]int64
+	writes map[string][]byte
+}
+
+type kvStore struct {
+	b  kvBackend
+	tx *kvTx // set only for stores passed to RunInTransaction callbacks
+}
+
+func kvKey(kind string, parts ...interface{}) string {
+	strs := []string{kind}
+	for _, part := range parts {
+		strs = append(strs, fmt.Sprint(part))
+	}
+	return strings.Join(strs, ":")
+}
+
+// Returns the int parts of the given key, i.e. all parts that follow the kind.
+func kvKeyIds(key string) []int64 {
+	parts := strings.Split(key, ":")[1:]
+	ids := make([]int64, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseInt(part, 10, 64)
+		CheckError(err)
+		ids[i] = id
+	}
+	return ids
+}
+
+// Decodes a stored value into dst. Like the datastore, returns times in the
+// local time zone, since callers compare them to time.Unix(0, 0) with ==.
+func decodeEntity(v []byte, dst interface{}) error {
+	if err := json.Unmarshal(v, dst); err != nil {
+		return err
+	}
+	localizeTimes(reflect.ValueOf(dst))
+	return nil
+}
+
+func localizeTimes(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			localizeTimes(v.Elem())
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			v.Set(reflect.ValueOf(v.Interface().(time.Time).Local()))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				localizeTimes(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			localizeTimes(v.Index(i))
+		}
+	}
+}
+
+// Decodes the stored value for key into dst.
+func (s *kvStore) get(key string, dst interface{}) error {
+	if s.tx != nil {
+		if v, ok := s.tx.writes[key]; ok {
+			if v == nil {
+				return ErrNoSuchEntity
+			}
+			return decodeEntity(v, dst)
+		}
+	}
+	v, version, err := s.b.get(key)
+	if err != nil && err != ErrNoSuchEntity {
+		return err
+	}
+	if s.tx != nil {
+		if _, ok := s.tx.reads[key]; !ok {
+			s.tx.reads[key] = version
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return decodeEntity(v, dst)
+}
+
+// Stores src, encoded as JSON. If src is nil, deletes the entry.
+func (s *kvStore) put(key string, src interface{}) error {
+	var v []byte
+	if src != nil {
+		var err error
+		if v, err = json.Marshal(src); err != nil {
+			return err
+		}
+	}
+	if s.tx != nil {
+		s.tx.writes[key] = v
+		return nil
+	}
+	_, err := s.b.commit(nil, map[string][]byte{key: v})
+	return err
+}
+
+// Calls f with the key and value of each committed entry whose key starts with
+// prefix, in key order. f should decode the value. Stops if f returns an error.
+func (s *kvStore) scan(prefix string, f func(key string, v []byte) error) error {
+	keys, values, err := s.b.scan(prefix)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := f(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kvStore) GetUser(userId int64, c *Context) (*User, error) {
+	user := &User{}
+	if err := s.get(kvKey("User", userId), user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *kvStore) NewUser(user *User, c *Context) (int64, error) {
+	userId, err := s.b.allocateId()
+	if err != nil {
+		return 0, err
+	}
+	return userId, s.put(kvKey("User", userId), user)
+}
+
+func (s *kvStore) PutUser(userId int64, user *User, c *Context) error {
+	return s.put(kvKey("User", userId), user)
+}
+
+func (s *kvStore) GetUserId(email string, c *Context) (int64, error) {
+	userId := &UserId{}
+	if err := s.get(kvKey("UserId", email), userId); err != nil {
+		return 0, err
+	}
+	return userId.UserId, nil
+}
+
+func (s *kvStore) PutUserId(email string, userId int64, c *Context) error {
+	return s.put(kvKey("UserId", email), &UserId{UserId: userId})
+}
+
+func (s *kvStore) ForEachVerifiedUser(f func(userId int64, user *User) error, c *Context) error {
+	return s.scan("User:", func(key string, v []byte) error {
+		user := &User{}
+		if err := decodeEntity(v, user); err != nil {
+			return err
+		}
+		if !user.EmailOk {
+			return nil
+		}
+		return f(kvKeyIds(key)[0], user)
+	})
+}
+
+func (s *kvStore) GetPayRequest(userId, reqId int64, c *Context) (*PayRequest, error) {
+	req := &PayRequest{}
+	if err := s.get(kvKey("PayRequest", userId, reqId), req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *kvStore) NewPayRequest(userId int64, req *PayRequest, c *Context) (int64, error) {
+	reqId, err := s.b.allocateId()
+	if err != nil {
+		return 0, err
+	}
+	return reqId, s.put(kvKey("PayRequest", userId, reqId), req)
+}
+
+func (s *kvStore) PutPayRequest(userId, reqId int64, req *PayRequest, c *Context) error {
+	return s.put(kvKey("PayRequest", userId, reqId), req)
+}
+
+// Calls f for each non-deleted request whose key starts with prefix.
+func (s *kvStore) scanPayRequests(prefix string, f func(userId, reqId int64, req *PayRequest) error) error {
+	return s.scan(prefix, func(key string, v []byte) error {
+		req := &PayRequest{}
+		if err := decodeEntity(v, req); err != nil {
+			return err
+		}
+		if req.DeletionDate.After(time.Unix(0, 0)) {
+			return nil
+		}
+		ids := kvKeyIds(key)
+		return f(ids[0], ids[1], req)
+	})
+}
+
+// Returns the user's non-deleted requests for which keep returns true, sorted
+// by less, with ties broken by id (like the datastore).
+func (s *kvStore) getPayRequests(userId int64, keep func(req *PayRequest) bool, less func(a, b *PayRequest) bool) ([]int64, []PayRequest, error) {
+	sorter := &payRequestSorter{[]int64{}, []PayRequest{}, less}
+	err := s.scanPayRequests(kvKey("PayRequest", userId)+":", func(userId, reqId int64, req *PayRequest) error {
+		if keep(req) {
+			sorter.reqIds = append(sorter.reqIds, reqId)
+			sorter.reqs = append(sorter.reqs, *req)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(sorter)
+	return sorter.reqIds, sorter.reqs, nil
+}
+
+type payRequestSorter struct {
+	reqIds []int64
+	reqs   []PayRequest
+	less   func(a, b *PayRequest) bool
+}
+
+func (s *payRequestSorter) Len() int {
+	return len(s.reqs)
+}
+
+func (s *payRequestSorter) Less(i, j int) bool {
+	if s.less(&s.reqs[i], &s.reqs[j]) {
+		return true
+	} else if s.less(&s.reqs[j], &s.reqs[i]) {
+		return false
+	}
+	return s.reqIds[i] < s.reqIds[j]
+}
+
+func (s *payRequestSorter) Swap(i, j int) {
+	s.reqIds[i], s.reqIds[j] = s.reqIds[j], s.reqIds[i]
+	s.reqs[i], s.reqs[j] = s.reqs[j], s.reqs[i]
+}
+
+func newestFirst(a, b *PayRequest) bool {
+	return a.CreationDate.After(b.CreationDate)
+}
+
+func (s *kvStore) GetPayRequests(userId int64, c *Context) ([]int64, []PayRequest, error) {
+	return s.getPayRequests(userId, func(req *PayRequest) bool {
+		return true
+	}, newestFirst)
+}
+
+func (s *kvStore) GetPayRequestsByStatus(userId int64, isPaid bool, limit int, c *Context) ([]int64, []PayRequest, error) {
+	reqIds, reqs, err := s.getPayRequests(userId, func(req *PayRequest) bool {
+		return req.IsPaid == isPaid
+	}, newestFirst)
+	if err == nil && limit > 0 && len(reqs) > limit {
+		return reqIds[:limit], reqs[:limit], nil
+	}
+	return reqIds, reqs, err
+}
+
+func (s *kvStore) GetPayRequestsPaidSince(userId int64, since time.Time, c *Context) ([]int64, []PayRequest, error) {
+	return s.getPayRequests(userId, func(req *PayRequest) bool {
+		return req.IsPaid && req.PaymentDate.After(since)
+	}, func(a, b *PayRequest) bool {
+		return a.PaymentDate.After(b.PaymentDate)
+	})
+}
+
+// Cursors are offsets into the sorted results.
+func (s *kvStore) QueryPayRequests(userId int64, f *PaymentsFilter, c *Context) ([]int64, []PayRequest, string, error) {
+	reqIds, reqs, err := s.getPayRequests(userId, func(req *PayRequest) bool {
+		if f.Status != "all" && req.IsPaid != (f.Status == "paid") {
+			return false
+		}
+		return f.matches(req)
+	}, f.less)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	start := 0
+	if f.Cursor != "" {
+		if n, err := strconv.Atoi(f.Cursor); err == nil && n >= 0 && n <= len(reqs) {
+			start = n
+		}
+	}
+	end := start + kMaxPaymentsToShow
+	if end >= len(reqs) {
+		return reqIds[start:], reqs[start:], "", nil
+	}
+	return reqIds[start:end], reqs[start:end], strconv.Itoa(end), nil
+}
+
+func (s *kvStore) ForEachPayRequestRemindedBefore(remindedBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error {
+	return s.scanPayRequests("PayRequest:", func(userId, reqId int64, req *PayRequest) error {
+		if req.IsPaid || !req.ReminderSentDate.Before(remindedBefore) {
+			return nil
+		}
+		return f(userId, reqId, req)
+	})
+}
+
+func (s *kvStore) ForEachUnreportedOverduePayRequest(dueBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error {
+	return s.scanPayRequests("PayRequest:", func(userId, reqId int64, req *PayRequest) error {
+		if req.IsPaid || !req.OverdueSentDate.Equal(time.Unix(0, 0)) ||
+			!req.DueDate.After(time.Unix(0, 0)) || !req.DueDate.Before(dueBefore) {
+			return nil
+		}
+		return f(userId, reqId, req)
+	})
+}
+
+func (s *kvStore) AddPayRequestEvent(userId, reqId int64, event *PayRequestEvent, c *Context) error {
+	eventId, err := s.b.allocateId()
+	if err != nil {
+		return err
+	}
+	return s.put(kvKey("PayRequestEvent", userId, reqId, eventId), event)
+}
+
+func (s *kvStore) GetPayRequestEvents(userId, reqId int64, c *Context) ([]PayRequestEvent, error) {
+	sorter := &eventSorter{}
+	err := s.scan(kvKey("PayRequestEvent", userId, reqId)+":", func(key string, v []byte) error {
+		event := PayRequestEvent{}
+		if err := decodeEntity(v, &event); err != nil {
+			return err
+		}
+		sorter.eventIds = append(sorter.eventIds, kvKeyIds(key)[2])
+		sorter.events = append(sorter.events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sorter)
+	return append([]PayRequestEvent{}, sorter.events...), nil
+}
+
+func (s *kvStore) GetLatestPayRequestEvent(userId, reqId int64, eventType int, c *Context) (*PayRequestEvent, error) {
+	events, err := s.GetPayRequestEvents(userId, reqId, c)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == eventType {
+			return &events[i], nil
+		}
+	}
+	return nil, ErrNoSuchEntity
+}
+
+// Sorts events by date, then by id, i.e. in the order they were added.
+type eventSorter struct {
+	eventIds []int64
+	events   []PayRequestEvent
+}
+
+func (s *eventSorter) Len() int {
+	return len(s.events)
+}
+
+func (s *eventSorter) Less(i, j int) bool {
+	if !s.events[i].Date.Equal(s.events[j].Date) {
+		return s.events[i].Date.Before(s.events[j].Date)
+	}
+	return s.eventIds[i] < s.eventIds[j]
+}
+
+func (s *eventSorter) Swap(i, j int) {
+	s.eventIds[i], s.eventIds[j] = s.eventIds[j], s.eventIds[i]
+	s.events[i], s.events[j] = s.events[j], s.events[i]
+}
+
+func (s *kvStore) GetUserToken(userId int64, purpose string, c *Context) (*UserToken, error) {
+	token := &UserToken{}
+	if err := s.get(kvKey("UserToken", userId, purpose), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *kvStore) PutUserToken(userId int64, purpose string, token *UserToken, c *Context) error {
+	return s.put(kvKey("UserToken", userId, purpose), token)
+}
+
+func (s *kvStore) GetOAuthToken(userId int64, service string, c *Context) (*OAuthToken, error) {
+	token := &OAuthToken{}
+	if err := s.get(kvKey("OAuthToken", userId, service), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *kvStore) PutOAuthToken(userId int64, service string, token *OAuthToken, c *Context) error {
+	return s.put(kvKey("OAuthToken", userId, service), token)
+}
+
+func (s *kvStore) DeleteOAuthToken(userId int64, service string, c *Context) error {
+	return s.put(kvKey("OAuthToken", userId, service), nil)
+}
+
+func (s *kvStore) GetSuppression(email string, c *Context) (*Suppression, error) {
+	sup := &Suppression{}
+	if err := s.get(kvKey("Suppression", email), sup); err != nil {
+		return nil, err
+	}
+	return sup, nil
+}
+
+func (s *kvStore) GetSuppressions(emails []string, c *Context) (map[string]*Suppression, error) {
+	res := map[string]*Suppression{}
+	for _, email := range emails {
+		sup, err := s.GetSuppression(email, c)
+		if err == ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res[email] = sup
+	}
+	return res, nil
+}
+
+func (s *kvStore) PutSuppression(email string, sup *Suppression, c *Context) error {
+	return s.put(kvKey("Suppression", email), sup)
+}
+
+func (s *kvStore) GetApiToken(tokenHash string, c *Context) (*ApiToken, error) {
+	token := &ApiToken{}
+	if err := s.get(kvKey("ApiToken", tokenHash), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *kvStore) PutApiToken(tokenHash string, token *ApiToken, c *Context) error {
+	return s.put(kvKey("ApiToken", tokenHash), token)
+}
+
+func (s *kvStore) DeleteApiToken(tokenHash string, c *Context) error {
+	return s.put(kvKey("ApiToken", tokenHash), nil)
+}
+
+// Scans all API tokens; there are few of them.
+func (s *kvStore) GetApiTokens(userId int64, c *Context) ([]string, []ApiToken, error) {
+	hashes := []string{}
+	tokens := []ApiToken{}
+	err := s.scan("ApiToken:", func(key string, v []byte) error {
+		token := ApiToken{}
+		if err := decodeEntity(v, &token); err != nil {
+			return err
+		}
+		if token.UserId == userId {
+			hashes = append(hashes, strings.TrimPrefix(key, "ApiToken:"))
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return hashes, tokens, nil
+}
+
+func (s *kvStore) GetWebhook(userId, webhookId int64, c *Context) (*Webhook, error) {
+	webhook := &Webhook{}
+	if err := s.get(kvKey("Webhook", userId, webhookId), webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *kvStore) GetWebhooks(userId int64, c *Context) ([]int64, []Webhook, error) {
+	// Ids are allocated in increasing order, so id order is creation order.
+	webhookIds := []int64{}
+	webhooks := []Webhook{}
+	err := s.scan(kvKey("Webhook", userId)+":", func(key string, v []byte) error {
+		webhook := Webhook{}
+		if err := decodeEntity(v, &webhook); err != nil {
+			return err
+		}
+		webhookIds = append(webhookIds, kvKeyIds(key)[1])
+		webhooks = append(webhooks, webhook)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(&webhookSorter{webhookIds, webhooks})
+	return webhookIds, webhooks, nil
+}
+
+type webhookSorter struct {
+	webhookIds []int64
+	webhooks   []Webhook
+}
+
+func (s *webhookSorter) Len() int {
+	return len(s.webhooks)
+}
+
+func (s *webhookSorter) Less(i, j int) bool {
+	return s.webhookIds[i] < s.webhookIds[j]
+}
+
+func (s *webhookSorter) Swap(i, j int) {
+	s.webhookIds[i], s.webhookIds[j] = s.webhookIds[j], s.webhookIds[i]
+	s.webhooks[i], s.webhooks[j] = s.webhooks[j], s.webhooks[i]
+}
+
+func (s *kvStore) NewWebhook(userId int64, webhook *Webhook, c *Context) (int64, error) {
+	webhookId, err := s.b.allocateId()
+	if err != nil {
+		return 0, err
+	}
+	return webhookId, s.put(kvKey("Webhook", userId, webhookId), webhook)
+}
+
+func (s *kvStore) DeleteWebhook(userId, webhookId int64, c *Context) error {
+	writes := map[string][]byte{kvKey("Webhook", userId, webhookId): nil}
+	keys, _, err := s.b.scan(kvKey("WebhookDelivery", userId, webhookId) + ":")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		writes[key] = nil
+	}
+	if s.tx != nil {
+		for key := range writes {
+			s.tx.writes[key] = nil
+		}
+		return nil
+	}
+	_, err = s.b.commit(nil, writes)
+	return err
+}
+
+func (s *kvStore) AllocateWebhookDeliveryId(userId, webhookId int64, c *Context) (int64, error) {
+	return s.b.allocateId()
+}
+
+func (s *kvStore) GetWebhookDelivery(userId, webhookId, deliveryId int64, c *Context) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	if err := s.get(kvKey("WebhookDelivery", userId, webhookId, deliveryId), delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *kvStore) PutWebhookDelivery(userId, webhookId, deliveryId int64, delivery *WebhookDelivery, c *Context) error {
+	return s.put(kvKey("WebhookDelivery", userId, webhookId, deliveryId), delivery)
+}
+
+func (s *kvStore) GetWebhookDeliveries(userId, webhookId int64, limit int, c *Context) ([]int64, []WebhookDelivery, error) {
+	sorter := &deliverySorter{}
+	err := s.scan(kvKey("WebhookDelivery", userId, webhookId)+":", func(key string, v []byte) error {
+		delivery := WebhookDelivery{}
+		if err := decodeEntity(v, &delivery); err != nil {
+			return err
+		}
+		sorter.deliveryIds = append(sorter.deliveryIds, kvKeyIds(key)[2])
+		sorter.deliveries = append(sorter.deliveries, delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(sorter)
+	if len(sorter.deliveries) > limit {
+		return sorter.deliveryIds[:limit], sorter.deliveries[:limit], nil
+	}
+	return append([]int64{}, sorter.deliveryIds...), append([]WebhookDelivery{}, sorter.deliveries...), nil
+}
+
+// Sorts deliveries newest first.
+type deliverySorter struct {
+	deliveryIds []int64
+	deliveries  []WebhookDelivery
+}
+
+func (s *deliverySorter) Len() int {
+	return len(s.deliveries)
+}
+
+func (s *deliverySorter) Less(i, j int) bool {
+	if !s.deliveries[i].CreationDate.Equal(s.deliveries[j].CreationDate) {
+		return s.deliveries[i].CreationDate.After(s.deliveries[j].CreationDate)
+	}
+	return s.deliveryIds[i] > s.deliveryIds[j]
+}
+
+func (s *deliverySorter) Swap(i, j int) {
+	s.deliveryIds[i], s.deliveryIds[j] = s.deliveryIds[j], s.deliveryIds[i]
+	s.deliveries[i], s.deliveries[j] = s.deliveries[j], s.deliveries[i]
+}
+
+// Makes up to 3 attempts, like datastore.RunInTransaction.
+func (s *kvStore) RunInTransaction(f func(tx Store) error, c *Context) error {
+	if s.tx != nil {
+		return errNestedTransaction
+	}
+	for i := 0; i < 3; i++ {
+		tx := &kvStore{
+			b:  s.b,
+			tx: &kvTx{reads: map[string]int64{}, writes: map[string][]byte{}},
+		}
+		if err := f(tx); err != nil {
+			return err
+		}
+		if ok, err := s.b.commit(tx.tx.reads, tx.tx.writes); err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+	}
+	return ErrConcurrentTransaction
+}
+
+////////////////////////////////////////
+// MemoryStore
+
+type memoryEntry struct {
+	value   []byte
+	version int64
+}
+
+type memoryBackend struct {
+	mu          sync.Mutex
+	entries     map[string]*memoryEntry
+	lastId      int64
+	lastVersion int64
+}
+
+func (b *memoryBackend) get(key string) ([]byte, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[key]
+	if !ok {
+		return nil, 0, ErrNoSuchEntity
+	}
+	return e.value, e.version, nil
+}
+
+func (b *memoryBackend) scan(prefix string) ([]string, [][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := []string{}
+	for key := range b.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = b.entries[key].value
+	}
+	return keys, values, nil
+}
+
+func (b *memoryBackend) commit(reads map[string]int64, writes map[string][]byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, version := range reads {
+		var current int64
+		if e, ok := b.entries[key]; ok {
+			current = e.version
+		}
+		if current != version {
+			return false, nil
+		}
+	}
+	b.lastVersion++
+	for key, v := range writes {
+		if v == nil {
+			delete(b.entries, key)
+		} else {
+			b.entries[key] = &memoryEntry{value: v, version: b.lastVersion}
+		}
+	}
+	return true, nil
+}
+
+func (b *memoryBackend) allocateId() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastId++
+	return b.lastId, nil
+}
+
+// Keeps entities in memory. Used in tests.
+type MemoryStore struct {
+	kvStore
+	mem *memoryBackend
+}
+
+func NewMemoryStore() *MemoryStore {
+	b := &memoryBackend{entries: map[string]*memoryEntry{}}
+	return &MemoryStore{kvStore{b: b}, b}
+}
+
+// Removes all entities.
+func (s *MemoryStore) Clear() {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.entries = map[string]*memoryEntry{}
+}
@@ -0,0 +1,171 @@
+// Structured logging. Each line is a message followed by key=value fields, e.g.
+//
+//   Sent payment done email reqCode=ab12 payee=pat@example.com requestId=3f2a...
+//
+// Context.Log adds the fields of the current request: requestId, handler, and
+// userId if logged in. The request ID is propagated to enqueued tasks and
+// PayPal callbacks (see getRequestId), so that one payment can be traced
+// across /pay, /ipn and the email tasks.
+
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+const kRequestIdHeader = "X-Tadue-Request-Id"
+
+// PayPal callbacks cannot carry headers, so we pass the ID in their urls.
+const kRequestIdParam = "requestId"
+
+var requestIdRegexp = regexp.MustCompile("^[0-9a-f]{16}$")
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	CheckError(err)
+	return hex.EncodeToString(b)
+}
+
+// Paths of the PayPal callbacks; see PayPalSendPayRequest.
+var payPalCallbackPaths = map[string]bool{"/pay": true, "/pay/done": true, "/ipn": true}
+
+// Reuses the ID of the request that caused this one, if any, so that tasks and
+// PayPal callbacks log under the same ID. Clients can't pick the ID of any
+// other request: the header is only trusted on tasks, since App Engine strips
+// X-AppEngine-* headers from outside requests (and standalone mode doesn't
+// serve /tasks/), and the url param only on PayPal callbacks. Malformed IDs are
+// ignored, since they end up in logs.
+func getRequestId(r *http.Request) string {
+	if r.Header.Get("X-AppEngine-QueueName") != "" {
+		if id := r.Header.Get(kRequestIdHeader); requestIdRegexp.MatchString(id) {
+			return id
+		}
+	}
+	if payPalCallbackPaths[r.URL.Path] {
+		if id := r.URL.Query().Get(kRequestIdParam); requestIdRegexp.MatchString(id) {
+			return id
+		}
+	}
+	return newRequestId()
+}
+
+////////////////////////////////////////
+// Logger
+
+type Logger struct {
+	aec    appengine.Context
+	fields []interface{} // alternating keys and values
+}
+
+func NewLogger(aec appengine.Context, kv ...interface{}) *Logger {
+	return &Logger{aec: aec, fields: kv}
+}
+
+// Returns a logger that adds the given fields to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{aec: l.aec, fields: append(fields, kv...)}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.aec.Debugf("%s", formatLogLine(msg, l.fields, kv))
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.aec.Infof("%s", formatLogLine(msg, l.fields, kv))
+}
+
+func (l *Logger) Warning(msg string, kv ...interface{}) {
+	l.aec.Warningf("%s", formatLogLine(msg, l.fields, kv))
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.aec.Errorf("%s", formatLogLine(msg, l.fields, kv))
+}
+
+// Puts the line's own fields first, then the logger's. If a key appears more
+// than once, the first value wins.
+func formatLogLine(msg string, loggerFields, lineFields []interface{}) string {
+	all := append(append([]interface{}{}, lineFields...), loggerFields...)
+	Assert(len(all)%2 == 0, "Odd number of log fields")
+	parts := []string{msg}
+	seen := map[string]bool{}
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		parts = append(parts, key+"="+formatLogValue(all[i+1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Quotes values that would otherwise be ambiguous.
+func formatLogValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case time.Duration:
+		s = strconv.FormatInt(int64(v/time.Millisecond), 10) + "ms"
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+////////////////////////////////////////
+// Request logs
+
+// Returns the name of the given handler function, e.g. "handlePay".
+func handlerName(fn interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// Records the response status.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Initializes c's App Engine context and request ID, and returns a
+// ResponseWriter that records the status for endRequest.
+func beginRequest(w http.ResponseWriter, r *http.Request, handler string, c *Context) *statusRecorder {
+	c.SetAec(newAppEngineContext(r))
+	c.SetRequestId(getRequestId(r))
+	c.SetHandler(handler)
+	w.Header().Set(kRequestIdHeader, c.RequestId())
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Logs the request and records its metrics.
+func endRequest(r *http.Request, w *statusRecorder, start time.Time, c *Context) {
+	latency := time.Since(start)
+	c.Log().Info("Handled request", "method", r.Method, "path", r.URL.Path,
+		"status", w.status, "latency", latency)
+	httpRequests.Inc(c.Handler(), strconv.Itoa(w.status))
+	httpRequestDuration.Observe(latency.Seconds(), c.Handler())
+}
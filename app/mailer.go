@@ -0,0 +1,242 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/mail"
+)
+
+// An outgoing email. Mirrors the subset of appengine/mail.Message that we use.
+type Email struct {
+	Sender   string // defaults to kEmailSender
+	ReplyTo  string
+	To       []string
+	Cc       []string
+	Subject  string
+	Body     string            // plain text body
+	HTMLBody string            // HTML body; if set, email is multipart/alternative
+	Headers  map[string]string // extra headers, e.g. List-Unsubscribe
+}
+
+type Mailer interface {
+	Send(email *Email, c *Context) error
+}
+
+// Chosen in init() based on kMailer and whether this is the dev server.
+var mailer Mailer
+
+// Sends an email using the configured Mailer. All outgoing email should go
+// through this function.
+func SendEmail(email *Email, c *Context) error {
+	if email.Sender == "" {
+		email.Sender = kEmailSender
+	}
+	err := mailer.Send(email, c)
+	if err != nil {
+		emailSendErrors.Inc()
+	}
+	return err
+}
+
+////////////////////////////////////////
+// AppEngineMailer
+
+// Sends email using the App Engine Mail API.
+type AppEngineMailer struct{}
+
+// App Engine rejects messages with any other extra headers.
+// See https://developers.google.com/appengine/docs/go/mail/#Go_Sending_mail
+var appEngineAllowedHeaders = []string{
+	"In-Reply-To", "List-Id", "List-Unsubscribe", "On-Behalf-Of", "References",
+	"Resent-Date", "Resent-From", "Resent-To",
+}
+
+func (m *AppEngineMailer) Send(email *Email, c *Context) error {
+	msg := &mail.Message{
+		Sender:   email.Sender,
+		ReplyTo:  email.ReplyTo,
+		To:       email.To,
+		Cc:       email.Cc,
+		Subject:  email.Subject,
+		Body:     email.Body,
+		HTMLBody: email.HTMLBody,
+	}
+	for k, v := range email.Headers {
+		if !ContainsString(appEngineAllowedHeaders, k) {
+			c.Log().Warning("Dropping header not allowed by App Engine", "header", k)
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = netmail.Header{}
+		}
+		msg.Headers[k] = []string{v}
+	}
+	return mail.Send(c.Aec(), msg)
+}
+
+////////////////////////////////////////
+// SmtpMailer
+
+// Sends email through an SMTP server, e.g. a local debugging server.
+type SmtpMailer struct {
+	Addr string    // host:port
+	Auth smtp.Auth // may be nil
+}
+
+func (m *SmtpMailer) Send(email *Email, c *Context) error {
+	from, err := netmail.ParseAddress(email.Sender)
+	if err != nil {
+		return err
+	}
+	rcpts := append(append([]string{}, email.To...), email.Cc...)
+	if len(rcpts) == 0 {
+		return errors.New("No recipients")
+	}
+	msg, err := FormatEmail(email)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, from.Address, rcpts, msg)
+}
+
+// Returns the RFC 5322 representation of the given email. If the email has an
+// HTML body, it is sent as multipart/alternative with the text body first.
+func FormatEmail(email *Email) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writeHeader := func(k, v string) {
+		fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+	}
+	writeHeader("From", email.Sender)
+	writeHeader("To", strings.Join(email.To, ", "))
+	if len(email.Cc) > 0 {
+		writeHeader("Cc", strings.Join(email.Cc, ", "))
+	}
+	if email.ReplyTo != "" {
+		writeHeader("Reply-To", email.ReplyTo)
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("MIME-Version", "1.0")
+	for k, v := range email.Headers {
+		writeHeader(k, v)
+	}
+
+	writePart := func(w *bytes.Buffer, body string) error {
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write([]byte(body)); err != nil {
+			return err
+		}
+		return qw.Close()
+	}
+
+	if email.HTMLBody == "" {
+		writeHeader("Content-Type", "text/plain; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writePart(buf, email.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := &bytes.Buffer{}
+	mw := multipart.NewWriter(parts)
+	writeHeader("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", mw.Boundary()))
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", email.Body},
+		{"text/html; charset=utf-8", email.HTMLBody},
+	} {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", part.contentType)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		partBuf := &bytes.Buffer{}
+		if err := writePart(partBuf, part.body); err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(partBuf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(parts.Bytes())
+	return buf.Bytes(), nil
+}
+
+////////////////////////////////////////
+// MemoryMailer
+
+type SentEmail struct {
+	Email
+	SendDate time.Time
+}
+
+// Captures email in memory instead of sending it. Used in tests and on the
+// dev server; see /dev/outbox. Note that each App Engine instance has its own
+// outbox.
+type MemoryMailer struct {
+	mu     sync.Mutex
+	outbox []*SentEmail
+}
+
+func (m *MemoryMailer) Send(email *Email, c *Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = append(m.outbox, &SentEmail{
+		Email:    *email,
+		SendDate: time.Now(),
+	})
+	c.Log().Info("Captured email", "to", strings.Join(email.To, ","), "subject", email.Subject)
+	return nil
+}
+
+// Returns captured emails, oldest first.
+func (m *MemoryMailer) Outbox() []*SentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*SentEmail{}, m.outbox...)
+}
+
+func (m *MemoryMailer) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = nil
+}
+
+func init() {
+	name := kMailer
+	if name == "" {
+		name = "appengine"
+		if appengine.IsDevAppServer() {
+			name = "memory"
+		}
+	}
+	switch name {
+	case "appengine":
+		mailer = &AppEngineMailer{}
+	case "smtp":
+		mailer = &SmtpMailer{Addr: kSmtpAddr}
+	case "memory":
+		mailer = &MemoryMailer{}
+	default:
+		panic(fmt.Sprintf("Invalid kMailer: %q", name))
+	}
+}
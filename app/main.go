@@ -6,18 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/mail"
-	"appengine/taskqueue"
-	"appengine/urlfetch"
 	"code.google.com/p/goauth2/oauth"
 )
 
@@ -34,6 +33,24 @@ func makePayUrl(reqCode, method string) string {
 	return res
 }
 
+// Signed, so that only recipients of our emails can unsubscribe.
+func makeUnsubscribeUrl(email string) string {
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("sig", SignString("unsubscribe:"+email))
+	return "/unsubscribe?" + v.Encode()
+}
+
+// Replies to this address are handled by handleInboundMail.
+// Returns "" in standalone mode, which does not receive email.
+func makeReplyToAddress(reqKey *datastore.Key, c *Context) string {
+	if standalone != nil {
+		return ""
+	}
+	local := makeReplyToLocalPart(reqKey.Parent().IntID(), reqKey.IntID())
+	return fmt.Sprintf("%s@%s.appspotmail.com", local, appengine.AppID(c.Aec()))
+}
+
 func makeWrongPasswordError(email string) error {
 	return errors.New(fmt.Sprintf("Wrong password for user: %q", email))
 }
@@ -46,12 +63,12 @@ func makePayRequestQuery(userKey *datastore.Key, isPaid bool) *datastore.Query {
 	return q.Filter("DeletionDate =", time.Unix(0, 0)).Filter("IsPaid =", isPaid)
 }
 
-func makeSentLinkMessage(linkType, email string) string {
-	return fmt.Sprintf("%s link sent to %s.", linkType, email)
+func makeSentLinkMessage(linkType, email string, c *Context) string {
+	return c.T("%s link sent to %s.", c.T(linkType), email)
 }
 
-func makeExpiredLinkError(linkType string) error {
-	return errors.New(fmt.Sprintf("%s link has expired. Please request another.", linkType))
+func makeExpiredLinkError(linkType string, c *Context) error {
+	return errors.New(c.T("%s link has expired. Please request another.", c.T(linkType)))
 }
 
 func makeXG() *datastore.TransactionOptions {
@@ -81,19 +98,25 @@ func steerThroughLogin(w http.ResponseWriter, r *http.Request, c *Context) bool
 // If checkUser is true, aborts the transaction if any PayRequest does not
 // belong to the current user.
 func updatePayRequests(reqCodes []string, updateFn func(reqCode string, req *PayRequest) bool, checkUser bool, c *Context) ([]string, error) {
+	return updatePayRequestsAndLog(reqCodes, updateFn, nil, checkUser, c)
+}
+
+// Like updatePayRequests, but also appends an event to the log of each updated
+// PayRequest, in the same transaction. eventFn is called after updateFn returns
+// true, and may return nil to skip the event.
+func updatePayRequestsAndLog(reqCodes []string, updateFn func(reqCode string, req *PayRequest) bool, eventFn func(req *PayRequest) *PayRequestEvent, checkUser bool, c *Context) ([]string, error) {
 	Assert(len(reqCodes) > 0, "No reqCodes")
 	if checkUser {
 		c.AssertLoggedIn()
 	}
 
 	var updatedReqCodes []string
-	err := datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+	err := store.RunInTransaction(func(tx Store) error {
 		updatedReqCodes = []string{} // ensure transaction is idempotent
 		for _, reqCode := range reqCodes {
-			reqKey, err := datastore.DecodeKey(reqCode)
-			CheckError(err)
-			req := &PayRequest{}
-			if err := datastore.Get(aec, reqKey, req); err != nil {
+			userId, reqId := ParseReqCode(reqCode)
+			req, err := tx.GetPayRequest(userId, reqId, c)
+			if err != nil {
 				return err
 			}
 			// Check that this PayRequest belongs to the current user; if not, abort.
@@ -103,13 +126,21 @@ func updatePayRequests(reqCodes []string, updateFn func(reqCode string, req *Pay
 			}
 			if updateFn(reqCode, req) {
 				updatedReqCodes = append(updatedReqCodes, reqCode)
-				if _, err := datastore.Put(aec, reqKey, req); err != nil {
+				if err := tx.PutPayRequest(userId, reqId, req, c); err != nil {
 					return err
 				}
+				if eventFn == nil {
+					continue
+				}
+				if event := eventFn(req); event != nil {
+					if err := tx.AddPayRequestEvent(userId, reqId, event, c); err != nil {
+						return err
+					}
+				}
 			}
 		}
 		return nil
-	}, nil)
+	}, c)
 
 	if err != nil {
 		return []string{}, err
@@ -125,10 +156,9 @@ func updateUser(userId int64, password *string, updateFn func(user *User) bool,
 		c.AssertLoggedIn()
 		Assert(c.Session().UserId == userId)
 	}
-	return datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
-		userKey := ToUserKey(c.Aec(), userId)
-		user := &User{}
-		if err := datastore.Get(aec, userKey, user); err != nil {
+	return store.RunInTransaction(func(tx Store) error {
+		user, err := tx.GetUser(userId, c)
+		if err != nil {
 			return err
 		}
 		// Check password.
@@ -136,36 +166,46 @@ func updateUser(userId int64, password *string, updateFn func(user *User) bool,
 			return makeWrongPasswordError(user.Email)
 		}
 		if updateFn(user) {
-			if _, err := datastore.Put(aec, userKey, user); err != nil {
-				return err
-			}
+			return tx.PutUser(userId, user, c)
 		}
 		return nil
-	}, nil)
+	}, c)
 }
 
-// TODO(sadovsky): Delete ResetPassword record.
-func useResetPassword(encodedKey string, c *Context) (int64, error) {
-	key, err := datastore.DecodeKey(encodedKey)
-	CheckError(err)
-	v := &ResetPassword{}
-	CheckError(datastore.Get(c.Aec(), key, v))
-	if time.Now().After(v.Timestamp.Add(time.Minute * kResetPasswordLifespanMinutes)) {
-		return 0, makeExpiredLinkError("Password reset")
-	}
-	return v.UserId, nil
+// Checks the given password reset token, and returns the user it was issued
+// to. Does not use up the token; see doResetPassword.
+func checkResetPasswordToken(token string, c *Context) (int64, error) {
+	return checkUserToken(store, token, TPResetPassword, "Password reset", false, c)
 }
 
-// TODO(sadovsky): Delete VerifyEmail record.
-func useVerifyEmail(encodedKey string, c *Context) (int64, error) {
-	key, err := datastore.DecodeKey(encodedKey)
-	CheckError(err)
-	v := &VerifyEmail{}
-	CheckError(datastore.Get(c.Aec(), key, v))
-	if time.Now().After(v.Timestamp.AddDate(0, 0, kVerifyEmailLifespan)) {
-		return 0, makeExpiredLinkError("Email verification")
-	}
-	return v.UserId, nil
+// Uses up the given password reset token, and sets the password of the user it
+// was issued to, in one transaction.
+func doResetPassword(token, newPassword string, c *Context) error {
+	return store.RunInTransaction(func(tx Store) error {
+		userId, err := checkUserToken(tx, token, TPResetPassword, "Password reset", true, c)
+		if err != nil {
+			return err
+		}
+		user, err := tx.GetUser(userId, c)
+		if err != nil {
+			return err
+		}
+		user.SaltB = GenerateSecureRandomString()
+		user.PassHashB = SaltAndHash(user.SaltB, newPassword)
+		return tx.PutUser(userId, user, c)
+	}, c)
+}
+
+// Uses up the given email verification token, and returns the user it was
+// issued to.
+func useVerifyEmailToken(token string, c *Context) (int64, error) {
+	var userId int64
+	err := store.RunInTransaction(func(tx Store) error {
+		var err error
+		userId, err = checkUserToken(tx, token, TPVerifyEmail, "Email verification", true, c)
+		return err
+	}, c)
+	return userId, err
 }
 
 // TODO(sadovsky): Differentiate between user error and app error.
@@ -175,7 +215,7 @@ func doLogin(w http.ResponseWriter, r *http.Request, c *Context) (*User, error)
 	Assert(email != "")
 
 	userId, user, err := GetUserFromEmail(email, c)
-	if err == datastore.ErrNoSuchEntity {
+	if err == ErrNoSuchEntity {
 		return nil, errors.New(fmt.Sprintf("No such user: %q", email))
 	}
 	CheckError(err)
@@ -184,8 +224,9 @@ func doLogin(w http.ResponseWriter, r *http.Request, c *Context) (*User, error)
 		return nil, makeWrongPasswordError(user.Email)
 	}
 
-	CheckError(MakeSession(userId, user.Email, user.FullName, w, c))
-	c.Aec().Infof("Logged in user: %q", user.Email)
+	CheckError(MakeSession(userId, user.Email, user.FullName, user.Locale, user.TimeZone, w, c))
+	c.SetLocale(chooseLocale(r, c))
+	c.Log().Info("Logged in user", "email", user.Email)
 	return user, nil
 }
 
@@ -197,6 +238,13 @@ func doSignup(w http.ResponseWriter, r *http.Request, c *Context) (*User, error)
 		SaltB:     salt,
 		PassHashB: SaltAndHash(salt, r.FormValue("signup-password")),
 		FullName:  ParseFullName(r.FormValue("signup-name")),
+		// Send the first summary email one period after signup.
+		DigestSentDate: time.Now(),
+		// Use the negotiated locale, so that emails to this user are sent in the
+		// same language as the signup page.
+		Locale: c.Locale(),
+		// Detected by the browser; see tadue.signup.init.
+		TimeZone: ParseTimeZone(r.FormValue("signup-time-zone")),
 	}
 	if r.FormValue("signup-copy-email") == "on" {
 		newUser.PayPalEmail = newUser.Email
@@ -208,38 +256,28 @@ func doSignup(w http.ResponseWriter, r *http.Request, c *Context) (*User, error)
 	// Check whether user already exists. If so, report error; if not, create new
 	// account.
 	var userId int64
-	err := datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+	err := store.RunInTransaction(func(tx Store) error {
 		userId = 0 // ensure transaction is idempotent
-		userIdKey := ToUserIdKey(c.Aec(), newUser.Email)
-		userIdStruct := &UserId{}
-		err := datastore.Get(aec, userIdKey, userIdStruct)
-		if err != nil && err != datastore.ErrNoSuchEntity {
+		_, err := tx.GetUserId(newUser.Email, c)
+		if err != nil && err != ErrNoSuchEntity {
 			return err
 		}
 		if err == nil { // entity already exists
 			return errors.New(fmt.Sprintf("User already exists: %q", newUser.Email))
 		}
 
-		incompleteUserKey := datastore.NewIncompleteKey(c.Aec(), "User", nil)
-		userKey, err := datastore.Put(c.Aec(), incompleteUserKey, newUser)
-		CheckError(err)
-
-		userId = userKey.IntID()
-		userIdStruct = &UserId{
-			UserId: userId,
-		}
-		if _, err := datastore.Put(aec, userIdKey, userIdStruct); err != nil {
+		if userId, err = tx.NewUser(newUser, c); err != nil {
 			return err
 		}
-		aec.Infof("Signed up user: %q", newUser.Email)
-		return nil
-	}, makeXG())
+		return tx.PutUserId(newUser.Email, userId, c)
+	}, c)
 
 	if err != nil {
 		return nil, err
 	}
+	c.Log().Info("Signed up user", "email", newUser.Email)
 
-	if err = MakeSession(userId, newUser.Email, newUser.FullName, w, c); err != nil {
+	if err = MakeSession(userId, newUser.Email, newUser.FullName, newUser.Locale, newUser.TimeZone, w, c); err != nil {
 		return nil, err
 	}
 	if err = doInitiateVerifyEmail(c); err != nil {
@@ -252,90 +290,110 @@ func doInitiateResetPassword(email string, c *Context) error {
 	// Check that it's a known user email.
 	userId, user := GetUserFromEmailOrDie(email, c)
 
-	// Create the ResetPassword record.
-	v := &ResetPassword{
-		UserId:    userId,
-		Timestamp: time.Now(),
-	}
-	key := NewEphemeralKey(c.Aec(), "ResetPassword")
-	key, err := datastore.Put(c.Aec(), key, v)
+	token, err := issueUserToken(userId, TPResetPassword, time.Minute*kResetPasswordLifespanMinutes, c)
 	if err != nil {
 		return err
 	}
 
 	// Send the email.
-	resetUrl := prependHost(fmt.Sprintf("/account/change-password?key=%s", key.Encode()), c)
-	data := map[string]interface{}{
-		"fullName": user.FullName,
-		"email":    user.Email,
-		"resetUrl": resetUrl,
-	}
-	body, err := ExecuteTextTemplate("email-reset-password.txt", data)
+	resetUrl := prependHost(fmt.Sprintf("/account/change-password?token=%s", url.QueryEscape(token)), c)
+	data := &ResetPasswordEmailData{
+		FullName: user.FullName,
+		Email:    user.Email,
+		ResetUrl: resetUrl,
+	}
+	subject := Translate(user.Locale, "Reset your Tadue password")
+	body, htmlBody, err := ExecuteEmailTemplates(user.Locale, "email-reset-password", subject, data, c)
 	if err != nil {
 		return err
 	}
 
-	msg := &mail.Message{
-		Sender:  "Tadue <noreply@tadue.com>",
-		To:      []string{user.Email},
-		Subject: "Reset your Tadue password",
-		Body:    body,
+	msg := &Email{
+		To:       []string{user.Email},
+		Subject:  subject,
+		Body:     body,
+		HTMLBody: htmlBody,
 	}
-	return mail.Send(c.Aec(), msg)
+	return SendEmail(msg, c)
 }
 
 func doInitiateVerifyEmail(c *Context) error {
-	// Create the VerifyEmail record.
-	v := &VerifyEmail{
-		UserId:    c.Session().UserId,
-		Timestamp: time.Now(),
-	}
-	key := NewEphemeralKey(c.Aec(), "VerifyEmail")
-	key, err := datastore.Put(c.Aec(), key, v)
+	token, err := issueUserToken(c.Session().UserId, TPVerifyEmail, time.Hour*24*kVerifyEmailLifespan, c)
 	if err != nil {
 		return err
 	}
 
 	// Send the email.
-	verifUrl := prependHost(fmt.Sprintf("/account/verif?key=%s", key.Encode()), c)
-	data := map[string]interface{}{
-		"fullName": c.Session().FullName,
-		"verifUrl": verifUrl,
+	verifUrl := prependHost(fmt.Sprintf("/account/verif?token=%s", url.QueryEscape(token)), c)
+	data := &VerifEmailData{
+		FullName: c.Session().FullName,
+		VerifUrl: verifUrl,
 	}
-	body, err := ExecuteTextTemplate("email-verif.txt", data)
+	subject := c.T("Welcome to Tadue")
+	body, htmlBody, err := ExecuteEmailTemplates(c.Locale(), "email-verif", subject, data, c)
 	if err != nil {
 		return err
 	}
 
-	msg := &mail.Message{
-		Sender:  "Tadue <noreply@tadue.com>",
-		To:      []string{c.Session().Email},
-		Subject: "Welcome to Tadue",
-		Body:    body,
+	msg := &Email{
+		To:       []string{c.Session().Email},
+		Subject:  subject,
+		Body:     body,
+		HTMLBody: htmlBody,
 	}
-	return mail.Send(c.Aec(), msg)
+	return SendEmail(msg, c)
 }
 
-func doEnqueuePayRequestEmails(reqCodes []string, c *Context) error {
-	c.Aec().Infof("Enqueuing pay request emails for reqCodes: %v", reqCodes)
+// If isAutoReminder is true, each email is only sent if the request's reminder
+// policy says a reminder is due, and counts toward the policy's MaxCount.
+func doEnqueuePayRequestEmailsImpl(reqCodes []string, isAutoReminder bool, c *Context) error {
+	c.Log().Info("Enqueuing pay request emails", "reqCodes", strings.Join(reqCodes, ","))
 	if len(reqCodes) == 0 {
 		return nil
 	}
 	v := url.Values{}
 	v.Set("reqCodes", strings.Join(reqCodes, ","))
-	t := taskqueue.NewPOSTTask("/tasks/send-pay-request-emails", v)
-	_, err := taskqueue.Add(c.Aec(), t, "")
-	return err
+	if isAutoReminder {
+		v.Set("auto", "true")
+	}
+	return EnqueueTask("/tasks/send-pay-request-emails", v, "", c)
+}
+
+func doEnqueuePayRequestEmails(reqCodes []string, c *Context) error {
+	return doEnqueuePayRequestEmailsImpl(reqCodes, false, c)
+}
+
+func doEnqueueAutoReminderEmail(reqCode string, c *Context) error {
+	return doEnqueuePayRequestEmailsImpl([]string{reqCode}, true, c)
 }
 
 func doEnqueuePaymentDoneEmail(reqCode, method string, c *Context) error {
-	c.Aec().Infof("Enqueuing payment done email for reqCode=%q, method=%q", reqCode, method)
+	c.Log().Info("Enqueuing payment done email", "reqCode", reqCode, "method", method)
 	v := url.Values{}
 	v.Set("reqCode", reqCode)
 	v.Set("method", method)
-	t := taskqueue.NewPOSTTask("/tasks/send-payment-done-email", v)
-	_, err := taskqueue.Add(c.Aec(), t, "")
-	return err
+	return EnqueueTask("/tasks/send-payment-done-email", v, "", c)
+}
+
+func doEnqueueOverdueEmail(reqCode string, c *Context) error {
+	c.Log().Info("Enqueuing overdue email", "reqCode", reqCode)
+	v := url.Values{}
+	v.Set("reqCode", reqCode)
+	return EnqueueTask("/tasks/send-overdue-email", v, "", c)
+}
+
+func doEnqueueReplyEmail(commentCode string, c *Context) error {
+	c.Log().Info("Enqueuing reply email", "commentCode", commentCode)
+	v := url.Values{}
+	v.Set("commentCode", commentCode)
+	return EnqueueTask("/tasks/send-reply-email", v, "", c)
+}
+
+func doEnqueueDigestEmail(userId int64, c *Context) error {
+	c.Log().Info("Enqueuing digest email", "payeeUserId", userId)
+	v := url.Values{}
+	v.Set("userId", strconv.FormatInt(userId, 10))
+	return EnqueueTask("/tasks/send-digest-email", v, "", c)
 }
 
 func doSetEmailOk(userId int64, c *Context) (email string, sentPayRequestEmails bool, err error) {
@@ -355,33 +413,152 @@ func doSetEmailOk(userId int64, c *Context) (email string, sentPayRequestEmails
 	} else if alreadyVerified {
 		return user.Email, false, nil
 	}
-	c.Aec().Infof("Verified email: %q", user.Email)
+	c.Log().Info("Verified email", "email", user.Email)
 
 	// Enqueue pay request emails.
-	userKey := ToUserKey(c.Aec(), userId)
-	q := makePayRequestQuery(userKey, false).KeysOnly()
-	reqKeys, err := q.GetAll(c.Aec(), nil)
+	reqIds, _, err := store.GetPayRequestsByStatus(userId, false, 0, c)
 	CheckError(err)
-	reqCodes := make([]string, len(reqKeys))
-	for i, reqKey := range reqKeys {
-		reqCodes[i] = reqKey.Encode()
+	reqCodes := make([]string, len(reqIds))
+	for i, reqId := range reqIds {
+		reqCodes[i] = MakeReqCode(userId, reqId, c)
 	}
 	CheckError(doEnqueuePayRequestEmails(reqCodes, c))
 	return user.Email, len(reqCodes) > 0, nil
 }
 
+// Adds the given email to the suppression list. If the email is already
+// suppressed, keeps the original reason.
+func doSuppressEmail(email string, reason int, details string, c *Context) error {
+	if IsSuppressedOrDie(email, c) {
+		return nil
+	}
+	sup := &Suppression{Reason: reason, Timestamp: time.Now(), Details: details}
+	if err := store.PutSuppression(email, sup, c); err != nil {
+		return err
+	}
+	c.Log().Info("Suppressed email address", "email", email, "reason", reason, "details", details)
+	return nil
+}
+
+// Flags the PayRequests that a bounce or complaint is about: bounces mark the
+// request as bounced, so that its payee can fix the payer email, and complaints
+// turn off its reminders. Reports are not authenticated, so we only act on
+// requests that the original message proves we emailed, via a reqCode or a
+// signed reply-to address, and only if the request's payer is among the
+// reported recipients. In particular, reports never add global suppressions.
+func doProcessDeliveryReport(report *DeliveryReport, c *Context) error {
+	if len(report.Recipients) == 0 {
+		return nil
+	}
+	reqCodes := []string{}
+	for _, reqCode := range report.ReqCodes {
+		reqKey, err := datastore.DecodeKey(reqCode)
+		if err == nil && reqKey.Kind() == "PayRequest" && reqKey.Parent() != nil {
+			reqCodes = append(reqCodes, reqCode)
+		}
+	}
+	for _, addr := range report.ReplyTo {
+		if userId, reqId, err := parseReplyToLocalPart(addr); err == nil {
+			reqCodes = append(reqCodes, MakeReqCode(userId, reqId, c))
+		}
+	}
+
+	now := time.Now()
+	updateFn := func(reqCode string, req *PayRequest) bool {
+		if req.IsPaid || !ContainsString(report.Recipients, req.PayerEmail) {
+			return false
+		}
+		if report.IsComplaint {
+			if req.ReminderPolicy.Mode == RMOff {
+				return false
+			}
+			req.ReminderPolicy = ReminderPolicy{Mode: RMOff}
+			return true
+		}
+		if isBounced(req) {
+			return false
+		}
+		req.BounceDate = now
+		return true
+	}
+	// Requests may belong to different payees, so update each one separately.
+	for _, reqCode := range dedupStrings(reqCodes) {
+		updated, err := updatePayRequests([]string{reqCode}, updateFn, false, c)
+		if err == ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(updated) > 0 {
+			c.Log().Info("Processed delivery report", "reqCode", reqCode,
+				"complaint", report.IsComplaint, "details", report.Details)
+		}
+	}
+	return nil
+}
+
+// Stores a payer's reply to a payment request email as a Comment on the
+// PayRequest, and forwards it to the payee. The "to" argument is the address
+// the reply was sent to; see makeReplyToAddress.
+func doProcessReply(to string, body io.Reader, c *Context) error {
+	userId, reqId, err := parseReplyToLocalPart(to)
+	if err != nil {
+		return err
+	}
+	reply, err := ParseReplyEmail(body)
+	if err != nil {
+		return err
+	}
+	if reply.IsAutoReply || reply.Body == "" {
+		c.Log().Info("Ignoring reply", "from", reply.From, "auto", reply.IsAutoReply)
+		return nil
+	}
+	req, err := store.GetPayRequest(userId, reqId, c)
+	if err != nil {
+		return err
+	}
+	reqKey := ToPayRequestKey(c.Aec(), userId, reqId)
+	comment := &Comment{
+		Author:      reply.From,
+		Body:        reply.Body,
+		Timestamp:   time.Now(),
+		ConfirmDate: time.Unix(0, 0),
+	}
+	// Only the payer may send commands. Even then, the payee must confirm.
+	if reply.From == req.PayerEmail {
+		comment.Command = parseReplyCommand(reply.Body)
+	}
+	commentKey, err := datastore.Put(c.Aec(), datastore.NewIncompleteKey(c.Aec(), "Comment", reqKey), comment)
+	if err != nil {
+		return err
+	}
+	c.Log().Info("Stored reply", "from", reply.From, "command", comment.Command)
+	return doEnqueueReplyEmail(commentKey.Encode(), c)
+}
+
+func doStopReminders(reqCodes []string, checkUser bool, c *Context) ([]string, error) {
+	updateFn := func(reqCode string, req *PayRequest) bool {
+		if req.ReminderPolicy.Mode == RMOff {
+			return false
+		}
+		req.ReminderPolicy = ReminderPolicy{Mode: RMOff}
+		return true
+	}
+	return updatePayRequests(reqCodes, updateFn, checkUser, c)
+}
+
 ////////////////////////////////////////
-// DatastoreOAuthTokenCache
+// StoreOAuthTokenCache
 
 // Implements oauth.Cache.
-type DatastoreOAuthTokenCache struct {
+type StoreOAuthTokenCache struct {
 	UserId  int64
 	Context *Context
 	Service string
 }
 
-func (tc *DatastoreOAuthTokenCache) Token() (*oauth.Token, error) {
-	t, err := GetOAuthTokenFromUserId(tc.UserId, tc.Service, tc.Context)
+func (tc *StoreOAuthTokenCache) Token() (*oauth.Token, error) {
+	t, err := store.GetOAuthToken(tc.UserId, tc.Service, tc.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -392,19 +569,16 @@ func (tc *DatastoreOAuthTokenCache) Token() (*oauth.Token, error) {
 	}, nil
 }
 
-func (tc *DatastoreOAuthTokenCache) PutToken(t *oauth.Token) error {
-	tokenKey := ToOAuthTokenKey(tc.Context.Aec(), tc.UserId, tc.Service)
-	_, err := datastore.Put(tc.Context.Aec(), tokenKey, &OAuthToken{
+func (tc *StoreOAuthTokenCache) PutToken(t *oauth.Token) error {
+	return store.PutOAuthToken(tc.UserId, tc.Service, &OAuthToken{
 		AccessToken:  t.AccessToken,
 		RefreshToken: t.RefreshToken,
 		Expiry:       t.Expiry,
-	})
-	return err
+	}, tc.Context)
 }
 
-func (tc *DatastoreOAuthTokenCache) DeleteToken() error {
-	tokenKey := ToOAuthTokenKey(tc.Context.Aec(), tc.UserId, tc.Service)
-	return datastore.Delete(tc.Context.Aec(), tokenKey)
+func (tc *StoreOAuthTokenCache) DeleteToken() error {
+	return store.DeleteOAuthToken(tc.UserId, tc.Service, tc.Context)
 }
 
 ////////////////////////////////////////
@@ -447,12 +621,12 @@ func handleIpn(w http.ResponseWriter, r *http.Request, c *Context) {
 	CheckError(r.ParseForm())
 	reqCode := r.FormValue("reqCode")
 	Assert(reqCode != "", "No reqCode")
-	reqKey, err := datastore.DecodeKey(reqCode)
-	CheckError(err)
+	userId, reqId := ParseReqCode(reqCode)
 
 	msg, err := PayPalValidateIpn(string(requestBytes), c)
 	CheckError(err)
-	c.Aec().Infof("%+v", msg) // plus flag (%+v) adds field names
+	c.Log().Info("Got IPN", "reqCode", reqCode, "ipnStatus", msg.Status, "payer", msg.PayerEmail,
+		"payee", msg.PayeeEmail, "amount", msg.Amount, "payKey", msg.PayKey)
 
 	// If the transaction is not completed, we don't care.
 	// TODO(sadovsky): Should we care? Probably.
@@ -461,15 +635,15 @@ func handleIpn(w http.ResponseWriter, r *http.Request, c *Context) {
 	}
 
 	var shouldSendEmail bool
-	err = datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+	err = store.RunInTransaction(func(tx Store) error {
 		shouldSendEmail = true // ensure transaction is idempotent
-		req := &PayRequest{}
-		if err := datastore.Get(aec, reqKey, req); err != nil {
+		req, err := tx.GetPayRequest(userId, reqId, c)
+		if err != nil {
 			return err
 		}
 
 		// Get payee's User object so we can get their paypal email.
-		payee := GetUserOrDie(GetPayeeUserKey(reqCode), c)
+		payee := GetUserFromUserIdOrDie(userId, c)
 
 		// Check payee's paypal email and amount.
 		if msg.PayeeEmail != payee.PayPalEmail {
@@ -490,46 +664,62 @@ func handleIpn(w http.ResponseWriter, r *http.Request, c *Context) {
 		}
 		req.IsPaid = true
 		req.PaymentDate = time.Now()
-		if _, err := datastore.Put(aec, reqKey, req); err != nil {
+		if err := tx.PutPayRequest(userId, reqId, req, c); err != nil {
 			return err
 		}
+		event := &PayRequestEvent{Type: ETPaid, Actor: EAPayer, Date: req.PaymentDate, Detail: "paypal"}
 		// TODO(sadovsky): Maybe store payer's paypal email, since we know it here.
-		return nil
-	}, nil)
+		return tx.AddPayRequestEvent(userId, reqId, event, c)
+	}, c)
 	CheckError(err)
 
 	if shouldSendEmail {
+		payments.Inc("paypal", "payer")
 		CheckError(doEnqueuePaymentDoneEmail(reqCode, "paypal", c))
+		doEnqueueWebhookEvents(WEPaid, []string{reqCode}, c)
 	}
 }
 
 func handlePay(w http.ResponseWriter, r *http.Request, c *Context) {
 	reqCode := r.FormValue("reqCode")
 	Assert(reqCode != "", "No reqCode")
-	reqKey, err := datastore.DecodeKey(reqCode)
-	CheckError(err)
+	userId, reqId := ParseReqCode(reqCode)
 
 	method := r.FormValue("method")
 	Assert(method == "" || method == "offline" || method == "paypal",
 		fmt.Sprintf("Invalid method: %q", method))
 
-	// TODO(sadovsky): Cache PayRequest and User lookups so that multiple loads of
-	// this page (e.g. first with method="", then with method="paypal") don't all
-	// hit the datastore.
-	req := &PayRequest{}
-	CheckError(datastore.Get(c.Aec(), reqKey, req))
+	req, err := store.GetPayRequest(userId, reqId, c)
+	CheckError(err)
 
 	// If request has already been paid, show an error.
 	// TODO(sadovsky): Make error message more friendly.
 	if req.PaymentDate != time.Unix(0, 0) {
-		RedirectWithMessage(w, r, "/", "Already paid.")
+		RedirectWithMessage(w, r, "/", c.T("Already paid."))
 		return
 	}
 
 	// Get payee's User object so we can get their name and paypal email.
-	payee := GetUserOrDie(GetPayeeUserKey(reqCode), c)
+	payee := GetUserFromUserIdOrDie(userId, c)
 
 	if method == "" {
+		// The payee also lands here when they click on one of their requests.
+		isPayer := !c.LoggedIn() || c.Session().Email != req.PayeeEmail
+		if isPayer {
+			CheckError(doRecordPayPageView(userId, reqId, c))
+		}
+		// If we don't know the payer's locale yet, assume it's the one their
+		// browser asked for.
+		if isPayer && req.PayerLocale == "" {
+			_, err := updatePayRequests([]string{reqCode}, func(reqCode string, req *PayRequest) bool {
+				if req.PayerLocale != "" {
+					return false
+				}
+				req.PayerLocale = c.Locale()
+				return true
+			}, false, c)
+			CheckError(err)
+		}
 		data := map[string]interface{}{
 			"payerEmail":       req.PayerEmail,
 			"payeeEmail":       payee.PayPalEmail,
@@ -545,7 +735,7 @@ func handlePay(w http.ResponseWriter, r *http.Request, c *Context) {
 		CheckError(err)
 		err = doEnqueuePaymentDoneEmail(reqCode, method, c)
 		CheckError(err)
-		RedirectWithMessage(w, r, "/", "Payment marked as complete. Thanks for using Tadue!")
+		RedirectWithMessage(w, r, "/", c.T("Payment marked as complete. Thanks for using Tadue!"))
 	} else { // method == "paypal"
 		// According to the PayPal documentation, the pay key is only valid for
 		// three hours, so we must request it when the payer arrives.
@@ -558,7 +748,7 @@ func handlePay(w http.ResponseWriter, r *http.Request, c *Context) {
 }
 
 func handlePayDone(w http.ResponseWriter, r *http.Request, c *Context) {
-	RedirectWithMessage(w, r, "/", "Payment processed successfully. Thanks for using Tadue!")
+	RedirectWithMessage(w, r, "/", c.T("Payment processed successfully. Thanks for using Tadue!"))
 }
 
 func handleRequestPayment(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -567,8 +757,8 @@ func handleRequestPayment(w http.ResponseWriter, r *http.Request, c *Context) {
 		doInitAutoComplete := false
 		if c.LoggedIn() && strings.HasSuffix(c.Session().Email, "gmail.com") {
 			// Check whether user has done the OAuth dance.
-			if _, err := GetOAuthTokenFromUserId(c.Session().UserId, "google", c); err != nil {
-				if err != datastore.ErrNoSuchEntity {
+			if _, err := store.GetOAuthToken(c.Session().UserId, "google", c); err != nil {
+				if err != ErrNoSuchEntity {
 					CheckError(err)
 				}
 				// User has not done the OAuth dance.
@@ -583,6 +773,7 @@ func handleRequestPayment(w http.ResponseWriter, r *http.Request, c *Context) {
 			"loggedIn":           c.LoggedIn(),
 			"authCodeUrl":        authCodeUrl,
 			"doInitAutoComplete": doInitAutoComplete,
+			"reminderPolicy":     makeReminderPolicyForm(ReminderPolicy{}, true),
 		}
 		RenderPageOrDie(w, c, "request-payment", data)
 		return
@@ -618,54 +809,103 @@ func handleRequestPayment(w http.ResponseWriter, r *http.Request, c *Context) {
 	paymentType := ParsePaymentType(r.FormValue("payment-type"))
 	// Make it so all requests have the same creation date.
 	creationDate := time.Now()
+	loc := getLocation(user.TimeZone)
+	dueDate := ParseDueDate(r.FormValue("due-date"), loc)
+	Assert(dueDate.Equal(time.Unix(0, 0)) || calendarDaysBetween(creationDate, dueDate, loc) >= 0,
+		"Due date is in the past: ", dueDate)
+	reminderPolicy, ok := ParseReminderPolicy(
+		r.FormValue("reminder-mode"), r.FormValue("reminder-every-days"),
+		r.FormValue("reminder-offsets"), r.FormValue("reminder-max-count"))
+	if !ok {
+		reminderPolicy = user.ReminderPolicy
+	}
 
 	reqs := []*PayRequest{}
 	for k, v := range r.Form {
 		if strings.HasPrefix(k, "payer-email-") {
 			id := k[len("payer-email-"):]
 			req := &PayRequest{
-				PayeeEmail:       c.Session().Email,
-				PayerEmail:       ParseEmail(v[0]),
-				Amount:           ParseAmount(r.FormValue("amount-" + id)),
-				PaymentType:      paymentType,
-				Description:      r.FormValue("description"),
-				CreationDate:     creationDate,
-				PaymentDate:      time.Unix(0, 0),
-				DeletionDate:     time.Unix(0, 0),
-				ReminderSentDate: time.Unix(0, 0),
+				PayerEmail:     ParseEmail(v[0]),
+				Amount:         ParseAmount(r.FormValue("amount-" + id)),
+				PaymentType:    paymentType,
+				Description:    r.FormValue("description"),
+				CreationDate:   creationDate,
+				DueDate:        dueDate,
+				ReminderPolicy: reminderPolicy,
 			}
 			reqs = append(reqs, req)
 		}
 	}
+	_, err = doCreatePayRequests(user, reqs, c)
+	CheckError(err)
+
+	target := "/payments"
+	if isNewUser {
+		target = "/payments?new"
+	}
+	RedirectWithMessage(w, r, target, c.T("Payment request made."))
+}
+
+// Creates the given PayRequests for the logged-in user, whose User struct is
+// given. Callers set the payer, amount, description, payment type, creation
+// date, due date, and reminder policy; the remaining fields are set here. If the
+// user's email is verified, also enqueues the pay request emails. Creates at
+// most kMaxPayRequestsPerBatch requests; see doImportPayRequests for more. On
+// error, returns the codes of any requests that were created anyway.
+func doCreatePayRequests(user *User, reqs []*PayRequest, c *Context) ([]string, error) {
+	c.AssertLoggedIn()
 	Assert(len(reqs) > 0, "No requests")
-	Assert(len(reqs) < 50, "Too many requests")
+	Assert(len(reqs) <= kMaxPayRequestsPerBatch, "Too many requests")
+
+	for _, req := range reqs {
+		req.PayeeEmail = c.Session().Email
+		req.PaymentDate = time.Unix(0, 0)
+		req.DeletionDate = time.Unix(0, 0)
+		req.ReminderSentDate = time.Unix(0, 0)
+		req.OverdueSentDate = time.Unix(0, 0)
+		req.BounceDate = time.Unix(0, 0)
+		req.TimeZone = user.TimeZone
+		// If the payer has a Tadue account, email them in their language and time
+		// zone.
+		if _, payer, err := GetUserFromEmail(req.PayerEmail, c); err == nil {
+			req.PayerLocale = payer.Locale
+			req.PayerTimeZone = payer.TimeZone
+		} else if err != ErrNoSuchEntity {
+			return nil, err
+		}
+	}
 
 	var reqCodes []string
-	err = datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+	userId := c.Session().UserId
+	err := store.RunInTransaction(func(tx Store) error {
 		reqCodes = []string{} // ensure transaction is idempotent
 		for _, req := range reqs {
-			incompleteReqKey := datastore.NewIncompleteKey(
-				c.Aec(), "PayRequest", ToUserKey(c.Aec(), c.Session().UserId))
-			reqKey, err := datastore.Put(c.Aec(), incompleteReqKey, req)
+			reqId, err := tx.NewPayRequest(userId, req, c)
 			if err != nil {
 				return err
 			}
-			reqCodes = append(reqCodes, reqKey.Encode())
+			event := &PayRequestEvent{Type: ETCreated, Actor: EAPayee, Date: req.CreationDate}
+			if err := tx.AddPayRequestEvent(userId, reqId, event, c); err != nil {
+				return err
+			}
+			reqCodes = append(reqCodes, MakeReqCode(userId, reqId, c))
 		}
 		return nil
-	}, nil)
-	CheckError(err)
-
-	// If payee's email is already verified, enqueue the pay request emails.
-	if user.EmailOk {
-		CheckError(doEnqueuePayRequestEmails(reqCodes, c))
+	}, c)
+	if err != nil {
+		return nil, err
 	}
+	payRequestsCreated.Add(float64(len(reqCodes)), c.Handler())
+	doEnqueueWebhookEvents(WECreated, reqCodes, c)
 
-	target := "/payments"
-	if isNewUser {
-		target = "/payments?new"
+	// If payee's email is already verified, enqueue the pay request emails. The
+	// requests exist even if this fails, so we return their codes.
+	if user.EmailOk {
+		if err := doEnqueuePayRequestEmails(reqCodes, c); err != nil {
+			return reqCodes, err
+		}
 	}
-	RedirectWithMessage(w, r, target, "Payment request made.")
+	return reqCodes, nil
 }
 
 // Url should be one of:
@@ -675,10 +915,10 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, c *Context) {
 	c.AssertLoggedIn()
 	code, error := r.FormValue("code"), r.FormValue("error")
 	if code == "" || error != "" {
-		RenderTemplateOrDie(w, "close-oauth.html", map[string]interface{}{"ok": false})
+		RenderTemplateOrDie(w, c, "close-oauth.html", map[string]interface{}{"ok": false})
 		return
 	}
-	tc := &DatastoreOAuthTokenCache{
+	tc := &StoreOAuthTokenCache{
 		UserId:  c.Session().UserId,
 		Context: c,
 		Service: "google",
@@ -686,11 +926,11 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, c *Context) {
 	// NOTE(sadovsky): GAE requires us to set Transport below.
 	transport := &oauth.Transport{
 		Config:    GoogleMakeConfig(tc),
-		Transport: &urlfetch.Transport{Context: c.Aec()},
+		Transport: newHttpTransport(0, c),
 	}
 	_, err := transport.Exchange(code)
 	CheckError(err)
-	RenderTemplateOrDie(w, "close-oauth.html", map[string]interface{}{"ok": true})
+	RenderTemplateOrDie(w, c, "close-oauth.html", map[string]interface{}{"ok": true})
 }
 
 func handleGetContacts(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -699,7 +939,7 @@ func handleGetContacts(w http.ResponseWriter, r *http.Request, c *Context) {
 		return
 	}
 	c.AssertLoggedIn()
-	tc := &DatastoreOAuthTokenCache{
+	tc := &StoreOAuthTokenCache{
 		UserId:  c.Session().UserId,
 		Context: c,
 		Service: "google",
@@ -707,7 +947,7 @@ func handleGetContacts(w http.ResponseWriter, r *http.Request, c *Context) {
 	// NOTE(sadovsky): GAE requires us to set Transport below.
 	transport := &oauth.Transport{
 		Config:    GoogleMakeConfig(tc),
-		Transport: &urlfetch.Transport{Context: c.Aec()},
+		Transport: newHttpTransport(0, c),
 	}
 	apiResponse, err := transport.Client().Get(GOOGLE_API_REQUEST)
 	// If the request failed, the user probably revoked their OAuth token. We
@@ -725,7 +965,7 @@ func handleGetContacts(w http.ResponseWriter, r *http.Request, c *Context) {
 	contacts, err := GoogleParseContacts(apiResponse.Body)
 	CheckError(err)
 
-	c.Aec().Debugf("Parsed %d contacts", len(contacts))
+	c.Log().Debug("Parsed contacts", "count", len(contacts))
 	// Prepare list of "Name <Email>" strings.
 	contact_strs := make([]string, len(contacts))
 	for i, v := range contacts {
@@ -786,65 +1026,59 @@ type RenderablePayRequest struct {
 	Amount       string
 	Description  string
 	IsPaid       bool
+	IsBounced    bool // email to payer bounced; payee should fix the address
+	IsOptedOut   bool // payer unsubscribed
 	Status       string
+	DueStatus    string
+	IsOverdue    bool
+	Reminders    string // description of reminder policy
 	CreationDate string
 }
 
-func renderDate(t time.Time) string {
-	// TODO(sadovsky): For now, we always use Pacific time.
-	loc, err := time.LoadLocation("America/Los_Angeles")
-	CheckError(err)
-	if t.Equal(time.Unix(0, 0)) {
-		loc = time.UTC
-	}
-	// return t.In(loc).Format("Jan 2 15:04:05")
-	return t.In(loc).Format("Jan 2")
-}
-
 func renderAmount(amount float32) string {
 	return fmt.Sprintf("$%.2f", amount)
 }
 
-func getRecentPayRequestsOrDie(userId int64, emailOk bool, sentReminderReqCodes []string, c *Context) []RenderablePayRequest {
-	userKey := ToUserKey(c.Aec(), userId)
-	reqs := []PayRequest{}
-
-	// Get unpaid requests. Then, if there's still space, append paid requests.
-	// Note the similarity to email inbox rendering.
-	q := makePayRequestQuery(userKey, false).
-		Order("-CreationDate").Limit(kMaxPaymentsToShow)
-	reqKeys, err := q.GetAll(c.Aec(), &reqs)
+// Returns one page of the user's requests that match the given filter, along
+// with the cursor for the next page (empty if there is none).
+func getPayRequestsPageOrDie(userId int64, f *PaymentsFilter, emailOk bool, sentReminderReqCodes []string, c *Context) ([]RenderablePayRequest, string) {
+	reqIds, reqs, nextCursor, err := store.QueryPayRequests(userId, f, c)
 	CheckError(err)
+	Assert(len(reqs) <= kMaxPaymentsToShow)
+	Assert(len(reqs) == len(reqIds))
 
-	// NOTE(sadovsky): Because GAE does not allow Filter("x !="), and also does
-	// not allow Filter("x >") with Order("y") for x != y, we must filter on
-	// IsPaid rather than PaymentDate.
-	if len(reqs) < kMaxPaymentsToShow {
-		q = makePayRequestQuery(userKey, true).
-			Order("-CreationDate").Limit(kMaxPaymentsToShow - len(reqs))
-		extraReqKeys, err := q.GetAll(c.Aec(), &reqs)
-		CheckError(err)
-		reqKeys = append(reqKeys, extraReqKeys...)
+	// Look up which unpaid payers have opted out of our emails.
+	payerEmails := []string{}
+	for _, pr := range reqs {
+		if !pr.IsPaid && !ContainsString(payerEmails, pr.PayerEmail) {
+			payerEmails = append(payerEmails, pr.PayerEmail)
+		}
 	}
-	Assert(len(reqs) <= kMaxPaymentsToShow)
-	Assert(len(reqs) == len(reqKeys))
+	sups := GetSuppressionsOrDie(payerEmails, c)
 
 	// Convert PayRequests to RenderablePayRequests.
+	now := time.Now()
+	loc := c.Location()
 	rendReqs := make([]RenderablePayRequest, len(reqs))
 	for i, pr := range reqs {
 		rpr := &rendReqs[i]
-		rpr.ReqCode = reqKeys[i].Encode()
+		rpr.ReqCode = MakeReqCode(userId, reqIds[i], c)
 		rpr.PayUrl = makePayUrl(rpr.ReqCode, "")
 		rpr.PayerEmail = pr.PayerEmail
 		rpr.Amount = renderAmount(pr.Amount)
 		rpr.Description = pr.Description
 		rpr.IsPaid = pr.IsPaid
-		// TODO(sadovsky): Get user's time zone during signup.
-		// https://bitbucket.org/pellepim/jstimezonedetect/wiki/Home
-		// http://arshaw.com/xdate/
+		rpr.IsBounced = !pr.IsPaid && isBounced(&pr)
+		if _, ok := sups[pr.PayerEmail]; ok && !pr.IsPaid {
+			rpr.IsOptedOut = true
+		}
 		if pr.PaymentDate != time.Unix(0, 0) {
-			rpr.Status = "Paid on " + renderDate(pr.PaymentDate)
-		} else if pr.ReminderSentDate != time.Unix(0, 0) {
+			rpr.Status = c.T("Paid on %s", renderDate(pr.PaymentDate, loc))
+		} else if rpr.IsBounced {
+			rpr.Status = c.T("Email bounced")
+		} else if rpr.IsOptedOut {
+			rpr.Status = c.T("Payer opted out of reminders")
+		} else if pr.ReminderSentDate != time.Unix(0, 0) || ContainsString(sentReminderReqCodes, rpr.ReqCode) {
 			// If this function was called via handleSendReminder, the reminder emails
 			// have been enqueued, but may not have been sent yet. Optimistically show
 			// them as sent.
@@ -854,18 +1088,44 @@ func getRecentPayRequestsOrDie(userId int64, emailOk bool, sentReminderReqCodes
 			if ContainsString(sentReminderReqCodes, rpr.ReqCode) {
 				reminderSentDate = time.Now()
 			}
-			rpr.Status = "Emailed on " + renderDate(reminderSentDate)
+			rpr.Status = c.T("Emailed on %s", renderDate(reminderSentDate, loc))
 		} else if emailOk {
 			// This function was called by handlePayments. User is verified, so emails
 			// must have been enqueued, but apparently they have not been sent yet.
 			// Optimistically show them as sent.
-			rpr.Status = "Emailed on " + renderDate(time.Now())
+			rpr.Status = c.T("Emailed on %s", renderDate(time.Now(), loc))
 		} else {
-			rpr.Status = "Pending verification"
+			rpr.Status = c.T("Pending verification")
 		}
-		rpr.CreationDate = renderDate(pr.CreationDate)
+		rpr.DueStatus = renderDueStatus(c.Locale(), &pr, now)
+		rpr.IsOverdue = isOverdue(&pr, now)
+		rpr.Reminders = renderReminderPolicy(c.Locale(), pr.ReminderPolicy)
+		rpr.CreationDate = renderDate(pr.CreationDate, loc)
+	}
+	return rendReqs, nextCursor
+}
+
+// Returns the data used by the "payments-data" template.
+func makePaymentsData(r *http.Request, emailOk bool, sentReminderReqCodes []string, c *Context) map[string]interface{} {
+	f := ParsePaymentsFilter(r, c.Location())
+	rendReqs, nextCursor := getPayRequestsPageOrDie(c.Session().UserId, f, emailOk, sentReminderReqCodes, c)
+	nextPageUrl, firstPageUrl := "", ""
+	if nextCursor != "" {
+		v := f.Values()
+		v.Set("cursor", nextCursor)
+		nextPageUrl = "/payments?" + v.Encode()
+	}
+	if f.Cursor != "" {
+		firstPageUrl = "/payments?" + f.Values().Encode()
+	}
+	return map[string]interface{}{
+		"rendReqs":         rendReqs,
+		"undoableReqCodes": "",
+		"filter":           f.Values(),
+		"isFiltered":       f.IsActive(),
+		"nextPageUrl":      nextPageUrl,
+		"firstPageUrl":     firstPageUrl,
 	}
-	return rendReqs
 }
 
 func handlePayments(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -873,25 +1133,20 @@ func handlePayments(w http.ResponseWriter, r *http.Request, c *Context) {
 		return
 	}
 	user := GetUserFromSessionOrDie(c)
-	rendReqs := getRecentPayRequestsOrDie(c.Session().UserId, user.EmailOk, []string{}, c)
-	data := map[string]interface{}{
-		"user":              user,
-		"isNew":             !user.EmailOk && r.Form["new"] != nil,
-		"rendReqs":          rendReqs,
-		"undoableReqCodes":  "",
-		"reminderFrequency": kAutoPayRequestEmailFrequency,
-	}
+	data := makePaymentsData(r, user.EmailOk, []string{}, c)
+	data["user"] = user
+	data["isNew"] = !user.EmailOk && r.Form["new"] != nil
+	data["reminderPolicy"] = renderReminderPolicy(c.Locale(), user.ReminderPolicy)
 	RenderPageOrDie(w, c, "payments", data)
 }
 
-func renderRecentRequests(w http.ResponseWriter, undoableReqCodes, sentReminderReqCodes []string, c *Context) {
+// Renders the "payments-data" fragment after an AJAX action. The request URL
+// carries the payments page's filter params, so that the same view is shown.
+func renderRecentRequests(w http.ResponseWriter, r *http.Request, undoableReqCodes, sentReminderReqCodes []string, c *Context) {
 	c.AssertLoggedIn()
-	rendReqs := getRecentPayRequestsOrDie(c.Session().UserId, false, sentReminderReqCodes, c)
-	data := map[string]interface{}{
-		"rendReqs":         rendReqs,
-		"undoableReqCodes": strings.Join(undoableReqCodes, ","),
-	}
-	RenderTemplateOrDie(w, "payments-data", data)
+	data := makePaymentsData(r, false, sentReminderReqCodes, c)
+	data["undoableReqCodes"] = strings.Join(undoableReqCodes, ",")
+	RenderTemplateOrDie(w, c, "payments-data", data)
 }
 
 func doMarkAsPaid(reqCodes []string, undo, checkUser bool, c *Context) ([]string, error) {
@@ -909,7 +1164,32 @@ func doMarkAsPaid(reqCodes []string, undo, checkUser bool, c *Context) ([]string
 		}
 		return true
 	}
-	return updatePayRequests(reqCodes, updateFn, checkUser, c)
+	// If checkUser is false, the payer marked the request as paid via the pay
+	// page.
+	actor := EAPayee
+	if !checkUser {
+		actor = EAPayer
+	}
+	eventFn := func(req *PayRequest) *PayRequestEvent {
+		if undo {
+			return &PayRequestEvent{Type: ETUnpaid, Actor: actor, Date: time.Now()}
+		}
+		return &PayRequestEvent{Type: ETPaid, Actor: actor, Date: time.Now(), Detail: "offline"}
+	}
+	updatedReqCodes, err := updatePayRequestsAndLog(reqCodes, updateFn, eventFn, checkUser, c)
+	if err != nil {
+		return updatedReqCodes, err
+	}
+	event := WEMarkedPaid
+	if undo {
+		event = WEMarkedUnpaid
+	} else if actor == EAPayee {
+		payments.Add(float64(len(updatedReqCodes)), "offline", "payee")
+	} else {
+		payments.Add(float64(len(updatedReqCodes)), "offline", "payer")
+	}
+	doEnqueueWebhookEvents(event, updatedReqCodes, c)
+	return updatedReqCodes, nil
 }
 
 func handleMarkAsPaid(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -923,7 +1203,7 @@ func handleMarkAsPaid(w http.ResponseWriter, r *http.Request, c *Context) {
 	undo := r.Form["undo"] != nil
 	undoableReqCodes, err := doMarkAsPaid(reqCodes, undo, true, c)
 	CheckError(err)
-	renderRecentRequests(w, undoableReqCodes, []string{}, c)
+	renderRecentRequests(w, r, undoableReqCodes, []string{}, c)
 }
 
 func handleSendReminder(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -936,7 +1216,34 @@ func handleSendReminder(w http.ResponseWriter, r *http.Request, c *Context) {
 	// TODO(sadovsky): Show error if user is not verified.
 	// TODO(sadovsky): Show error if user exceeds email rate limit.
 	CheckError(doEnqueuePayRequestEmails(reqCodes, c))
-	renderRecentRequests(w, []string{}, reqCodes, c)
+	renderRecentRequests(w, r, []string{}, reqCodes, c)
+}
+
+func doDelete(reqCodes []string, undo bool, c *Context) ([]string, error) {
+	updateFn := func(reqCode string, req *PayRequest) bool {
+		if undo {
+			req.DeletionDate = time.Unix(0, 0)
+		} else {
+			req.DeletionDate = time.Now()
+		}
+		return true
+	}
+	eventFn := func(req *PayRequest) *PayRequestEvent {
+		if undo {
+			return &PayRequestEvent{Type: ETRestored, Actor: EAPayee, Date: time.Now()}
+		}
+		return &PayRequestEvent{Type: ETDeleted, Actor: EAPayee, Date: time.Now()}
+	}
+	updatedReqCodes, err := updatePayRequestsAndLog(reqCodes, updateFn, eventFn, true, c)
+	if err != nil {
+		return updatedReqCodes, err
+	}
+	event := WEDeleted
+	if undo {
+		event = WERestored
+	}
+	doEnqueueWebhookEvents(event, updatedReqCodes, c)
+	return updatedReqCodes, nil
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -948,17 +1255,194 @@ func handleDelete(w http.ResponseWriter, r *http.Request, c *Context) {
 	c.AssertLoggedIn()
 	reqCodes := strings.Split(r.FormValue("reqCodes"), ",")
 	undo := r.Form["undo"] != nil
+	undoableReqCodes, err := doDelete(reqCodes, undo, c)
+	CheckError(err)
+	renderRecentRequests(w, r, undoableReqCodes, []string{}, c)
+}
+
+// Lets the payee correct the payer email of a request whose email bounced.
+// Sends the payment request email to the new address.
+func handleFixPayerEmail(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	c.AssertLoggedIn()
+	reqCodes := strings.Split(r.FormValue("reqCodes"), ",")
+	payerEmail := ParseEmail(r.FormValue("payerEmail"))
+	if IsSuppressedOrDie(payerEmail, c) {
+		http.Error(w, c.T("We cannot send email to %s.", payerEmail), http.StatusBadRequest)
+		return
+	}
 	updateFn := func(reqCode string, req *PayRequest) bool {
-		if undo {
-			req.DeletionDate = time.Unix(0, 0)
-		} else {
-			req.DeletionDate = time.Now()
+		if req.IsPaid {
+			return false
 		}
+		req.PayerEmail = payerEmail
+		req.BounceDate = time.Unix(0, 0)
+		// The payer never got the original email, so send it again as a new
+		// request rather than as a reminder.
+		req.ReminderSentDate = time.Unix(0, 0)
 		return true
 	}
-	undoableReqCodes, err := updatePayRequests(reqCodes, updateFn, true, c)
+	updatedReqCodes, err := updatePayRequests(reqCodes, updateFn, true, c)
 	CheckError(err)
-	renderRecentRequests(w, undoableReqCodes, []string{}, c)
+	if len(updatedReqCodes) > 0 {
+		CheckError(doEnqueuePayRequestEmails(updatedReqCodes, c))
+	}
+	renderRecentRequests(w, r, []string{}, updatedReqCodes, c)
+}
+
+// Lets recipients of payment request emails opt out of all further email from
+// Tadue. GET shows a confirmation page; POST unsubscribes. Mail clients that
+// support RFC 8058 POST directly (with "List-Unsubscribe=One-Click").
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request, c *Context) {
+	email, sig := r.FormValue("email"), r.FormValue("sig")
+	if !emailRegexp.MatchString(email) || !CheckSignature("unsubscribe:"+email, sig) {
+		RedirectWithMessage(w, r, "/", c.T("Invalid unsubscribe link."))
+		return
+	}
+	email = ParseEmail(email)
+	data := map[string]interface{}{
+		"email":        email,
+		"sig":          sig,
+		"unsubscribed": false,
+	}
+	if r.Method == "GET" {
+		data["unsubscribed"] = IsSuppressedOrDie(email, c)
+		RenderPageOrDie(w, c, "unsubscribe", data)
+		return
+	} else if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	CheckError(doSuppressEmail(email, SRUnsubscribe, "", c))
+	if r.FormValue("List-Unsubscribe") == "One-Click" {
+		return
+	}
+	data["unsubscribed"] = true
+	RenderPageOrDie(w, c, "unsubscribe", data)
+}
+
+// Shows a payer's reply to the payee, and lets the payee confirm the reply's
+// command (if any).
+func handleReply(w http.ResponseWriter, r *http.Request, c *Context) {
+	if steerThroughLogin(w, r, c) {
+		return
+	}
+	commentCode := r.FormValue("key")
+	commentKey, err := datastore.DecodeKey(commentCode)
+	CheckError(err)
+	Assert(commentKey.Kind() == "Comment", "Invalid key: ", commentCode)
+	comment := &Comment{}
+	CheckError(datastore.Get(c.Aec(), commentKey, comment))
+	reqCode := commentKey.Parent().Encode()
+	userId, reqId := ParseReqCode(reqCode)
+	req, err := store.GetPayRequest(userId, reqId, c)
+	CheckError(err)
+	if req.PayeeEmail != c.Session().Email {
+		Serve404(w)
+		return
+	}
+
+	if r.Method == "POST" {
+		if comment.ConfirmDate == time.Unix(0, 0) {
+			var msg string
+			switch comment.Command {
+			case RCPaid:
+				_, err = doMarkAsPaid([]string{reqCode}, false, true, c)
+				msg = c.T("Payment request marked as paid.")
+			case RCStop:
+				_, err = doStopReminders([]string{reqCode}, true, c)
+				msg = c.T("Reminders stopped.")
+			default:
+				// The reply has no command to confirm, so there is nothing to do.
+				return
+			}
+			CheckError(err)
+			comment.ConfirmDate = time.Now()
+			_, err = datastore.Put(c.Aec(), commentKey, comment)
+			CheckError(err)
+			RedirectWithMessage(w, r, "/payments", msg)
+			return
+		}
+		http.Redirect(w, r, "/payments", http.StatusSeeOther)
+		return
+	} else if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	data := map[string]interface{}{
+		"key":         commentCode,
+		"comment":     comment,
+		"date":        renderDate(comment.Timestamp, c.Location()),
+		"amount":      renderAmount(req.Amount),
+		"description": req.Description,
+		"saysPaid":    comment.Command == RCPaid,
+		"asksToStop":  comment.Command == RCStop,
+		"isPaid":      req.IsPaid,
+		"isStopped":   req.ReminderPolicy.Mode == RMOff,
+		"confirmed":   comment.ConfirmDate != time.Unix(0, 0),
+	}
+	RenderPageOrDie(w, c, "reply", data)
+}
+
+type RenderableWebhook struct {
+	Code         string // encoded Webhook key
+	Url          string
+	CreationDate string
+}
+
+type RenderableApiToken struct {
+	Id           string // token hash
+	Name         string
+	CreationDate string
+	LastUsedDate string // empty if never used
+}
+
+// If newApiToken is not empty, it is shown to the user, who must copy it then,
+// since we only store its hash.
+func renderSettings(w http.ResponseWriter, newApiToken string, c *Context) {
+	user := GetUserFromSessionOrDie(c)
+	hashes, tokens := GetApiTokensOrDie(c.Session().UserId, c)
+	rendTokens := make([]RenderableApiToken, len(tokens))
+	for i, token := range tokens {
+		rendTokens[i] = RenderableApiToken{
+			Id:           hashes[i],
+			Name:         token.Name,
+			CreationDate: renderDate(token.CreationDate, c.Location()),
+		}
+		if token.LastUsedDate.After(time.Unix(0, 0)) {
+			rendTokens[i].LastUsedDate = renderDate(token.LastUsedDate, c.Location())
+		}
+	}
+	webhookIds, webhooks := GetWebhooksOrDie(c.Session().UserId, c)
+	rendWebhooks := make([]RenderableWebhook, len(webhooks))
+	for i, webhook := range webhooks {
+		rendWebhooks[i] = RenderableWebhook{
+			Code:         ToWebhookKey(c.Aec(), c.Session().UserId, webhookIds[i]).Encode(),
+			Url:          webhook.Url,
+			CreationDate: renderDate(webhook.CreationDate, c.Location()),
+		}
+	}
+	data := map[string]interface{}{
+		"email":          user.Email,
+		"fullName":       user.FullName,
+		"payPalEmail":    user.PayPalEmail,
+		"reminderPolicy": makeReminderPolicyForm(user.ReminderPolicy, false),
+		"digest":         renderDigestFrequency(user.DigestFrequency),
+		"locale":         user.Locale,
+		"locales":        getLocaleOptions(),
+		"timeZone":       getLocation(user.TimeZone).String(),
+		"timeZones":      getTimeZoneOptions(user.TimeZone),
+		"apiTokens":      rendTokens,
+		"canAddApiToken": len(tokens) < kMaxApiTokens,
+		"newApiToken":    newApiToken,
+		"webhooks":       rendWebhooks,
+		"canAddWebhook":  len(webhooks) < kMaxWebhooks,
+	}
+	RenderPageOrDie(w, c, "settings", data)
 }
 
 func handleSettings(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -966,13 +1450,7 @@ func handleSettings(w http.ResponseWriter, r *http.Request, c *Context) {
 		return
 	}
 	if r.Method == "GET" {
-		user := GetUserFromSessionOrDie(c)
-		data := map[string]interface{}{
-			"email":       user.Email,
-			"fullName":    user.FullName,
-			"payPalEmail": user.PayPalEmail,
-		}
-		RenderPageOrDie(w, c, "settings", data)
+		renderSettings(w, "", c)
 		return
 	} else if r.Method != "POST" {
 		Serve404(w)
@@ -983,41 +1461,111 @@ func handleSettings(w http.ResponseWriter, r *http.Request, c *Context) {
 	// to verify the new email before actually making the change.
 	fullName := ParseFullName(r.FormValue("name"))
 	payPalEmail := ParseEmail(r.FormValue("paypal-email"))
-
-	err := datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
-		userKey := ToUserKey(c.Aec(), c.Session().UserId)
-		user := &User{}
-		if err := datastore.Get(aec, userKey, user); err != nil {
+	// Settings forms rendered before reminder policies existed don't have the
+	// reminder fields; for those, we keep the user's current policy.
+	keepReminderPolicy := r.FormValue("reminder-mode") == ""
+	reminderPolicy := ReminderPolicy{}
+	if !keepReminderPolicy {
+		var ok bool
+		reminderPolicy, ok = ParseReminderPolicy(
+			r.FormValue("reminder-mode"), r.FormValue("reminder-every-days"),
+			r.FormValue("reminder-offsets"), r.FormValue("reminder-max-count"))
+		Assert(ok, "Missing reminder policy")
+	}
+	digestFrequency := ParseDigestFrequency(r.FormValue("digest"))
+	locale := ParseLocale(r.FormValue("locale"))
+	timeZone := ParseTimeZone(r.FormValue("time-zone"))
+
+	err := store.RunInTransaction(func(tx Store) error {
+		user, err := tx.GetUser(c.Session().UserId, c)
+		if err != nil {
 			return err
 		}
-		if user.FullName == fullName && user.PayPalEmail == payPalEmail {
+		if keepReminderPolicy {
+			reminderPolicy = user.ReminderPolicy
+		}
+		if user.FullName == fullName && user.PayPalEmail == payPalEmail &&
+			reflect.DeepEqual(user.ReminderPolicy, reminderPolicy) &&
+			effectiveDigestFrequency(user.DigestFrequency) == digestFrequency &&
+			user.Locale == locale && user.TimeZone == timeZone {
 			// Nothing changed, so just return.
 			return nil
 		}
-		if user.FullName != fullName {
+		if user.FullName != fullName || user.Locale != locale || user.TimeZone != timeZone {
 			// Update Session record.
 			session := c.Session()
 			session.FullName = fullName // mutates c.Session()
+			session.Locale = locale
+			session.TimeZone = timeZone
 			CheckError(UpdateSession(session, w, c))
 		}
 		// Update User record.
 		user.FullName = fullName
 		user.PayPalEmail = payPalEmail
-		if _, err := datastore.Put(aec, userKey, user); err != nil {
-			return err
-		}
-		return nil
-	}, makeXG())
+		user.ReminderPolicy = reminderPolicy
+		user.DigestFrequency = digestFrequency
+		user.Locale = locale
+		user.TimeZone = timeZone
+		return tx.PutUser(c.Session().UserId, user, c)
+	}, c)
 
 	CheckError(err)
 	// http://en.wikipedia.org/wiki/Post/Redirect/Get
 	http.Redirect(w, r, "/settings", http.StatusSeeOther)
 }
 
+// Creates an API token and shows it on the settings page. Unlike most POST
+// handlers, does not redirect, since the token must not end up in a URL or
+// cookie.
+func handleCreateApiToken(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	c.AssertLoggedIn()
+	name := strings.TrimSpace(r.FormValue("name"))
+	Assert(name != "", "No name")
+	hashes, _ := GetApiTokensOrDie(c.Session().UserId, c)
+	Assert(len(hashes) < kMaxApiTokens, "Too many API tokens")
+
+	token, tokenHash := GenerateApiToken()
+	v := &ApiToken{
+		UserId:       c.Session().UserId,
+		Name:         name,
+		CreationDate: time.Now(),
+		LastUsedDate: time.Unix(0, 0),
+	}
+	CheckError(store.PutApiToken(tokenHash, v, c))
+	c.Log().Info("Created API token", "name", name)
+	renderSettings(w, token, c)
+}
+
+func handleDeleteApiToken(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	c.AssertLoggedIn()
+	tokenHash := r.FormValue("id")
+	err := store.RunInTransaction(func(tx Store) error {
+		token, err := tx.GetApiToken(tokenHash, c)
+		if err != nil {
+			return err
+		}
+		// Check that this token belongs to the current user; if not, abort.
+		if token.UserId != c.Session().UserId {
+			return errors.New(fmt.Sprintf("Unauthorized user: %d != %d", c.Session().UserId, token.UserId))
+		}
+		return tx.DeleteApiToken(tokenHash, c)
+	}, c)
+	CheckError(err)
+	RedirectWithMessage(w, r, "/settings", c.T("API token deleted."))
+}
+
 // Handles both changes and resets.
 func handleChangePassword(w http.ResponseWriter, r *http.Request, c *Context) {
-	encodedKey := r.FormValue("key")
-	isPasswordResetRequest := encodedKey != ""
+	token := r.FormValue("token")
+	isPasswordResetRequest := token != ""
 	if !isPasswordResetRequest {
 		if steerThroughLogin(w, r, c) {
 			return
@@ -1026,14 +1574,15 @@ func handleChangePassword(w http.ResponseWriter, r *http.Request, c *Context) {
 
 	if r.Method == "GET" {
 		if !isPasswordResetRequest {
-			RenderPageOrDie(w, c, "change-password", map[string]interface{}{"key": nil})
+			RenderPageOrDie(w, c, "change-password", map[string]interface{}{"token": nil})
 		} else { // password reset request
-			_, err := useResetPassword(encodedKey, c)
-			if err != nil {
+			if _, err := checkResetPasswordToken(token, c); err != nil {
+				_, ok := err.(*TokenError)
+				Assert(ok, err)
 				RedirectWithMessage(w, r, "/", err.Error())
 				return
 			}
-			RenderPageOrDie(w, c, "change-password", map[string]interface{}{"key": encodedKey})
+			RenderPageOrDie(w, c, "change-password", map[string]interface{}{"token": token})
 		}
 		return
 	} else if r.Method != "POST" {
@@ -1042,23 +1591,25 @@ func handleChangePassword(w http.ResponseWriter, r *http.Request, c *Context) {
 	}
 
 	var err error = nil
-	updateFn := func(user *User) bool {
-		salt := GenerateSecureRandomString()
-		user.SaltB = salt
-		user.PassHashB = SaltAndHash(salt, r.FormValue("new-password"))
-		return true
-	}
 	if !isPasswordResetRequest {
+		updateFn := func(user *User) bool {
+			salt := GenerateSecureRandomString()
+			user.SaltB = salt
+			user.PassHashB = SaltAndHash(salt, r.FormValue("new-password"))
+			return true
+		}
 		currentPassword := r.FormValue("current-password")
 		err = updateUser(c.Session().UserId, &currentPassword, updateFn, c)
 	} else { // password reset request
-		userId, err := useResetPassword(encodedKey, c)
-		CheckError(err)
-		err = updateUser(userId, nil, updateFn, c)
+		err = doResetPassword(token, r.FormValue("new-password"), c)
+		if _, ok := err.(*TokenError); ok {
+			RedirectWithMessage(w, r, "/", err.Error())
+			return
+		}
 	}
 	// TODO(sadovsky): Differentiate between user error and app error.
 	CheckError(err)
-	RedirectWithMessage(w, r, "/", "Password changed successfully.")
+	RedirectWithMessage(w, r, "/", c.T("Password changed successfully."))
 }
 
 func handleResetPassword(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -1071,19 +1622,19 @@ func handleResetPassword(w http.ResponseWriter, r *http.Request, c *Context) {
 	}
 	email := ParseEmail(r.FormValue("email"))
 	CheckError(doInitiateResetPassword(email, c))
-	RedirectWithMessage(w, r, "/", makeSentLinkMessage("Password reset", email))
+	RedirectWithMessage(w, r, "/", makeSentLinkMessage("Password reset", email, c))
 }
 
 func handleSendVerif(w http.ResponseWriter, r *http.Request, c *Context) {
 	c.AssertLoggedIn()
 	CheckError(doInitiateVerifyEmail(c))
-	RedirectWithMessage(w, r, "/", makeSentLinkMessage("Email verification", c.Session().Email))
+	RedirectWithMessage(w, r, "/", makeSentLinkMessage("Email verification", c.Session().Email, c))
 }
 
 func doRenderVerifMsg(email string, sentPayRequestEmails bool, w http.ResponseWriter, r *http.Request, c *Context) {
-	msg := fmt.Sprintf("Email address %s has been verified.", email)
+	msg := c.T("Email address %s has been verified.", email)
 	if sentPayRequestEmails {
-		msg += " All pending payment requests have been sent."
+		msg += " " + c.T("All pending payment requests have been sent.")
 	}
 	RedirectWithMessage(w, r, "/", msg)
 }
@@ -1097,12 +1648,12 @@ func handleDebugVerif(w http.ResponseWriter, r *http.Request, c *Context) {
 }
 
 func handleVerif(w http.ResponseWriter, r *http.Request, c *Context) {
-	encodedKey := r.FormValue("key")
-	Assert(encodedKey != "", "No key")
-	userId, err := useVerifyEmail(encodedKey, c)
-	if err != nil {
+	userId, err := useVerifyEmailToken(r.FormValue("token"), c)
+	if _, ok := err.(*TokenError); ok {
 		RedirectWithMessage(w, r, "/", err.Error())
+		return
 	}
+	CheckError(err)
 	email, sentPayRequestEmails, err := doSetEmailOk(userId, c)
 	CheckError(err)
 	doRenderVerifMsg(email, sentPayRequestEmails, w, r, c)
@@ -1115,6 +1666,7 @@ func handleSendPayRequestEmails(w http.ResponseWriter, r *http.Request, c *Conte
 	}
 	reqCodes := strings.Split(r.FormValue("reqCodes"), ",")
 	Assert(len(reqCodes) > 0, "No reqCodes")
+	isAutoReminder := r.FormValue("auto") == "true"
 
 	payeeUserKey := GetPayeeUserKey(reqCodes[0])
 	// Verify that all reqCodes have the same parent.
@@ -1122,82 +1674,225 @@ func handleSendPayRequestEmails(w http.ResponseWriter, r *http.Request, c *Conte
 		Assert(GetPayeeUserKey(reqCode).Equal(payeeUserKey))
 	}
 
-	payee := &User{}
-	// TODO(sadovsky): Add write-through memcached layer, at least for User.
-	CheckError(datastore.Get(c.Aec(), payeeUserKey, payee))
+	payee := GetUserOrDie(payeeUserKey, c)
 	if !payee.EmailOk {
 		// Payee's email has not been verified, so do not send any emails.
 		return
 	}
 
 	// Sends payment request email and updates ReminderSentDate in PayRequest.
+	now := time.Now()
+	var event *PayRequestEvent // for the request that updateFn last updated
 	updateFn := func(reqCode string, req *PayRequest) bool {
-		if req.IsPaid {
+		if req.IsPaid || isBounced(req) {
+			return false
+		} else if calendarDaysBetween(req.ReminderSentDate, now, requestLocation(req)) < kPayRequestEmailCooldown {
 			return false
-		} else if req.ReminderSentDate.After(time.Now().AddDate(0, 0, -kPayRequestEmailCooldown)) {
+		} else if isAutoReminder && !isReminderDue(req, now) {
+			// Check again, since the request may have changed since the reminder was
+			// enqueued.
+			return false
+		} else if IsSuppressedOrDie(req.PayerEmail, c) {
+			c.Log().Info("Not sending PayRequest email to suppressed address", "reqCode", reqCode, "payer", req.PayerEmail)
+			emailsSuppressed.Inc("pay_request")
 			return false
 		}
 
 		isReminder := req.ReminderSentDate != time.Unix(0, 0)
-		data := map[string]interface{}{
-			"payerEmail":    req.PayerEmail,
-			"payeeEmail":    payee.PayPalEmail,
-			"payeeFullName": payee.FullName,
-			"amount":        renderAmount(req.Amount),
-			"description":   req.Description,
-			"markAsPaidUrl": prependHost(makePayUrl(reqCode, "offline"), c),
-			"payUrl":        prependHost(makePayUrl(reqCode, ""), c),
-			"isReminder":    isReminder,
-			"creationDate":  renderDate(req.CreationDate),
-		}
-		body, err := ExecuteTextTemplate("email-pay-request.txt", data)
-		CheckError(err)
+		overdue := isOverdue(req, now)
+		dueDate := ""
+		if hasDueDate(req) {
+			dueDate = renderDueDate(req)
+		}
+		// Use the payer's time zone if we know it, and otherwise the payee's.
+		payerLoc := getLocation(payee.TimeZone)
+		if req.PayerTimeZone != "" {
+			payerLoc = getLocation(req.PayerTimeZone)
+		}
+		data := &PayRequestEmailData{
+			PayerEmail:            req.PayerEmail,
+			PayeeEmail:            payee.PayPalEmail,
+			PayeeFullName:         payee.FullName,
+			Amount:                renderAmount(req.Amount),
+			Description:           req.Description,
+			CreationDate:          renderDate(req.CreationDate, payerLoc),
+			DueDate:               dueDate,
+			IsReminder:            isReminder,
+			IsOverdue:             overdue,
+			PayUrl:                prependHost(makePayUrl(reqCode, ""), c),
+			PayWithPayPalUrl:      prependHost(makePayUrl(reqCode, "paypal"), c),
+			PayWithPayPalImageUrl: prependHost("/static/pay_with_paypal.gif", c),
+			MarkAsPaidUrl:         prependHost(makePayUrl(reqCode, "offline"), c),
+			UnsubscribeUrl:        prependHost(makeUnsubscribeUrl(req.PayerEmail), c),
+		}
 
-		var subject string
-		if isReminder {
-			subject = "Reminder of payment"
-		} else {
-			subject = "Payment"
+		subjectFormat := "Payment request from %s"
+		if overdue {
+			subjectFormat = "Overdue payment request from %s"
+		} else if isReminder {
+			subjectFormat = "Reminder of payment request from %s"
 		}
-		subject += fmt.Sprintf(" request from %s", template.HTMLEscapeString(payee.FullName))
+		subject := Translate(req.PayerLocale, subjectFormat, template.HTMLEscapeString(payee.FullName))
+		body, htmlBody, err := ExecuteEmailTemplates(req.PayerLocale, "email-pay-request", subject, data, c)
+		CheckError(err)
 
-		msg := &mail.Message{
-			Sender:  "Tadue <noreply@tadue.com>",
-			To:      []string{req.PayerEmail},
-			Cc:      []string{req.PayeeEmail},
-			Subject: subject,
-			Body:    body,
+		reqKey, err := datastore.DecodeKey(reqCode)
+		CheckError(err)
+		msg := &Email{
+			ReplyTo:  makeReplyToAddress(reqKey, c),
+			To:       []string{req.PayerEmail},
+			Cc:       []string{req.PayeeEmail},
+			Subject:  subject,
+			Body:     body,
+			HTMLBody: htmlBody,
+			// See RFC 2369 and RFC 8058. Note, App Engine does not allow the
+			// List-Unsubscribe-Post header, so AppEngineMailer drops it.
+			Headers: map[string]string{
+				"List-Unsubscribe":      "<" + data.UnsubscribeUrl + ">",
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			},
 		}
-		CheckError(mail.Send(c.Aec(), msg))
-		c.Aec().Infof("Sent PayRequest email: payee=%q, payer=%q, amount=%q",
-			req.PayeeEmail, req.PayerEmail, renderAmount(req.Amount))
+		CheckError(SendEmail(msg, c))
+		c.Log().Info("Sent PayRequest email", "reqCode", reqCode, "payee", req.PayeeEmail,
+			"payer", req.PayerEmail, "amount", renderAmount(req.Amount), "reminder", isReminder)
+		emailsSent.Inc("pay_request")
 
 		req.ReminderSentDate = time.Now()
+		if isAutoReminder {
+			recordAutoReminder(req, req.ReminderSentDate)
+		}
+		event = &PayRequestEvent{Type: ETEmailed, Actor: EAPayee, Date: req.ReminderSentDate, Detail: req.PayerEmail}
+		if isReminder {
+			event.Type = ETReminded
+		}
+		if isAutoReminder {
+			event.Actor = EASystem
+		}
 		return true
 	}
+	eventFn := func(req *PayRequest) *PayRequestEvent {
+		return event
+	}
 
 	// Process each reqCode separately to avoid sending extra emails on failure.
+	sentReqCodes := []string{}
 	for _, reqCode := range reqCodes {
-		_, err := updatePayRequests([]string{reqCode}, updateFn, false, c)
+		updatedReqCodes, err := updatePayRequestsAndLog([]string{reqCode}, updateFn, eventFn, false, c)
 		CheckError(err)
+		sentReqCodes = append(sentReqCodes, updatedReqCodes...)
 	}
+	doEnqueueWebhookEvents(WEEmailed, sentReqCodes, c)
 }
 
 func handleEnqueueReminderEmails(w http.ResponseWriter, r *http.Request, c *Context) {
-	q := makePayRequestQuery(nil, false).
-		Filter("ReminderSentDate <", time.Now().AddDate(0, 0, -kAutoPayRequestEmailFrequency)).
-		KeysOnly()
+	now := time.Now()
+
+	// Requests emailed within the cooldown are never due, so the query skips
+	// them, and isReminderDue applies each request's policy. The bound is an
+	// hour late, since the emails sent by the last run went out a little after
+	// it started.
+	remindedBefore := now.AddDate(0, 0, -kPayRequestEmailCooldown).Add(time.Hour)
 	count := 0
-	for it := q.Run(c.Aec()); ; {
-		reqKey, err := it.Next(nil)
-		if err == datastore.Done {
-			break
+	err := store.ForEachPayRequestRemindedBefore(remindedBefore, func(userId, reqId int64, req *PayRequest) error {
+		reqCode := MakeReqCode(userId, reqId, c)
+		if !checkPayRequestOrLog(reqCode, func() bool { return isReminderDue(req, now) }, c) {
+			return nil
+		}
+		count++
+		return doEnqueueAutoReminderEmail(reqCode, c)
+	}, c)
+	CheckError(err)
+	c.Log().Info("Enqueued reminder emails", "count", count)
+
+	// Tell payees about requests that have become overdue.
+	count = 0
+	err = store.ForEachUnreportedOverduePayRequest(now, func(userId, reqId int64, req *PayRequest) error {
+		reqCode := MakeReqCode(userId, reqId, c)
+		if !checkPayRequestOrLog(reqCode, func() bool { return isOverdue(req, now) }, c) {
+			return nil
+		}
+		count++
+		return doEnqueueOverdueEmail(reqCode, c)
+	}, c)
+	CheckError(err)
+	c.Log().Info("Enqueued overdue emails", "count", count)
+}
+
+// Returns the result of check, or false if it panics, e.g. because the request
+// has a malformed stored value. Keeps one bad request from failing a whole
+// cron run.
+func checkPayRequestOrLog(reqCode string, check func() bool, c *Context) (res bool) {
+	defer func() {
+		if data := recover(); data != nil {
+			c.Log().Error("Skipping malformed PayRequest", "reqCode", reqCode, "error", fmt.Sprint(data))
+			res = false
+		}
+	}()
+	return check()
+}
+
+func handleEnqueueDigestEmails(w http.ResponseWriter, r *http.Request, c *Context) {
+	now := time.Now()
+	count := 0
+	err := store.ForEachVerifiedUser(func(userId int64, user *User) error {
+		if !isDigestDue(user, now) {
+			return nil
 		}
-		CheckError(err)
-		CheckError(doEnqueuePayRequestEmails([]string{reqKey.Encode()}, c))
 		count++
+		return doEnqueueDigestEmail(userId, c)
+	}, c)
+	CheckError(err)
+	c.Log().Info("Enqueued digest emails", "count", count)
+}
+
+// Sends a summary of unpaid, overdue, and recently paid requests to the given
+// user. Users who are not owed any money are skipped.
+func handleSendDigestEmail(w http.ResponseWriter, r *http.Request, c *Context) {
+	userId, err := strconv.ParseInt(r.FormValue("userId"), 10, 64)
+	CheckError(err)
+	user := GetUserFromUserIdOrDie(userId, c)
+	now := time.Now()
+	// Check again, since the user may have changed since the email was enqueued.
+	if !isDigestDue(user, now) {
+		return
+	}
+
+	_, unpaid, err := store.GetPayRequestsByStatus(userId, false, 0, c)
+	CheckError(err)
+	since := digestPeriodStart(user.DigestFrequency, now)
+	if user.DigestSentDate.After(since) {
+		since = user.DigestSentDate
 	}
-	c.Aec().Infof("Enqueued %d reminder emails", count)
+	_, paid, err := store.GetPayRequestsPaidSince(userId, since, c)
+	CheckError(err)
+
+	if data := makeDigestEmailData(user, unpaid, paid, now, c); data == nil {
+		c.Log().Info("Not sending digest email: nothing outstanding", "payee", user.Email)
+	} else {
+		subjectFormat := "Your weekly Tadue summary: %s outstanding"
+		if effectiveDigestFrequency(user.DigestFrequency) == DFMonthly {
+			subjectFormat = "Your monthly Tadue summary: %s outstanding"
+		}
+		subject := Translate(user.Locale, subjectFormat, data.TotalOwed)
+		body, htmlBody, err := ExecuteEmailTemplates(user.Locale, "email-digest", subject, data, c)
+		CheckError(err)
+		msg := &Email{
+			To:       []string{user.Email},
+			Subject:  subject,
+			Body:     body,
+			HTMLBody: htmlBody,
+		}
+		CheckError(SendEmail(msg, c))
+		c.Log().Info("Sent digest email", "payee", user.Email, "owed", data.TotalOwed)
+		emailsSent.Inc("digest")
+	}
+
+	// Update DigestSentDate even if we skipped this user, so that the next
+	// summary is sent one period from now.
+	CheckError(updateUser(userId, nil, func(user *User) bool {
+		user.DigestSentDate = now
+		return true
+	}, c))
 }
 
 func handleSendPaymentDoneEmail(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -1205,51 +1900,189 @@ func handleSendPaymentDoneEmail(w http.ResponseWriter, r *http.Request, c *Conte
 	Assert(reqCode != "", "No reqCode")
 	Assert(method == "offline" || method == "paypal", fmt.Sprintf("Invalid method: %q", method))
 
-	reqKey, err := datastore.DecodeKey(reqCode)
-	CheckError(err)
-	payeeUserKey := reqKey.Parent()
+	userId, reqId := ParseReqCode(reqCode)
 
 	// TODO(sadovsky): Parallelize lookups using goroutines.
-	req := &PayRequest{}
-	CheckError(datastore.Get(c.Aec(), reqKey, req))
-	payee := &User{}
-	CheckError(datastore.Get(c.Aec(), payeeUserKey, payee))
+	req, err := store.GetPayRequest(userId, reqId, c)
+	CheckError(err)
+	payee := GetUserFromUserIdOrDie(userId, c)
 
-	templateName := "email-got-paid.txt"
-	subject := fmt.Sprintf("You've been paid by %s", req.PayerEmail)
+	templateName := "email-got-paid"
+	subjectFormat := "You've been paid by %s"
 	if method == "offline" {
-		templateName = "email-marked-as-paid.txt"
-		subject = fmt.Sprintf("Your payment request was marked as paid by %s", req.PayerEmail)
+		templateName = "email-marked-as-paid"
+		subjectFormat = "Your payment request was marked as paid by %s"
 	}
+	subject := Translate(payee.Locale, subjectFormat, req.PayerEmail)
 
-	data := map[string]interface{}{
-		"payeeFullName": payee.FullName,
-		"payerEmail":    req.PayerEmail,
-		"amount":        renderAmount(req.Amount),
-		"description":   req.Description,
-		"paymentsUrl":   prependHost("/payments", c),
+	data := &PayeeNoticeEmailData{
+		PayeeFullName: payee.FullName,
+		PayerEmail:    req.PayerEmail,
+		Amount:        renderAmount(req.Amount),
+		Description:   req.Description,
+		PaymentsUrl:   prependHost("/payments", c),
+	}
+	if hasDueDate(req) {
+		data.DueDate = renderDueDate(req)
 	}
-	body, err := ExecuteTextTemplate(templateName, data)
+	body, htmlBody, err := ExecuteEmailTemplates(payee.Locale, templateName, subject, data, c)
 	CheckError(err)
 
-	msg := &mail.Message{
-		Sender:  "Tadue <noreply@tadue.com>",
-		To:      []string{req.PayeeEmail},
-		Subject: subject,
-		Body:    body,
+	msg := &Email{
+		To:       []string{req.PayeeEmail},
+		Subject:  subject,
+		Body:     body,
+		HTMLBody: htmlBody,
 	}
-	CheckError(mail.Send(c.Aec(), msg))
-	c.Aec().Infof("Sent %s email: payee=%q, payer=%q, amount=%q",
-		tmpl, req.PayeeEmail, req.PayerEmail, renderAmount(req.Amount))
+	CheckError(SendEmail(msg, c))
+	c.Log().Info("Sent payment done email", "template", templateName, "reqCode", reqCode,
+		"payee", req.PayeeEmail, "payer", req.PayerEmail, "amount", renderAmount(req.Amount))
+	emailsSent.Inc("payment_done")
+}
+
+func handleSendOverdueEmail(w http.ResponseWriter, r *http.Request, c *Context) {
+	reqCode := r.FormValue("reqCode")
+	Assert(reqCode != "", "No reqCode")
+
+	payee := GetUserOrDie(GetPayeeUserKey(reqCode), c)
+	if !payee.EmailOk {
+		// Payee's email has not been verified, so do not send any emails.
+		return
+	}
+
+	// Sends overdue email and updates OverdueSentDate in PayRequest.
+	now := time.Now()
+	updateFn := func(reqCode string, req *PayRequest) bool {
+		if !isOverdue(req, now) || req.OverdueSentDate != time.Unix(0, 0) {
+			return false
+		}
+
+		data := &PayeeNoticeEmailData{
+			PayeeFullName: payee.FullName,
+			PayerEmail:    req.PayerEmail,
+			Amount:        renderAmount(req.Amount),
+			Description:   req.Description,
+			DueDate:       renderDueDate(req),
+			PaymentsUrl:   prependHost("/payments", c),
+		}
+		subject := Translate(payee.Locale, "Your payment request to %s is overdue", req.PayerEmail)
+		body, htmlBody, err := ExecuteEmailTemplates(payee.Locale, "email-overdue", subject, data, c)
+		CheckError(err)
+
+		msg := &Email{
+			To:       []string{req.PayeeEmail},
+			Subject:  subject,
+			Body:     body,
+			HTMLBody: htmlBody,
+		}
+		CheckError(SendEmail(msg, c))
+		c.Log().Info("Sent overdue email", "reqCode", reqCode, "payee", req.PayeeEmail,
+			"payer", req.PayerEmail, "amount", renderAmount(req.Amount))
+		emailsSent.Inc("overdue")
+
+		req.OverdueSentDate = now
+		return true
+	}
+	_, err := updatePayRequests([]string{reqCode}, updateFn, false, c)
+	CheckError(err)
+}
+
+func handleSendReplyEmail(w http.ResponseWriter, r *http.Request, c *Context) {
+	commentCode := r.FormValue("commentCode")
+	Assert(commentCode != "", "No commentCode")
+	commentKey, err := datastore.DecodeKey(commentCode)
+	CheckError(err)
+
+	comment := &Comment{}
+	CheckError(datastore.Get(c.Aec(), commentKey, comment))
+	userId, reqId := ParseReqCode(commentKey.Parent().Encode())
+	req, err := store.GetPayRequest(userId, reqId, c)
+	CheckError(err)
+	payee := GetUserFromUserIdOrDie(userId, c)
+	if !payee.EmailOk {
+		// Payee's email has not been verified, so do not send any emails.
+		return
+	}
+
+	data := &PayerReplyEmailData{
+		PayeeFullName: payee.FullName,
+		Author:        comment.Author,
+		Body:          comment.Body,
+		Amount:        renderAmount(req.Amount),
+		Description:   req.Description,
+		SaysPaid:      comment.Command == RCPaid && !req.IsPaid,
+		AsksToStop:    comment.Command == RCStop && req.ReminderPolicy.Mode != RMOff,
+		ReplyUrl:      prependHost("/payments/reply?key="+commentCode, c),
+	}
+	if hasDueDate(req) {
+		data.DueDate = renderDueDate(req)
+	}
+	subject := Translate(payee.Locale, "%s replied to your payment request", comment.Author)
+	body, htmlBody, err := ExecuteEmailTemplates(payee.Locale, "email-payer-reply", subject, data, c)
+	CheckError(err)
+
+	msg := &Email{
+		ReplyTo:  comment.Author,
+		To:       []string{req.PayeeEmail},
+		Subject:  subject,
+		Body:     body,
+		HTMLBody: htmlBody,
+	}
+	CheckError(SendEmail(msg, c))
+	c.Log().Info("Sent reply email", "payee", req.PayeeEmail, "author", comment.Author)
+	emailsSent.Inc("reply")
+}
+
+// Handles bounce notifications for email sent via the App Engine Mail API.
+// See https://developers.google.com/appengine/docs/go/mail/bounce
+func handleBounce(w http.ResponseWriter, r *http.Request, c *Context) {
+	rawMessage := r.FormValue("raw-message")
+	report, err := ParseDeliveryReport(strings.NewReader(rawMessage))
+	if err != nil {
+		c.Log().Warning("Failed to parse bounce notification", "error", err)
+		return
+	}
+	CheckError(doProcessDeliveryReport(report, c))
+}
+
+// Handles email sent to <anything>@<app-id>.appspotmail.com. Replies to
+// payment request emails, delivery status notifications (e.g. sent by SMTP
+// servers), and abuse feedback reports are processed; all other messages are
+// ignored.
+func handleInboundMail(w http.ResponseWriter, r *http.Request, c *Context) {
+	to := strings.TrimPrefix(r.URL.Path, "/_ah/mail/")
+	if strings.HasPrefix(strings.ToLower(to), "reply-") {
+		if err := doProcessReply(to, r.Body, c); err != nil {
+			c.Log().Warning("Failed to process reply", "to", to, "error", err)
+		}
+		return
+	}
+	report, err := ParseDeliveryReport(r.Body)
+	if err == errNotDeliveryReport {
+		c.Log().Info("Ignoring inbound email", "to", to)
+		return
+	} else if err != nil {
+		c.Log().Warning("Failed to parse inbound email", "to", to, "error", err)
+		return
+	}
+	CheckError(doProcessDeliveryReport(report, c))
 }
 
 var types = map[string]interface{}{
-	"OAuthToken":    OAuthToken{},
-	"PayRequest":    PayRequest{},
-	"ResetPassword": ResetPassword{},
-	"VerifyEmail":   VerifyEmail{},
-	"User":          User{},
-	"UserId":        UserId{},
+	"AdminAuditEntry": AdminAuditEntry{},
+	"ApiToken":        ApiToken{},
+	"Comment":         Comment{},
+	"JanitorState":    JanitorState{},
+	"OAuthToken":      OAuthToken{},
+	"Migration":       Migration{},
+	"PayRequest":      PayRequest{},
+	"PayRequestEvent": PayRequestEvent{},
+	"Suppression":     Suppression{},
+	"User":            User{},
+	"UserId":          UserId{},
+	"UserToken":       UserToken{},
+	"Webhook":         Webhook{},
+	"WebhookDelivery": WebhookDelivery{},
 }
 
 func makeNew(typeName string) interface{} {
@@ -1258,64 +2091,37 @@ func makeNew(typeName string) interface{} {
 	return reflect.New(reflect.ValueOf(val).Type()).Interface()
 }
 
-// Uses reflection to print records from datastore.
-// Reference: http://golang.org/doc/articles/laws_of_reflection.html
-func handleDump(w http.ResponseWriter, r *http.Request, c *Context) {
-	typeName := r.FormValue("t")
-	unpaid := r.Form["unpaid"] != nil
-
-	renderValue := func(v interface{}) string {
-		// If v is a time.Time and it's not the Unix epoch, render it in Pacific
-		// time.
-		if t, ok := v.(time.Time); ok {
-			loc, err := time.LoadLocation("America/Los_Angeles")
-			CheckError(err)
-			if t.Equal(time.Unix(0, 0)) {
-				loc = time.UTC
-			}
-			return fmt.Sprint(t.In(loc))
-		}
-		// If v is a byte slice, render it in hex.
-		if b, ok := v.([]byte); ok {
-			return fmt.Sprintf("%x", b)
+// Lists emails captured by MemoryMailer, newest first. With "format=json",
+// returns them as a JSON list (oldest first) for use in scripts and tests.
+func handleOutbox(w http.ResponseWriter, r *http.Request, c *Context) {
+	m, enabled := mailer.(*MemoryMailer)
+	if r.Method == "POST" {
+		Assert(enabled, "Outbox capture is disabled")
+		if r.FormValue("clear") == "true" {
+			m.Clear()
 		}
-		res := fmt.Sprintf("%+q", fmt.Sprint(v))
-		return res[1 : len(res)-1] // strip quotes
-	}
-
-	// Make header row.
-	headers := []string{"Key", "EncodedKey"}
-	s := reflect.ValueOf(makeNew(typeName)).Elem()
-	t := s.Type()
-	for i := 0; i < s.NumField(); i++ {
-		headers = append(headers, t.Field(i).Name)
+		http.Redirect(w, r, "/dev/outbox", http.StatusSeeOther)
+		return
 	}
-
-	// Make data rows.
-	rows := [][]string{}
-	q := datastore.NewQuery(typeName)
-	if unpaid && typeName == "PayRequest" {
-		q = q.Filter("DeletionDate =", time.Unix(0, 0)).Filter("IsPaid =", false)
+	emails := []*SentEmail{}
+	if enabled {
+		emails = m.Outbox()
 	}
-	for it := q.Run(c.Aec()); ; {
-		val := makeNew(typeName)
-		key, err := it.Next(val)
-		if err == datastore.Done {
-			break
-		}
+	if r.FormValue("format") == "json" {
+		b, err := json.Marshal(emails)
 		CheckError(err)
-		s := reflect.ValueOf(val).Elem()
-		row := []string{renderValue(key.String()), renderValue(key.Encode())}
-		for i := 0; i < s.NumField(); i++ {
-			row = append(row, renderValue(s.Field(i).Interface()))
-		}
-		rows = append(rows, row)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+	for i, j := 0, len(emails)-1; i < j; i, j = i+1, j-1 {
+		emails[i], emails[j] = emails[j], emails[i]
 	}
 	data := map[string]interface{}{
-		"headers": headers,
-		"rows":    rows,
+		"enabled": enabled,
+		"emails":  emails,
 	}
-	RenderTemplateOrDie(w, "dump.html", data)
+	RenderTemplateOrDie(w, c, "outbox.html", data)
 }
 
 func handleWipe(w http.ResponseWriter, r *http.Request, c *Context) {
@@ -1324,6 +2130,7 @@ func handleWipe(w http.ResponseWriter, r *http.Request, c *Context) {
 		keys, err := q.GetAll(c.Aec(), nil)
 		CheckError(err)
 		CheckError(datastore.DeleteMulti(c.Aec(), keys))
+		cacheDelete(c, keys...)
 	}
 	c.DeleteSession()
 	RedirectWithMessage(w, r, "/", "Datastore has been wiped.")
@@ -1334,6 +2141,12 @@ func init() {
 	http.Handle("/ipn", WrapHandlerNoParseForm(handleIpn))
 	// Account.
 	http.Handle("/settings", WrapHandler(handleSettings))
+	http.Handle("/settings/api-tokens", WrapHandler(handleCreateApiToken))
+	http.Handle("/settings/api-tokens/delete", WrapHandler(handleDeleteApiToken))
+	http.Handle("/settings/webhooks", WrapHandler(handleCreateWebhook))
+	http.Handle("/settings/webhooks/delete", WrapHandler(handleDeleteWebhook))
+	http.Handle("/settings/webhooks/log", WrapHandler(handleWebhookLog))
+	http.Handle("/settings/webhooks/redeliver", WrapHandler(handleRedeliverWebhook))
 	http.Handle("/account/change-password", WrapHandler(handleChangePassword))
 	http.Handle("/account/reset-password", WrapHandler(handleResetPassword))
 	http.Handle("/account/sendverif", WrapHandler(handleSendVerif))
@@ -1343,6 +2156,11 @@ func init() {
 	http.Handle("/payments/mark-as-paid", WrapHandler(handleMarkAsPaid))
 	http.Handle("/payments/send-reminder", WrapHandler(handleSendReminder))
 	http.Handle("/payments/delete", WrapHandler(handleDelete))
+	http.Handle("/payments/fix-payer-email", WrapHandler(handleFixPayerEmail))
+	http.Handle("/payments/reply", WrapHandler(handleReply))
+	http.Handle("/payments/request", WrapHandler(handlePayRequestDetail))
+	http.Handle("/payments/export", WrapHandler(handleExportPayments))
+	http.Handle("/payments/import", WrapHandler(handleImportPayments))
 	// Request payment.
 	http.Handle("/request-payment", WrapHandler(handleRequestPayment))
 	http.Handle("/oauth2callback", WrapHandler(handleOAuthCallback))
@@ -1351,6 +2169,7 @@ func init() {
 	// Pay.
 	http.Handle("/pay", WrapHandler(handlePay))
 	http.Handle("/pay/done", WrapHandler(handlePayDone))
+	http.Handle("/unsubscribe", WrapHandler(handleUnsubscribe))
 	// Login, logout, signup.
 	http.Handle("/login", WrapHandler(handleLogin))
 	http.Handle("/logout", WrapHandler(handleLogout))
@@ -1359,15 +2178,35 @@ func init() {
 	http.Handle("/tasks/send-pay-request-emails", WrapHandler(handleSendPayRequestEmails))
 	http.Handle("/tasks/enqueue-reminder-emails", WrapHandler(handleEnqueueReminderEmails))
 	http.Handle("/tasks/send-payment-done-email", WrapHandler(handleSendPaymentDoneEmail))
+	http.Handle("/tasks/send-overdue-email", WrapHandler(handleSendOverdueEmail))
+	http.Handle("/tasks/send-reply-email", WrapHandler(handleSendReplyEmail))
+	http.Handle("/tasks/enqueue-digest-emails", WrapHandler(handleEnqueueDigestEmails))
+	http.Handle("/tasks/send-digest-email", WrapHandler(handleSendDigestEmail))
+	http.Handle("/tasks/fan-out-webhook-events", WrapHandler(handleFanOutWebhookEvents))
+	http.Handle("/tasks/deliver-webhook", WrapHandler(handleDeliverWebhook))
+	http.Handle("/tasks/run-migration", WrapHandler(handleRunMigration))
+	http.Handle("/tasks/run-janitor", WrapHandler(handleRunJanitor))
 	// Bottom links.
+	http.Handle("/api/v1/", WrapApiHandler(handleApi))
+
 	http.Handle("/about", WrapHandler(handleAbout))
 	http.Handle("/privacy", WrapHandler(handlePrivacy))
 	http.Handle("/terms", WrapHandler(handleTerms))
 	http.Handle("/help", WrapHandler(handleHelp))
 	// Admin links.
-	http.Handle("/admin/dump", WrapHandler(handleDump))
+	http.Handle("/_ah/bounce", WrapHandlerNoParseForm(handleBounce))
+	http.Handle("/_ah/mail/", WrapHandlerNoParseForm(handleInboundMail))
+
+	http.Handle("/admin/", WrapHandler(handleAdmin))
+	http.Handle("/admin/list", WrapHandler(handleAdminList))
+	http.Handle("/admin/entity", WrapHandler(handleAdminEntity))
+	http.Handle("/admin/delete", WrapHandler(handleAdminDelete))
+	http.Handle("/admin/export", WrapHandler(handleAdminExport))
+	http.Handle("/admin/migrations", WrapHandler(handleMigrations))
+	http.Handle("/admin/dashboard", WrapHandler(handleAdminDashboard))
+	http.Handle("/admin/metrics", WrapHandler(handleAdminMetrics))
 	// Development links.
 	http.Handle("/dev/dv", WrapHandler(handleDebugVerif))
+	http.Handle("/dev/outbox", WrapHandler(handleOutbox))
 	//http.Handle("/dev/wipe", WrapHandler(handleWipe))
-	//http.Handle("/dev/fix", WrapHandler(handleFix))
 }
@@ -0,0 +1,239 @@
+// Operational metrics: counters and histograms, exposed in the Prometheus text
+// format at /admin/metrics. Like the cache stats (see cache.go), metrics are
+// kept in memory, so each instance reports its own counts since it started.
+
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	httpRequests = NewCounter("tadue_http_requests_total",
+		"HTTP requests, by handler and status code.", "handler", "code")
+	httpRequestDuration = NewHistogram("tadue_http_request_duration_seconds",
+		"HTTP request latency, by handler.", latencyBuckets, "handler")
+	panicsRecovered = NewCounter("tadue_panics_recovered_total",
+		"Panics recovered by the handler wrappers, by handler.", "handler")
+	payRequestsCreated = NewCounter("tadue_pay_requests_created_total",
+		"Payment requests created, by handler.", "handler")
+	payments = NewCounter("tadue_payments_total",
+		"Payment requests marked as paid, by method (paypal or offline) and actor (payer or payee).",
+		"method", "actor")
+	emailsSent = NewCounter("tadue_emails_sent_total",
+		"Emails sent by the email tasks, by kind.", "kind")
+	emailsSuppressed = NewCounter("tadue_emails_suppressed_total",
+		"Emails not sent by the email tasks because the recipient is suppressed, by kind.", "kind")
+	emailSendErrors = NewCounter("tadue_email_send_errors_total",
+		"Emails that the mailer failed to send.")
+	paypalCalls = NewCounter("tadue_paypal_calls_total",
+		"Calls to PayPal, by call and result.", "call", "result")
+	paypalCallDuration = NewHistogram("tadue_paypal_call_duration_seconds",
+		"PayPal call latency, by call.", latencyBuckets, "call")
+)
+
+// Records the latency and result of a PayPal call that started at start.
+// Takes a pointer so that it can be deferred before the result is known.
+func recordPayPalCall(call string, start time.Time, result *string) {
+	paypalCalls.Inc(call, *result)
+	paypalCallDuration.Observe(time.Since(start).Seconds(), call)
+}
+
+////////////////////////////////////////
+// Registry
+
+type metric interface {
+	writePrometheus(w io.Writer)
+}
+
+// All metrics, in the order they were created.
+var metricsRegistry []metric
+
+// Writes all metrics in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer) {
+	for _, m := range metricsRegistry {
+		m.writePrometheus(w)
+	}
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// Returns the map key for the series with the given label values.
+func (d *metricDesc) seriesKey(labelValues []string) string {
+	Assert(len(labelValues) == len(d.labels), fmt.Sprintf(
+		"%s: got %d label values, want %d", d.name, len(labelValues), len(d.labels)))
+	return strings.Join(labelValues, "\x00")
+}
+
+func (d *metricDesc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Renders labels as {a="x",b="y"}, or "" if there are none. extra holds
+// additional name-value pairs, e.g. a histogram bucket's "le" label.
+func (d *metricDesc) formatLabels(labelValues []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range d.labels {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(labelValues[i])+`"`)
+	}
+	for i := 0; i < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+////////////////////////////////////////
+// Counter
+
+type Counter struct {
+	metricDesc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Creates and registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	m := &Counter{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		series:     map[string]*counterSeries{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func (m *Counter) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *Counter) Add(v float64, labelValues ...string) {
+	Assert(v >= 0, m.name, ": counters cannot decrease")
+	key := m.seriesKey(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		m.series[key] = s
+	}
+	s.value += v
+}
+
+func (m *Counter) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeHeader(w, "counter")
+	keys := []string{}
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(s.labelValues), formatMetricValue(s.value))
+	}
+}
+
+////////////////////////////////////////
+// Histogram
+
+type Histogram struct {
+	metricDesc
+	buckets []float64 // upper bounds, in increasing order
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative; the last is for +Inf
+	sum         float64
+}
+
+// Creates and registers a histogram with the given bucket upper bounds and
+// label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	Assert(sort.Float64sAreSorted(buckets), name, ": buckets are not sorted")
+	m := &Histogram{
+		metricDesc: metricDesc{name: name, help: help, labels: labels},
+		buckets:    buckets,
+		series:     map[string]*histogramSeries{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func (m *Histogram) Observe(v float64, labelValues ...string) {
+	key := m.seriesKey(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets)+1)}
+		m.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(m.buckets, v)]++
+	s.sum += v
+}
+
+func (m *Histogram) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeHeader(w, "histogram")
+	keys := []string{}
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		var count uint64
+		for i, n := range s.counts {
+			count += n
+			le := "+Inf"
+			if i < len(m.buckets) {
+				le = formatMetricValue(m.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, "le", le), count)
+		}
+		labels := m.formatLabels(s.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, count)
+	}
+}
+
+////////////////////////////////////////
+// Handlers
+
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request, c *Context) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
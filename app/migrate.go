@@ -0,0 +1,488 @@
+// Versioned data migrations. Each migration visits every entity of one kind,
+// in batches of kMigrationBatchSize, with one task per batch (on the
+// "migrations" queue) and one transaction per entity. The state of the latest
+// run of each migration is recorded in a Migration entity, which also holds the
+// cursor for the next batch, so that runs survive task retries and can be
+// resumed after failures. Runs are started from /admin/migrations.
+//
+// Migrations must be idempotent: a failed batch is retried from its start, and
+// applied migrations may be re-applied (e.g. after restoring a backup). They
+// must also not write anything when dryRun is true. Migrations are applied in
+// version order; never change or remove a registered migration, and never
+// reuse a version or name.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+type migration struct {
+	Version     int
+	Name        string // key name of Migration entity
+	Kind        string // kind of entities to visit
+	Description string
+	// Called once per entity. Unless dryRun is true, it is called in a (XG)
+	// transaction, using aec. Returns true if it changed the entity (or, if
+	// dryRun is true, would have).
+	Apply func(aec appengine.Context, key *datastore.Key, dryRun bool) (bool, error)
+}
+
+// Returns an Apply function that reads the entity, calls updateFn to update
+// it, and writes it back if updateFn returns true.
+func updateEach(makeFn func() interface{}, updateFn func(value interface{}) bool) func(appengine.Context, *datastore.Key, bool) (bool, error) {
+	return func(aec appengine.Context, key *datastore.Key, dryRun bool) (bool, error) {
+		value := makeFn()
+		if err := datastore.Get(aec, key, value); err != nil {
+			return false, err
+		}
+		if !updateFn(value) {
+			return false, nil
+		}
+		if !dryRun {
+			if _, err := datastore.Put(aec, key, value); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// Sets *email to its canonical form, and returns true if that changed it.
+func normalizeEmail(email *string) bool {
+	if *email == "" {
+		return false
+	}
+	old := *email
+	*email = ParseEmail(old)
+	return *email != old
+}
+
+// Versions 1 through 6 were run by hand (via the old /dev/fix handler) before
+// this framework existed. They are registered here so that new deployments get
+// the same data, and so that they are recorded as applied.
+var migrations = []*migration{
+	{
+		Version:     1,
+		Name:        "normalize-pay-request-emails",
+		Kind:        "PayRequest",
+		Description: "Normalizes payee and payer emails.",
+		Apply: updateEach(func() interface{} { return &PayRequest{} }, func(value interface{}) bool {
+			req := value.(*PayRequest)
+			changed := normalizeEmail(&req.PayeeEmail)
+			return normalizeEmail(&req.PayerEmail) || changed
+		}),
+	},
+	{
+		Version:     2,
+		Name:        "normalize-session-emails",
+		Kind:        "Session",
+		Description: "Normalizes session emails.",
+		Apply: updateEach(func() interface{} { return &Session{} }, func(value interface{}) bool {
+			return normalizeEmail(&value.(*Session).Email)
+		}),
+	},
+	{
+		Version:     3,
+		Name:        "normalize-user-emails",
+		Kind:        "User",
+		Description: "Normalizes user emails and PayPal emails.",
+		Apply: updateEach(func() interface{} { return &User{} }, func(value interface{}) bool {
+			user := value.(*User)
+			changed := normalizeEmail(&user.Email)
+			return normalizeEmail(&user.PayPalEmail) || changed
+		}),
+	},
+	{
+		Version:     4,
+		Name:        "normalize-user-id-keys",
+		Kind:        "UserId",
+		Description: "Re-keys UserId entities by normalized email.",
+		Apply:       rekeyUserId,
+	},
+	{
+		Version:     5,
+		Name:        "copy-passwords-to-bytes",
+		Kind:        "User",
+		Description: "Copies Salt and PassHash to SaltB and PassHashB.",
+		Apply: updateEach(func() interface{} { return &User{} }, func(value interface{}) bool {
+			user := value.(*User)
+			// Users who signed up (or changed their password) since SaltB was added
+			// have no Salt; don't clobber their SaltB.
+			if user.Salt == "" || len(user.SaltB) > 0 {
+				return false
+			}
+			user.SaltB = []byte(user.Salt)
+			user.PassHashB = []byte(user.PassHash)
+			return true
+		}),
+	},
+	{
+		Version:     6,
+		Name:        "clear-deprecated-password-fields",
+		Kind:        "User",
+		Description: "Clears Salt and PassHash.",
+		Apply: updateEach(func() interface{} { return &User{} }, func(value interface{}) bool {
+			user := value.(*User)
+			if user.Salt == "" && user.PassHash == "" {
+				return false
+			}
+			Assert(len(user.SaltB) > 0, "Password not copied for user: ", user.Email)
+			user.Salt = ""
+			user.PassHash = ""
+			return true
+		}),
+	},
+	{
+		Version:     7,
+		Name:        "delete-verify-email-records",
+		Kind:        "VerifyEmail",
+		Description: "Deletes VerifyEmail records, which were replaced by UserTokens.",
+		Apply:       deleteEach,
+	},
+	{
+		Version:     8,
+		Name:        "delete-reset-password-records",
+		Kind:        "ResetPassword",
+		Description: "Deletes ResetPassword records, which were replaced by UserTokens.",
+		Apply:       deleteEach,
+	},
+}
+
+// An Apply function that deletes every entity, e.g. of a kind that is no longer
+// used.
+func deleteEach(aec appengine.Context, key *datastore.Key, dryRun bool) (bool, error) {
+	if dryRun {
+		return true, nil
+	}
+	return true, datastore.Delete(aec, key)
+}
+
+// Moves the given UserId entity to the key for its normalized email.
+func rekeyUserId(aec appengine.Context, key *datastore.Key, dryRun bool) (bool, error) {
+	oldEmail := key.StringID()
+	newEmail := ParseEmail(oldEmail)
+	if oldEmail == newEmail {
+		return false, nil
+	}
+	newKey := ToUserIdKey(aec, newEmail)
+	userIdStruct := &UserId{}
+
+	// Check that there's no UserId record for newEmail.
+	if err := datastore.Get(aec, newKey, userIdStruct); err != datastore.ErrNoSuchEntity {
+		if err == nil {
+			return false, errors.New(fmt.Sprintf("UserId already exists: %q, %q", oldEmail, newEmail))
+		}
+		return false, err
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	// Get the UserId record for oldEmail, write one for newEmail, and delete the
+	// one for oldEmail.
+	if err := datastore.Get(aec, key, userIdStruct); err != nil {
+		return false, err
+	}
+	if _, err := datastore.Put(aec, newKey, userIdStruct); err != nil {
+		return false, err
+	}
+	return true, datastore.Delete(aec, key)
+}
+
+func lookupMigration(name string) *migration {
+	for _, m := range migrations {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func toMigrationKey(aec appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(aec, "Migration", name, 0, nil)
+}
+
+// Returns the state of each registered migration, in version order. Migrations
+// that have never been run get a zero Migration.
+func getMigrationStatesOrDie(c *Context) []*Migration {
+	states := make([]*Migration, len(migrations))
+	for i, m := range migrations {
+		states[i] = &Migration{}
+		err := datastore.Get(c.Aec(), toMigrationKey(c.Aec(), m.Name), states[i])
+		if err != datastore.ErrNoSuchEntity {
+			CheckError(err)
+		}
+	}
+	return states
+}
+
+func isApplied(state *Migration) bool {
+	return state.Status == MSDone && !state.DryRun
+}
+
+// Must be called in the transaction that updates the Migration entity, so that
+// a batch is enqueued if and only if the state says it should run.
+func doEnqueueMigrationBatch(aec appengine.Context, name string, batch int) error {
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("batch", strconv.Itoa(batch))
+	t := taskqueue.NewPOSTTask("/tasks/run-migration", v)
+	_, err := taskqueue.Add(aec, t, "migrations")
+	return err
+}
+
+// Starts (action "apply" or "dry-run") or resumes (action "resume") a run of
+// the given migration.
+func doStartMigration(m *migration, action string, c *Context) error {
+	states := getMigrationStatesOrDie(c)
+	if action == "apply" {
+		for i, other := range migrations {
+			if other.Version < m.Version && !isApplied(states[i]) {
+				return errors.New(fmt.Sprintf("Migration %d (%s) must be applied first.", other.Version, other.Name))
+			}
+		}
+	}
+	key := toMigrationKey(c.Aec(), m.Name)
+	return datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+		state := &Migration{}
+		if err := datastore.Get(aec, key, state); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if state.Status == MSRunning {
+			return errors.New("Migration is already running.")
+		}
+		now := time.Now()
+		switch action {
+		case "apply", "dry-run":
+			*state = Migration{
+				Version:   m.Version,
+				Status:    MSRunning,
+				DryRun:    action == "dry-run",
+				Admin:     getAdminEmail(c),
+				StartDate: now,
+				DoneDate:  time.Unix(0, 0),
+			}
+		case "resume":
+			if state.Status != MSFailed {
+				return errors.New("Only failed runs can be resumed.")
+			}
+			state.Status = MSRunning
+			state.Error = ""
+		default:
+			return errors.New(fmt.Sprintf("Invalid action: %q", action))
+		}
+		state.UpdateDate = now
+		if _, err := datastore.Put(aec, key, state); err != nil {
+			return err
+		}
+		if err := putAdminAuditEntry(aec, "migrate", key, map[string]string{"action": action}, c); err != nil {
+			return err
+		}
+		return doEnqueueMigrationBatch(aec, m.Name, state.Batch)
+	}, makeXG())
+}
+
+// Applies the given migration to the given entity. Returns a panic in Apply
+// (e.g. a failed Assert) as an error, so that the migration is marked as failed
+// instead of being retried until the task gives up.
+func runMigrationStep(m *migration, key *datastore.Key, dryRun bool, c *Context) (changed bool, err error) {
+	defer func() {
+		if data := recover(); data != nil {
+			changed, err = false, fmt.Errorf("panic: %v", data)
+		}
+	}()
+	if dryRun {
+		return m.Apply(c.Aec(), key, true)
+	}
+	err = datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+		var err error
+		changed, err = m.Apply(aec, key, false)
+		return err
+	}, makeXG())
+	if err == nil && changed {
+		// Apply functions use the datastore directly.
+		cacheDelete(c, key)
+	}
+	return changed, err
+}
+
+type RenderableMigration struct {
+	Version     int
+	Name        string
+	Kind        string
+	Description string
+	Status      string
+	DryRun      bool
+	Admin       string
+	Batch       int
+	Scanned     int
+	Changed     int
+	Error       string
+	StartDate   string
+	UpdateDate  string
+	DoneDate    string
+	Applied     bool
+	CanApply    bool // all earlier migrations have been applied
+}
+
+// GET lists the registered migrations and the state of their latest runs. POST
+// with "name" and "action" starts or resumes a run; see doStartMigration.
+func handleMigrations(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method == "POST" {
+		m := lookupMigration(r.FormValue("name"))
+		if m == nil {
+			http.Error(w, fmt.Sprintf("No such migration: %q", r.FormValue("name")), http.StatusNotFound)
+			return
+		}
+		action := r.FormValue("action")
+		if err := doStartMigration(m, action, c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.Log().Info("Admin started migration", "admin", getAdminEmail(c), "migration", m.Name, "action", action)
+		http.Redirect(w, r, "/admin/migrations", http.StatusSeeOther)
+		return
+	} else if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	states := getMigrationStatesOrDie(c)
+	rendMigrations := make([]RenderableMigration, len(migrations))
+	canApply, refresh := true, false
+	for i, m := range migrations {
+		state := states[i]
+		rm := RenderableMigration{
+			Version:     m.Version,
+			Name:        m.Name,
+			Kind:        m.Kind,
+			Description: m.Description,
+			Status:      state.Status,
+			DryRun:      state.DryRun,
+			Admin:       state.Admin,
+			Batch:       state.Batch,
+			Scanned:     state.Scanned,
+			Changed:     state.Changed,
+			Error:       state.Error,
+			Applied:     isApplied(state),
+			CanApply:    canApply,
+		}
+		if state.Status != "" {
+			rm.StartDate = renderAdminValue(state.StartDate, c)
+			rm.UpdateDate = renderAdminValue(state.UpdateDate, c)
+			rm.DoneDate = renderAdminValue(state.DoneDate, c)
+		}
+		rendMigrations[i] = rm
+		canApply = canApply && rm.Applied
+		refresh = refresh || state.Status == MSRunning
+	}
+	data := map[string]interface{}{
+		"kinds":      getKindNames(),
+		"migrations": rendMigrations,
+		"refresh":    refresh,
+	}
+	RenderTemplateOrDie(w, c, "admin-migrations", data)
+}
+
+// Runs one batch of a migration, then enqueues the next batch. Params: "name"
+// of the migration, and "batch", which must match the Migration entity, so that
+// repeated and stale tasks are ignored.
+func handleRunMigration(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	m := lookupMigration(r.FormValue("name"))
+	Assert(m != nil, "No such migration: ", r.FormValue("name"))
+	batch, err := strconv.Atoi(r.FormValue("batch"))
+	CheckError(err)
+	key := toMigrationKey(c.Aec(), m.Name)
+	state := &Migration{}
+	CheckError(datastore.Get(c.Aec(), key, state))
+	if state.Status != MSRunning || state.Batch != batch {
+		c.Log().Info("Skipping stale migration batch", "migration", m.Name, "batch", batch)
+		return
+	}
+
+	q := datastore.NewQuery(m.Kind).KeysOnly()
+	if state.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(state.Cursor)
+		CheckError(err)
+		q = q.Start(cursor)
+	}
+	scanned, changed, done := 0, 0, false
+	var runErr error
+	it := q.Run(c.Aec())
+	for scanned < kMigrationBatchSize {
+		entityKey, err := it.Next(nil)
+		if err == datastore.Done {
+			done = true
+			break
+		}
+		CheckError(err)
+		scanned++
+		ok, err := runMigrationStep(m, entityKey, state.DryRun, c)
+		if err != nil {
+			runErr = errors.New(fmt.Sprintf("%v: %v", entityKey, err))
+			break
+		}
+		if ok {
+			changed++
+		}
+	}
+	nextCursor := ""
+	if runErr == nil && !done {
+		cursor, err := it.Cursor()
+		CheckError(err)
+		nextCursor = cursor.String()
+	}
+
+	// On failure, we leave the cursor at the start of this batch, and don't count
+	// its entities; resuming will run the whole batch again.
+	err = datastore.RunInTransaction(c.Aec(), func(aec appengine.Context) error {
+		state := &Migration{}
+		if err := datastore.Get(aec, key, state); err != nil {
+			return err
+		}
+		if state.Status != MSRunning || state.Batch != batch {
+			return nil // another task got here first
+		}
+		now := time.Now()
+		state.UpdateDate = now
+		if runErr != nil {
+			state.Status = MSFailed
+			state.Error = runErr.Error()
+		} else {
+			state.Batch++
+			state.Cursor = nextCursor
+			state.Scanned += scanned
+			state.Changed += changed
+			if done {
+				state.Status = MSDone
+				state.DoneDate = now
+			} else if err := doEnqueueMigrationBatch(aec, m.Name, state.Batch); err != nil {
+				return err
+			}
+		}
+		_, err := datastore.Put(aec, key, state)
+		return err
+	}, nil)
+	CheckError(err)
+
+	if runErr != nil {
+		c.Log().Error("Migration failed", "migration", m.Name, "batch", batch, "error", runErr)
+	} else {
+		c.Log().Info("Ran migration batch", "migration", m.Name, "batch", batch, "scanned", scanned,
+			"changed", changed, "done", done)
+	}
+}
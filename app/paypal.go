@@ -10,8 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-
-	"appengine/urlfetch"
+	"time"
 )
 
 // Stores paypal response to one "Pay" request.
@@ -43,10 +42,11 @@ var headers = map[string]string{
 	"X-PAYPAL-APPLICATION-ID":       kAppId,
 }
 
-func setHeaders(r *http.Request) {
+func setHeaders(r *http.Request, c *Context) {
 	for k, v := range headers {
 		r.Header.Set(k, v)
 	}
+	r.Header.Set(kRequestIdHeader, c.RequestId())
 }
 
 // Wrapper around urlfetch.Client to extract response body string. Returns error
@@ -67,13 +67,18 @@ func getResponseBody(resp *http.Response, err error) (string, error) {
 }
 
 func PayPalSendPayRequest(reqCode, payeePayPalEmail, description string, amount float32, c *Context) (*PayPalPayResponse, string, error) {
-	c.Aec().Debugf("PayPalSendPayRequest, payee=%q", payeePayPalEmail)
+	c.Log().Debug("Sending PayPal Pay request", "reqCode", reqCode, "payee", payeePayPalEmail,
+		"amount", amount)
 
 	baseUrl := fmt.Sprintf("http://%s", AppHostnameForPayPal(c))
 
 	// NOTE(sadovsky): We could add a trackingId here, but reqCode in url seems
 	// good enough.
+	// The request ID in the urls ties the callbacks to this request in the logs.
+	callbackParams := fmt.Sprintf("reqCode=%s&%s=%s", reqCode, kRequestIdParam, c.RequestId())
 	v := url.Values{}
+	// Adaptive Payments only supports en_US error messages. These are logged,
+	// never shown to the payer; PayPal picks the checkout page language itself.
 	v.Set("requestEnvelope.errorLanguage", "en_US")
 	v.Set("actionType", "PAY")
 	v.Set("receiverList.receiver(0).email", payeePayPalEmail)
@@ -84,11 +89,11 @@ func PayPalSendPayRequest(reqCode, payeePayPalEmail, description string, amount
 	v.Set("currencyCode", "USD")
 	v.Set("feesPayer", "SENDER")
 	v.Set("memo", description)
-	v.Set("cancelUrl", fmt.Sprintf("%s/pay?reqCode=%s", baseUrl, reqCode))
-	v.Set("returnUrl", fmt.Sprintf("%s/pay/done?reqCode=%s", baseUrl, reqCode))
+	v.Set("cancelUrl", fmt.Sprintf("%s/pay?%s", baseUrl, callbackParams))
+	v.Set("returnUrl", fmt.Sprintf("%s/pay/done?%s", baseUrl, callbackParams))
 	// Note: IPN requires port 80, at least in the sandbox. This constraint is not
 	// documented.
-	v.Set("ipnNotificationUrl", fmt.Sprintf("%s/ipn?reqCode=%s", baseUrl, reqCode))
+	v.Set("ipnNotificationUrl", fmt.Sprintf("%s/ipn?%s", baseUrl, callbackParams))
 
 	// Last param (body) inferred from PostForm() implementation in
 	// http://golang.org/src/pkg/net/http/client.go.
@@ -96,10 +101,11 @@ func PayPalSendPayRequest(reqCode, payeePayPalEmail, description string, amount
 	if err != nil {
 		return nil, "", err
 	}
-	setHeaders(request)
+	setHeaders(request, c)
 
-	c.Aec().Debugf("Pay request: %v", request)
-	respStr, err := getResponseBody(urlfetch.Client(c.Aec()).Do(request))
+	result := "error"
+	defer recordPayPalCall("pay", time.Now(), &result)
+	respStr, err := getResponseBody(NewHttpClient(0, c).Do(request))
 	if err != nil {
 		return nil, "", err
 	}
@@ -107,12 +113,14 @@ func PayPalSendPayRequest(reqCode, payeePayPalEmail, description string, amount
 	if err != nil {
 		return nil, "", err
 	}
-	c.Aec().Debugf("Pay response: %v", values)
+	c.Log().Debug("Got PayPal Pay response", "reqCode", reqCode, "response", values)
 
 	ack := values.Get("responseEnvelope.ack")
 	if ack != "Success" {
+		result = "failure"
 		return nil, "", errors.New(ack)
 	}
+	result = "success"
 
 	res := &PayPalPayResponse{
 		Ack:           ack,
@@ -127,27 +135,33 @@ func PayPalSendPayRequest(reqCode, payeePayPalEmail, description string, amount
 
 // IPN handler references: http://goo.gl/bIX2Q and http://goo.gl/F1uej
 func PayPalValidateIpn(requestBody string, c *Context) (*PayPalIpnMessage, error) {
-	c.Aec().Debugf("PayPalValidateIpn")
-
 	// Post back to IPN server to get verification.
 	postBody := fmt.Sprintf("cmd=_notify-validate&%s", requestBody)
-	c.Aec().Debugf("IPN post body: %v", postBody)
+	c.Log().Debug("Validating IPN", "body", postBody)
 
-	respStr, err := getResponseBody(urlfetch.Client(c.Aec()).Post(
-		kValidateIpnUrl, "application/x-www-form-urlencoded", strings.NewReader(postBody)))
+	request, err := http.NewRequest("POST", kValidateIpnUrl, strings.NewReader(postBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set(kRequestIdHeader, c.RequestId())
+	result := "error"
+	defer recordPayPalCall("validate_ipn", time.Now(), &result)
+	respStr, err := getResponseBody(NewHttpClient(0, c).Do(request))
 	if err != nil {
 		return nil, err
 	}
 	if respStr != "VERIFIED" {
+		result = "invalid"
 		return nil, errors.New(respStr) // INVALID
 	}
+	result = "verified"
 
 	// Parse original IPN request and extract the useful values.
 	values, err := url.ParseQuery(requestBody)
 	if err != nil {
 		return nil, err
 	}
-	c.Aec().Debugf("IPN message: %v", values)
 
 	amountStr := values.Get("transaction[0].amount")
 	currencyAndAmount := strings.Split(amountStr, " ")
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the number of calendar days (in the given time zone) from "from" to
+// "to". The result is negative if "to" falls on an earlier day than "from".
+func calendarDaysBetween(from, to time.Time, loc *time.Location) int {
+	toUTCDay := func(t time.Time) time.Time {
+		y, m, d := t.In(loc).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	return int(toUTCDay(to).Sub(toUTCDay(from)).Hours() / 24)
+}
+
+// Old PayRequest records have no DueDate field, so we check for both the zero
+// time and the unix epoch.
+func hasDueDate(req *PayRequest) bool {
+	return req.DueDate.After(time.Unix(0, 0))
+}
+
+// Old PayRequest records have no BounceDate field; see hasDueDate.
+func isBounced(req *PayRequest) bool {
+	return req.BounceDate.After(time.Unix(0, 0))
+}
+
+// Returns the number of days until the request is due. Returns 0 if the
+// request is due today, and a negative number if it is overdue.
+func daysUntilDue(req *PayRequest, now time.Time) int {
+	Assert(hasDueDate(req), "No due date")
+	return calendarDaysBetween(now, req.DueDate, requestLocation(req))
+}
+
+func isOverdue(req *PayRequest, now time.Time) bool {
+	return !req.IsPaid && hasDueDate(req) && daysUntilDue(req, now) < 0
+}
+
+// Replaces the zero ReminderPolicy with the default policy.
+func effectiveReminderPolicy(policy ReminderPolicy) ReminderPolicy {
+	if policy.Mode == 0 {
+		return ReminderPolicy{
+			Mode:      RMEvery,
+			EveryDays: kAutoPayRequestEmailFrequency,
+		}
+	}
+	return policy
+}
+
+// Returns the number of days to wait between automatic reminder emails for a
+// request with an RMEvery policy. Reminders escalate as the due date
+// approaches and passes, but never become less frequent than the policy says.
+func reminderFrequency(req *PayRequest, now time.Time) int {
+	policy := effectiveReminderPolicy(req.ReminderPolicy)
+	Assert(policy.Mode == RMEvery, "Invalid mode: ", policy.Mode)
+	res := policy.EveryDays
+	if !hasDueDate(req) {
+		return res
+	}
+	days := daysUntilDue(req, now)
+	if days < 0 && kOverdueEmailFrequency < res {
+		res = kOverdueEmailFrequency
+	} else if days <= kDueSoonDays && kDueSoonEmailFrequency < res {
+		res = kDueSoonEmailFrequency
+	}
+	return res
+}
+
+// Returns true if an automatic reminder email should be sent for the given
+// request, according to its reminder policy.
+func isReminderDue(req *PayRequest, now time.Time) bool {
+	if req.IsPaid || isBounced(req) {
+		return false
+	}
+	daysSinceEmail := calendarDaysBetween(req.ReminderSentDate, now, requestLocation(req))
+	if daysSinceEmail < kPayRequestEmailCooldown {
+		return false
+	}
+	policy := effectiveReminderPolicy(req.ReminderPolicy)
+	if policy.MaxCount > 0 && req.ReminderCount >= policy.MaxCount {
+		return false
+	}
+	switch policy.Mode {
+	case RMOff:
+		return false
+	case RMEvery:
+		return daysSinceEmail >= reminderFrequency(req, now)
+	case RMOffsets:
+		return reachedOffsetCount(req, policy, now) > req.ReminderCount
+	}
+	panic(fmt.Sprintf("Invalid mode: %d", policy.Mode))
+}
+
+// Returns the number of offsets in the given RMOffsets policy that the request
+// has reached by now.
+func reachedOffsetCount(req *PayRequest, policy ReminderPolicy, now time.Time) int {
+	days := int64(calendarDaysBetween(req.CreationDate, now, requestLocation(req)))
+	n := 0
+	for n < len(policy.Offsets) && policy.Offsets[n] <= days {
+		n++
+	}
+	return n
+}
+
+// Updates the request's ReminderCount after an automatic reminder is sent.
+// Under RMOffsets, the reminder is for the latest offset reached, so earlier
+// offsets that were missed (e.g. because the policy changed) count as sent,
+// rather than being caught up on one per day.
+func recordAutoReminder(req *PayRequest, now time.Time) {
+	req.ReminderCount++
+	policy := effectiveReminderPolicy(req.ReminderPolicy)
+	if policy.Mode == RMOffsets {
+		if n := reachedOffsetCount(req, policy, now); n > req.ReminderCount {
+			req.ReminderCount = n
+		}
+	}
+}
+
+// Returns a human-readable description of a reminder policy, e.g. "Every 7
+// days", in the given locale.
+func renderReminderPolicy(locale string, policy ReminderPolicy) string {
+	policy = effectiveReminderPolicy(policy)
+	var res string
+	switch policy.Mode {
+	case RMOff:
+		return Translate(locale, "Never")
+	case RMEvery:
+		if policy.EveryDays == 1 {
+			res = Translate(locale, "Every day")
+		} else {
+			res = Translate(locale, "Every %d days", policy.EveryDays)
+		}
+	case RMOffsets:
+		res = Translate(locale, "%s days after request", renderOffsets(policy.Offsets))
+	}
+	if policy.MaxCount > 0 {
+		res += Translate(locale, ", at most %d times", policy.MaxCount)
+	}
+	return res
+}
+
+func renderOffsets(offsets []int64) string {
+	strs := make([]string, len(offsets))
+	for i, offset := range offsets {
+		strs[i] = strconv.FormatInt(offset, 10)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Template data for the reminder-policy-table template.
+type ReminderPolicyForm struct {
+	AllowDefault bool // whether to offer the "use my default" option
+	Mode         string
+	EveryDays    string
+	Offsets      string
+	MaxCount     string
+}
+
+func makeReminderPolicyForm(policy ReminderPolicy, allowDefault bool) *ReminderPolicyForm {
+	form := &ReminderPolicyForm{
+		AllowDefault: allowDefault,
+		EveryDays:    strconv.Itoa(kAutoPayRequestEmailFrequency),
+	}
+	if allowDefault {
+		form.Mode = "default"
+		return form
+	}
+	policy = effectiveReminderPolicy(policy)
+	for name, mode := range reminderModeMap {
+		if mode == policy.Mode {
+			form.Mode = name
+		}
+	}
+	if policy.Mode == RMEvery {
+		form.EveryDays = strconv.Itoa(policy.EveryDays)
+	}
+	form.Offsets = renderOffsets(policy.Offsets)
+	if policy.MaxCount > 0 {
+		form.MaxCount = strconv.Itoa(policy.MaxCount)
+	}
+	return form
+}
+
+// Returns a short human-readable due status, e.g. "Due in 3 days", in the given
+// locale. Returns an empty string if the request has no due date or is paid.
+func renderDueStatus(locale string, req *PayRequest, now time.Time) string {
+	if !hasDueDate(req) || req.IsPaid {
+		return ""
+	}
+	switch days := daysUntilDue(req, now); {
+	case days < 0:
+		return Translate(locale, "Overdue")
+	case days == 0:
+		return Translate(locale, "Due today")
+	case days == 1:
+		return Translate(locale, "Due tomorrow")
+	default:
+		return Translate(locale, "Due in %d days", days)
+	}
+}
@@ -0,0 +1,190 @@
+// Parses replies from payers to payment request emails. Each payment request
+// email has a per-request Reply-To address; see makeReplyToAddress.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidReplyToAddress = errors.New("Invalid reply-to address")
+
+type ReplyEmail struct {
+	From        string // canonicalized sender address
+	Subject     string
+	Body        string // text of the reply, without quoted text
+	IsAutoReply bool   // e.g. vacation responder; should be ignored
+}
+
+// Returns the local part of the reply-to address for the given PayRequest.
+// Local parts are case-insensitive in practice, so the signature is lowercase.
+func makeReplyToLocalPart(userId, reqId int64) string {
+	return fmt.Sprintf("reply-%d-%d-%s", userId, reqId, replySignature(userId, reqId))
+}
+
+func replySignature(userId, reqId int64) string {
+	return strings.ToLower(SignString(fmt.Sprintf("reply:%d:%d", userId, reqId)))[:12]
+}
+
+// Inverse of makeReplyToLocalPart. Accepts a full address or just the local
+// part.
+func parseReplyToLocalPart(addr string) (userId, reqId int64, err error) {
+	local := strings.ToLower(strings.SplitN(addr, "@", 2)[0])
+	parts := strings.SplitN(local, "-", 4)
+	if len(parts) != 4 || parts[0] != "reply" {
+		return 0, 0, errInvalidReplyToAddress
+	}
+	if userId, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, errInvalidReplyToAddress
+	}
+	if reqId, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return 0, 0, errInvalidReplyToAddress
+	}
+	if parts[3] != replySignature(userId, reqId) {
+		return 0, 0, errInvalidReplyToAddress
+	}
+	return userId, reqId, nil
+}
+
+func ParseReplyEmail(r io.Reader) (*ReplyEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, err
+	}
+	if !emailRegexp.MatchString(from.Address) {
+		return nil, errors.New(fmt.Sprintf("Invalid From address: %q", from.Address))
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	text, err := findTextBody(mail.Header(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// See RFC 3834.
+	autoSubmitted := strings.ToLower(msg.Header.Get("Auto-Submitted"))
+	precedence := strings.ToLower(msg.Header.Get("Precedence"))
+	isAutoReply := (autoSubmitted != "" && autoSubmitted != "no") ||
+		precedence == "auto_reply" || precedence == "bulk" || precedence == "junk"
+
+	return &ReplyEmail{
+		From:        ParseEmail(from.Address),
+		Subject:     subject,
+		Body:        stripQuotedText(text),
+		IsAutoReply: isAutoReply,
+	}, nil
+}
+
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// Returns the text/plain body of the given message, or, if there is none, its
+// text/html body with tags removed.
+func findTextBody(header mail.Header, body io.Reader) (string, error) {
+	var htmlText string
+	var walk func(header mail.Header, body io.Reader) (string, error)
+	walk = func(header mail.Header, body io.Reader) (string, error) {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			mediaType = "text/plain"
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					return "", nil
+				} else if err != nil {
+					return "", err
+				}
+				text, err := walk(mail.Header(part.Header), part)
+				if err != nil || text != "" {
+					return text, err
+				}
+			}
+		}
+		if mediaType != "text/plain" && mediaType != "text/html" {
+			return "", nil
+		}
+		b, err := decodeMessageBody(header, body)
+		if err != nil {
+			return "", err
+		}
+		if mediaType == "text/html" {
+			if htmlText == "" {
+				htmlText = html.UnescapeString(htmlTagRegexp.ReplaceAllString(string(b), ""))
+			}
+			return "", nil
+		}
+		return string(b), nil
+	}
+	text, err := walk(header, body)
+	if err != nil {
+		return "", err
+	}
+	if text == "" {
+		text = htmlText
+	}
+	return text, nil
+}
+
+// Matches the line that most mail clients put above quoted text.
+var quoteHeaderRegexp = regexp.MustCompile(`^(On .* wrote:|-+ ?Original Message ?-+)$`)
+
+// Removes quoted text (e.g. our original email) from a reply, along with
+// leading and trailing whitespace.
+func stripQuotedText(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	res := []string{}
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if quoteHeaderRegexp.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		res = append(res, line)
+	}
+	body := strings.TrimSpace(strings.Join(res, "\n"))
+	if len(body) > kMaxReplyLength {
+		// Back up to a rune boundary, so that we don't split a multi-byte rune.
+		n := kMaxReplyLength
+		for n > 0 && !utf8.RuneStart(body[n]) {
+			n--
+		}
+		body = body[:n]
+	}
+	return body
+}
+
+// Returns RCPaid or RCStop if the first word of the reply is "paid" or "stop",
+// and 0 otherwise.
+func parseReplyCommand(body string) int {
+	fields := strings.Fields(strings.ToLower(body))
+	if len(fields) == 0 {
+		return 0
+	}
+	switch strings.Trim(fields[0], ".,;:!") {
+	case "paid":
+		return RCPaid
+	case "stop":
+		return RCStop
+	}
+	return 0
+}
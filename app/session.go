@@ -14,15 +14,19 @@ type Session struct {
 	Timestamp time.Time // when this session was created
 	Email     string    // email of user, stored here for convenience
 	FullName  string    // full name of user, stored here for convenience
+	Locale    string    // preferred locale of user, or empty to negotiate
+	TimeZone  string    // time zone of user, or empty for default
 }
 
 // Sets session cookie and updates context.
-func MakeSession(userId int64, email, fullName string, w http.ResponseWriter, c *Context) error {
+func MakeSession(userId int64, email, fullName, locale, timeZone string, w http.ResponseWriter, c *Context) error {
 	s := &Session{
 		UserId:    userId,
 		Timestamp: time.Now(),
 		Email:     email,
 		FullName:  fullName,
+		Locale:    locale,
+		TimeZone:  timeZone,
 	}
 	options := &CookieOptions{
 		MaxAge: 86400 * kSessionCookieLifespan,
@@ -61,6 +65,29 @@ func ReadSession(r *http.Request, c *Context) error {
 	return nil
 }
 
+// Copies the profile fields stored in the session from the User, and updates
+// the session cookie if any of them changed. The API can change these fields
+// without access to the cookie, so we cannot rely on handlers that change them
+// calling UpdateSession. Logs the user out if their User no longer exists.
+func RefreshSession(w http.ResponseWriter, c *Context) error {
+	if !c.LoggedIn() {
+		return nil
+	}
+	s := *c.Session()
+	user, err := store.GetUser(s.UserId, c)
+	if err == ErrNoSuchEntity {
+		return DeleteSession(w, c)
+	} else if err != nil {
+		return err
+	}
+	if s.Email == user.Email && s.FullName == user.FullName && s.Locale == user.Locale &&
+		s.TimeZone == user.TimeZone {
+		return nil
+	}
+	s.Email, s.FullName, s.Locale, s.TimeZone = user.Email, user.FullName, user.Locale, user.TimeZone
+	return UpdateSession(&s, w, c)
+}
+
 // Deletes session cookie (if any) and updates context.
 func DeleteSession(w http.ResponseWriter, c *Context) error {
 	if err := DeleteCookie(sessionKey, w); err != nil {
@@ -0,0 +1,144 @@
+// SqlStore keeps entities in a SQLite database, via database/sql; see
+// cmd/tadue. Each entity is a row in the entities table; see kvstore.go for
+// the key and value formats.
+
+package app
+
+import (
+	"database/sql"
+)
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS entities (
+		key TEXT PRIMARY KEY,
+		version INTEGER NOT NULL,
+		value BLOB NOT NULL
+	)`,
+	// Holds the last allocated id and the last committed version.
+	`CREATE TABLE IF NOT EXISTS counters (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	)`,
+	`INSERT OR IGNORE INTO counters (name, value) VALUES ('id', 0), ('version', 0)`,
+}
+
+type sqlBackend struct {
+	db *sql.DB
+}
+
+func (b *sqlBackend) get(key string) ([]byte, int64, error) {
+	var value []byte
+	var version int64
+	err := b.db.QueryRow("SELECT value, version FROM entities WHERE key = ?", key).Scan(&value, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrNoSuchEntity
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
+
+// Returns the smallest string greater than every string with the given prefix.
+// Prefixes always end in ':', so incrementing the last byte cannot overflow.
+func prefixEnd(prefix string) string {
+	return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+}
+
+func (b *sqlBackend) scan(prefix string) ([]string, [][]byte, error) {
+	rows, err := b.db.Query("SELECT key, value FROM entities WHERE key >= ? AND key < ? ORDER BY key",
+		prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	values := [][]byte{}
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values, rows.Err()
+}
+
+// Increments the named counter in the given transaction, and returns its new
+// value.
+func incrementCounter(tx *sql.Tx, name string) (int64, error) {
+	if _, err := tx.Exec("UPDATE counters SET value = value + 1 WHERE name = ?", name); err != nil {
+		return 0, err
+	}
+	var value int64
+	err := tx.QueryRow("SELECT value FROM counters WHERE name = ?", name).Scan(&value)
+	return value, err
+}
+
+func (b *sqlBackend) commit(reads map[string]int64, writes map[string][]byte) (ok bool, err error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err == nil && ok {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	for key, version := range reads {
+		var current int64
+		err := tx.QueryRow("SELECT version FROM entities WHERE key = ?", key).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+		if current != version {
+			return false, nil
+		}
+	}
+	version, err := incrementCounter(tx, "version")
+	if err != nil {
+		return false, err
+	}
+	for key, value := range writes {
+		if value == nil {
+			_, err = tx.Exec("DELETE FROM entities WHERE key = ?", key)
+		} else {
+			_, err = tx.Exec("INSERT OR REPLACE INTO entities (key, version, value) VALUES (?, ?, ?)",
+				key, version, value)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (b *sqlBackend) allocateId() (id int64, err error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if id, err = incrementCounter(tx, "id"); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+type SqlStore struct {
+	kvStore
+}
+
+// Creates the tables if needed. SQLite allows only one writer at a time, so db
+// should be limited to one open connection.
+func NewSqlStore(db *sql.DB) (*SqlStore, error) {
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &SqlStore{kvStore{b: &sqlBackend{db: db}}}, nil
+}
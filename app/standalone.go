@@ -0,0 +1,315 @@
+// Standalone mode: serves the app on plain net/http, outside App Engine; see
+// cmd/tadue. Storage is SQLite (see sqlstore.go), tasks run in-process (see
+// LocalTaskQueue), an internal scheduler replaces cron.yaml, and email goes out
+// over SMTP.
+//
+// Features that depend on App Engine are disabled, which has consequences for
+// anyone running Tadue this way:
+//   - The janitor does not run, so expired UserTokens and soft-deleted
+//     PayRequests are never purged.
+//   - The admin console, dashboard, and migrations are not available. Data
+//     migrations must be done by hand, in SQL.
+//   - Inbound mail is not received, so payers' replies are not forwarded, and
+//     bounces and complaints are not recorded.
+//   - /dev is not served.
+// Building still needs the App Engine SDK (goapp), since the app imports its
+// appengine packages; see the Makefile.
+
+package app
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine_internal"
+)
+
+type StandaloneConfig struct {
+	Hostname string // e.g. "tadue.example.com"; used in links
+	DB       *sql.DB
+	SmtpAddr string
+	CronPath string // cron.yaml; jobs are not run if empty
+}
+
+// Non-nil in standalone mode.
+var standalone *StandaloneConfig
+
+// Paths that are not served in standalone mode. Tasks are only run by the local
+// task queue and the scheduler, which bypass the returned handler.
+var standaloneBlockedPrefixes = []string{"/admin/", "/dev/", "/tasks/", "/_ah/"}
+
+// Cron jobs that need App Engine.
+var standaloneSkippedJobs = []string{"/tasks/run-janitor"}
+
+// Used if the caller does not specify a deadline.
+const kStandaloneHttpTimeout = 30 * time.Second
+
+// Switches the app to standalone mode, starts the scheduler, and returns the
+// handler to serve. Must be called before serving any requests. Expects the
+// working directory to be the repository root, since templates and static
+// files are read from there.
+func SetupStandalone(cfg *StandaloneConfig) (http.Handler, error) {
+	if cfg.Hostname == "" {
+		return nil, errors.New("No hostname")
+	}
+	s, err := NewSqlStore(cfg.DB)
+	if err != nil {
+		return nil, err
+	}
+	standalone = cfg
+	store = s
+	mailer = &SmtpMailer{Addr: cfg.SmtpAddr}
+	taskQueue = NewLocalTaskQueue(http.DefaultServeMux)
+	newAppEngineContext = newStandaloneContext
+	newHttpTransport = getStandaloneTransport
+	newWebhookTransport = getStandaloneWebhookTransport
+
+	if cfg.CronPath != "" {
+		jobs, err := readCronYaml(cfg.CronPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			if ContainsString(standaloneSkippedJobs, job.Url) {
+				log.Printf("Skipping cron job %q: not available in standalone mode", job.Url)
+				continue
+			}
+			go runCronJob(job, http.DefaultServeMux)
+		}
+	}
+	return newStandaloneHandler(), nil
+}
+
+func newStandaloneHandler() http.Handler {
+	mux := http.NewServeMux()
+	// Mirrors the static handlers in app.yaml.
+	staticDirs := map[string]string{
+		"/css/":         "public/css",
+		"/js/":          "public/js",
+		"/third_party/": "third_party",
+		"/static/":      "public/static",
+	}
+	for prefix, dir := range staticDirs {
+		mux.Handle(prefix, http.StripPrefix(prefix, http.FileServer(http.Dir(dir))))
+	}
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "public/static/favicon.ico")
+	})
+	for _, prefix := range standaloneBlockedPrefixes {
+		mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+			Serve404(w)
+		})
+	}
+	mux.Handle("/", http.DefaultServeMux)
+	return mux
+}
+
+////////////////////////////////////////
+// standaloneContext
+
+// Implements appengine.Context. Logs go to the standard logger; App Engine API
+// calls fail.
+type standaloneContext struct {
+	r *http.Request
+}
+
+func newStandaloneContext(r *http.Request) appengine.Context {
+	return &standaloneContext{r: r}
+}
+
+func (c *standaloneContext) logf(level, format string, args ...interface{}) {
+	log.Printf("%s %s", level, fmt.Sprintf(format, args...))
+}
+
+func (c *standaloneContext) Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+func (c *standaloneContext) Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+func (c *standaloneContext) Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+func (c *standaloneContext) Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
+
+func (c *standaloneContext) Criticalf(format string, args ...interface{}) {
+	c.logf("CRITICAL", format, args...)
+}
+
+func (c *standaloneContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return fmt.Errorf("%s.%s is not available in standalone mode", service, method)
+}
+
+// Only used in datastore keys, which we use as ids in urls.
+func (c *standaloneContext) FullyQualifiedAppID() string {
+	return "tadue"
+}
+
+func (c *standaloneContext) Request() interface{} {
+	return c.r
+}
+
+////////////////////////////////////////
+// HTTP transports
+
+var standaloneTransports = struct {
+	sync.Mutex
+	m map[time.Duration]*http.Transport
+}{m: map[time.Duration]*http.Transport{}}
+
+// Shares one transport per deadline, so that connections get reused.
+func getStandaloneTransport(deadline time.Duration, c *Context) http.RoundTripper {
+	if deadline == 0 {
+		deadline = kStandaloneHttpTimeout
+	}
+	standaloneTransports.Lock()
+	defer standaloneTransports.Unlock()
+	t, ok := standaloneTransports.m[deadline]
+	if !ok {
+		t = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  (&net.Dialer{Timeout: deadline}).Dial,
+			ResponseHeaderTimeout: deadline,
+		}
+		standaloneTransports.m[deadline] = t
+	}
+	return t
+}
+
+var standaloneWebhookTransports = struct {
+	sync.Mutex
+	m map[time.Duration]*http.Transport
+}{m: map[time.Duration]*http.Transport{}}
+
+// Like getStandaloneTransport, but refuses to connect to internal addresses
+// (see dialWebhook). Proxies are not used, since the check would then apply to
+// the proxy instead.
+func getStandaloneWebhookTransport(deadline time.Duration, c *Context) http.RoundTripper {
+	standaloneWebhookTransports.Lock()
+	defer standaloneWebhookTransports.Unlock()
+	t, ok := standaloneWebhookTransports.m[deadline]
+	if !ok {
+		t = &http.Transport{
+			Dial:                  makeWebhookDial(deadline),
+			ResponseHeaderTimeout: deadline,
+		}
+		standaloneWebhookTransports.m[deadline] = t
+	}
+	return t
+}
+
+// Returns a dial function that resolves the host itself, fails if any of its
+// addresses is internal, and then dials a checked address. The check runs on
+// every connection, so it also covers redirects, and dialing the checked IP
+// rather than the hostname keeps a second DNS lookup from returning a
+// different address.
+func makeWebhookDial(timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if !isWebhookAddrAllowed(ip) {
+				return nil, fmt.Errorf("Refusing to connect to internal address %s of %s", ip, host)
+			}
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("No addresses for %s", host)
+		}
+		return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port), timeout)
+	}
+}
+
+////////////////////////////////////////
+// Scheduler
+
+type cronJob struct {
+	Url   string
+	Every time.Duration
+}
+
+// Reads the subset of the cron.yaml format that we use: a list of jobs, each
+// with a url and an "every N hours" or "every N minutes" schedule.
+func readCronYaml(path string) ([]cronJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jobs := []cronJob{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "- url:") {
+			jobs = append(jobs, cronJob{Url: strings.TrimSpace(line[len("- url:"):])})
+		} else if strings.HasPrefix(line, "schedule:") {
+			if len(jobs) == 0 {
+				return nil, fmt.Errorf("Schedule without url: %q", line)
+			}
+			fields := strings.Fields(line[len("schedule:"):])
+			if len(fields) != 3 || fields[0] != "every" {
+				return nil, fmt.Errorf("Unsupported schedule: %q", line)
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("Unsupported schedule: %q", line)
+			}
+			switch fields[2] {
+			case "hours":
+				jobs[len(jobs)-1].Every = time.Duration(n) * time.Hour
+			case "minutes":
+				jobs[len(jobs)-1].Every = time.Duration(n) * time.Minute
+			default:
+				return nil, fmt.Errorf("Unsupported schedule: %q", line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.Every == 0 {
+			return nil, fmt.Errorf("No schedule for %q", job.Url)
+		}
+	}
+	return jobs, nil
+}
+
+// Like App Engine, GETs the job's url with an X-AppEngine-Cron header. Also
+// runs the job at startup, since otherwise frequent restarts would keep
+// postponing it; our jobs are safe to run early. Never returns.
+func runCronJob(job cronJob, handler http.Handler) {
+	for {
+		r, err := http.NewRequest("GET", job.Url, nil)
+		CheckError(err)
+		r.Header.Set("X-AppEngine-Cron", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code < 200 || w.Code >= 300 {
+			log.Printf("Cron job %q failed with status %d", job.Url, w.Code)
+		}
+		time.Sleep(job.Every)
+	}
+}
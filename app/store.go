@@ -0,0 +1,567 @@
+// Storage for the entities that handlers read and write: Users (and the UserId
+// index), PayRequests and their events, UserTokens, OAuthTokens, Suppressions,
+// ApiTokens, and Webhooks and their deliveries. Handlers go through the global
+// store rather than calling the datastore directly, so that they can also run
+// against MemoryStore (in tests) and SqlStore (in standalone mode; see
+// standalone.go).
+//
+// Code that only runs on App Engine still uses the datastore directly: the
+// admin console, migrations, the janitor, and inbound mail (replies and
+// bounces).
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Returned by Get* methods if the entity does not exist. Same as
+// datastore.ErrNoSuchEntity, so that either can be checked for.
+var ErrNoSuchEntity = datastore.ErrNoSuchEntity
+
+// Returned by RunInTransaction if the transaction could not be committed
+// because of contention.
+var ErrConcurrentTransaction = datastore.ErrConcurrentTransaction
+
+var errNestedTransaction = errors.New("Nested transactions are not supported")
+
+type UserRepo interface {
+	GetUser(userId int64, c *Context) (*User, error)
+	// Stores the given user under a newly allocated id, and returns the id.
+	NewUser(user *User, c *Context) (int64, error)
+	PutUser(userId int64, user *User, c *Context) error
+	// Returns the id of the user with the given email.
+	GetUserId(email string, c *Context) (int64, error)
+	PutUserId(email string, userId int64, c *Context) error
+	// Calls f for each user whose email is verified, in no particular order.
+	// Stops if f returns an error.
+	ForEachVerifiedUser(f func(userId int64, user *User) error, c *Context) error
+}
+
+type PayRequestRepo interface {
+	GetPayRequest(userId, reqId int64, c *Context) (*PayRequest, error)
+	// Stores the given request under a newly allocated id, and returns the id.
+	NewPayRequest(userId int64, req *PayRequest, c *Context) (int64, error)
+	PutPayRequest(userId, reqId int64, req *PayRequest, c *Context) error
+	// Returns all of the user's non-deleted requests, in no particular order.
+	GetPayRequests(userId int64, c *Context) ([]int64, []PayRequest, error)
+	// Returns the user's non-deleted requests with the given paid status, newest
+	// first. If limit is positive, returns at most limit requests.
+	GetPayRequestsByStatus(userId int64, isPaid bool, limit int, c *Context) ([]int64, []PayRequest, error)
+	// Returns the user's non-deleted requests that were paid after since, most
+	// recently paid first.
+	GetPayRequestsPaidSince(userId int64, since time.Time, c *Context) ([]int64, []PayRequest, error)
+	// Returns one page of the user's requests that match f, along with the cursor
+	// for the next page, which is empty if there are no more results. See
+	// filter.go.
+	QueryPayRequests(userId int64, f *PaymentsFilter, c *Context) ([]int64, []PayRequest, string, error)
+	// Calls f for each non-deleted unpaid request that was last emailed before
+	// remindedBefore, in no particular order. Stops if f returns an error.
+	ForEachPayRequestRemindedBefore(remindedBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error
+	// Calls f for each non-deleted unpaid request that was due before dueBefore
+	// and whose payee has not been told that it is overdue, in no particular
+	// order. Stops if f returns an error.
+	ForEachUnreportedOverduePayRequest(dueBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error
+	// Appends the given event to the log of the given request.
+	AddPayRequestEvent(userId, reqId int64, event *PayRequestEvent, c *Context) error
+	// Returns the events for the given request, oldest first.
+	GetPayRequestEvents(userId, reqId int64, c *Context) ([]PayRequestEvent, error)
+	// Returns the newest event of the given type (e.g. ETViewed) for the given
+	// request, or ErrNoSuchEntity if there is none.
+	GetLatestPayRequestEvent(userId, reqId int64, eventType int, c *Context) (*PayRequestEvent, error)
+}
+
+type UserTokenRepo interface {
+	GetUserToken(userId int64, purpose string, c *Context) (*UserToken, error)
+	PutUserToken(userId int64, purpose string, token *UserToken, c *Context) error
+}
+
+type OAuthTokenRepo interface {
+	GetOAuthToken(userId int64, service string, c *Context) (*OAuthToken, error)
+	PutOAuthToken(userId int64, service string, token *OAuthToken, c *Context) error
+	DeleteOAuthToken(userId int64, service string, c *Context) error
+}
+
+type SuppressionRepo interface {
+	GetSuppression(email string, c *Context) (*Suppression, error)
+	// Returns a map from email to Suppression, containing only the given emails
+	// that are suppressed.
+	GetSuppressions(emails []string, c *Context) (map[string]*Suppression, error)
+	PutSuppression(email string, sup *Suppression, c *Context) error
+}
+
+type ApiTokenRepo interface {
+	GetApiToken(tokenHash string, c *Context) (*ApiToken, error)
+	PutApiToken(tokenHash string, token *ApiToken, c *Context) error
+	DeleteApiToken(tokenHash string, c *Context) error
+	// Returns the hashes and tokens of the given user's API tokens, in no
+	// particular order.
+	GetApiTokens(userId int64, c *Context) ([]string, []ApiToken, error)
+}
+
+type WebhookRepo interface {
+	GetWebhook(userId, webhookId int64, c *Context) (*Webhook, error)
+	// Returns the user's webhooks, oldest first.
+	GetWebhooks(userId int64, c *Context) ([]int64, []Webhook, error)
+	// Stores the given webhook under a newly allocated id, and returns the id.
+	NewWebhook(userId int64, webhook *Webhook, c *Context) (int64, error)
+	// Deletes the given webhook and its deliveries.
+	DeleteWebhook(userId, webhookId int64, c *Context) error
+	// Allocates an id for a new delivery, so that the delivery's payload can
+	// include it.
+	AllocateWebhookDeliveryId(userId, webhookId int64, c *Context) (int64, error)
+	GetWebhookDelivery(userId, webhookId, deliveryId int64, c *Context) (*WebhookDelivery, error)
+	PutWebhookDelivery(userId, webhookId, deliveryId int64, delivery *WebhookDelivery, c *Context) error
+	// Returns up to limit of the given webhook's deliveries, newest first.
+	GetWebhookDeliveries(userId, webhookId int64, limit int, c *Context) ([]int64, []WebhookDelivery, error)
+}
+
+type Store interface {
+	UserRepo
+	PayRequestRepo
+	UserTokenRepo
+	OAuthTokenRepo
+	SuppressionRepo
+	ApiTokenRepo
+	WebhookRepo
+	// Runs f in a transaction. Reads and writes made through tx are part of the
+	// transaction; if f returns an error, none of its writes are applied. f may be
+	// called more than once, so it must be idempotent. Queries made through tx
+	// don't see its own writes. In DatastoreStore they see the state as of the
+	// start of the transaction; in MemoryStore and SqlStore they aren't isolated
+	// at all, and see whatever has been committed when they run, without
+	// causing a retry if it changes. Transactions may not be nested.
+	RunInTransaction(f func(tx Store) error, c *Context) error
+}
+
+// Chosen in init() based on kStorage. Standalone mode replaces it with a
+// SqlStore.
+var store Store
+
+// Returns the request code (used in URLs and forms) for the given request.
+func MakeReqCode(userId, reqId int64, c *Context) string {
+	return ToPayRequestKey(c.Aec(), userId, reqId).Encode()
+}
+
+// Returns the payee's user id and the request id for the given request code.
+func ParseReqCode(reqCode string) (int64, int64) {
+	reqKey, err := datastore.DecodeKey(reqCode)
+	CheckError(err)
+	Assert(reqKey.Kind() == "PayRequest", "Invalid key: ", reqCode)
+	return reqKey.Parent().IntID(), reqKey.IntID()
+}
+
+////////////////////////////////////////
+// DatastoreStore
+
+// Stores entities in the App Engine datastore. Reads outside transactions go
+// through memcache; see cache.go. All transactions are cross-group, since
+// signup writes both a User and a UserId.
+type DatastoreStore struct {
+	// Set only for stores passed to RunInTransaction callbacks.
+	aec appengine.Context
+	cw  *cacheWrites
+}
+
+func (s *DatastoreStore) ctx(c *Context) appengine.Context {
+	if s.aec != nil {
+		return s.aec
+	}
+	return c.Aec()
+}
+
+func (s *DatastoreStore) get(key *datastore.Key, dst interface{}, c *Context) error {
+	if s.aec != nil {
+		return datastore.Get(s.aec, key, dst)
+	}
+	return cacheGet(c, key, dst)
+}
+
+func (s *DatastoreStore) put(key *datastore.Key, src interface{}, c *Context) (*datastore.Key, error) {
+	if s.aec != nil {
+		return s.cw.put(s.aec, key, src)
+	}
+	return cachePut(c, key, src)
+}
+
+func (s *DatastoreStore) GetUser(userId int64, c *Context) (*User, error) {
+	user := &User{}
+	if err := s.get(ToUserKey(s.ctx(c), userId), user, c); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *DatastoreStore) NewUser(user *User, c *Context) (int64, error) {
+	key, err := s.put(datastore.NewIncompleteKey(s.ctx(c), "User", nil), user, c)
+	if err != nil {
+		return 0, err
+	}
+	return key.IntID(), nil
+}
+
+func (s *DatastoreStore) PutUser(userId int64, user *User, c *Context) error {
+	_, err := s.put(ToUserKey(s.ctx(c), userId), user, c)
+	return err
+}
+
+func (s *DatastoreStore) GetUserId(email string, c *Context) (int64, error) {
+	userId := &UserId{}
+	if err := s.get(ToUserIdKey(s.ctx(c), email), userId, c); err != nil {
+		return 0, err
+	}
+	return userId.UserId, nil
+}
+
+func (s *DatastoreStore) PutUserId(email string, userId int64, c *Context) error {
+	_, err := s.put(ToUserIdKey(s.ctx(c), email), &UserId{UserId: userId}, c)
+	return err
+}
+
+func (s *DatastoreStore) ForEachVerifiedUser(f func(userId int64, user *User) error, c *Context) error {
+	for it := datastore.NewQuery("User").Filter("EmailOk =", true).Run(s.ctx(c)); ; {
+		user := &User{}
+		userKey, err := it.Next(user)
+		if err == datastore.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(userKey.IntID(), user); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DatastoreStore) GetPayRequest(userId, reqId int64, c *Context) (*PayRequest, error) {
+	req := &PayRequest{}
+	if err := s.get(ToPayRequestKey(s.ctx(c), userId, reqId), req, c); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *DatastoreStore) NewPayRequest(userId int64, req *PayRequest, c *Context) (int64, error) {
+	aec := s.ctx(c)
+	key, err := s.put(datastore.NewIncompleteKey(aec, "PayRequest", ToUserKey(aec, userId)), req, c)
+	if err != nil {
+		return 0, err
+	}
+	return key.IntID(), nil
+}
+
+func (s *DatastoreStore) PutPayRequest(userId, reqId int64, req *PayRequest, c *Context) error {
+	_, err := s.put(ToPayRequestKey(s.ctx(c), userId, reqId), req, c)
+	return err
+}
+
+func (s *DatastoreStore) getPayRequests(q *datastore.Query, c *Context) ([]int64, []PayRequest, error) {
+	reqs := []PayRequest{}
+	reqKeys, err := q.GetAll(s.ctx(c), &reqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keysToIds(reqKeys), reqs, nil
+}
+
+func (s *DatastoreStore) GetPayRequests(userId int64, c *Context) ([]int64, []PayRequest, error) {
+	q := datastore.NewQuery("PayRequest").Ancestor(ToUserKey(s.ctx(c), userId)).
+		Filter("DeletionDate =", time.Unix(0, 0))
+	return s.getPayRequests(q, c)
+}
+
+func (s *DatastoreStore) GetPayRequestsByStatus(userId int64, isPaid bool, limit int, c *Context) ([]int64, []PayRequest, error) {
+	q := makePayRequestQuery(ToUserKey(s.ctx(c), userId), isPaid).Order("-CreationDate")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	return s.getPayRequests(q, c)
+}
+
+func (s *DatastoreStore) GetPayRequestsPaidSince(userId int64, since time.Time, c *Context) ([]int64, []PayRequest, error) {
+	q := makePayRequestQuery(ToUserKey(s.ctx(c), userId), true).
+		Filter("PaymentDate >", since).Order("-PaymentDate")
+	return s.getPayRequests(q, c)
+}
+
+func (s *DatastoreStore) QueryPayRequests(userId int64, f *PaymentsFilter, c *Context) ([]int64, []PayRequest, string, error) {
+	reqKeys, reqs, cursor, err := queryPayRequestsPage(ToUserKey(s.ctx(c), userId), f, s.ctx(c))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return keysToIds(reqKeys), reqs, cursor, nil
+}
+
+func (s *DatastoreStore) ForEachPayRequestRemindedBefore(remindedBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error {
+	q := makePayRequestQuery(nil, false).Filter("ReminderSentDate <", remindedBefore)
+	return forEachPayRequest(q, f, s.ctx(c))
+}
+
+func (s *DatastoreStore) ForEachUnreportedOverduePayRequest(dueBefore time.Time, f func(userId, reqId int64, req *PayRequest) error, c *Context) error {
+	q := makePayRequestQuery(nil, false).
+		Filter("OverdueSentDate =", time.Unix(0, 0)).
+		Filter("DueDate >", time.Unix(0, 0)).
+		Filter("DueDate <", dueBefore)
+	return forEachPayRequest(q, f, s.ctx(c))
+}
+
+func forEachPayRequest(q *datastore.Query, f func(userId, reqId int64, req *PayRequest) error, aec appengine.Context) error {
+	for it := q.Run(aec); ; {
+		req := &PayRequest{}
+		reqKey, err := it.Next(req)
+		if err == datastore.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(reqKey.Parent().IntID(), reqKey.IntID(), req); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DatastoreStore) AddPayRequestEvent(userId, reqId int64, event *PayRequestEvent, c *Context) error {
+	aec := s.ctx(c)
+	reqKey := ToPayRequestKey(aec, userId, reqId)
+	_, err := datastore.Put(aec, datastore.NewIncompleteKey(aec, "PayRequestEvent", reqKey), event)
+	return err
+}
+
+func (s *DatastoreStore) GetPayRequestEvents(userId, reqId int64, c *Context) ([]PayRequestEvent, error) {
+	aec := s.ctx(c)
+	events := []PayRequestEvent{}
+	_, err := datastore.NewQuery("PayRequestEvent").Ancestor(ToPayRequestKey(aec, userId, reqId)).
+		Order("Date").GetAll(aec, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *DatastoreStore) GetLatestPayRequestEvent(userId, reqId int64, eventType int, c *Context) (*PayRequestEvent, error) {
+	aec := s.ctx(c)
+	events := []PayRequestEvent{}
+	_, err := datastore.NewQuery("PayRequestEvent").Ancestor(ToPayRequestKey(aec, userId, reqId)).
+		Filter("Type =", eventType).Order("-Date").Limit(1).GetAll(aec, &events)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNoSuchEntity
+	}
+	return &events[0], nil
+}
+
+func (s *DatastoreStore) GetUserToken(userId int64, purpose string, c *Context) (*UserToken, error) {
+	token := &UserToken{}
+	if err := datastore.Get(s.ctx(c), ToUserTokenKey(s.ctx(c), userId, purpose), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *DatastoreStore) PutUserToken(userId int64, purpose string, token *UserToken, c *Context) error {
+	_, err := datastore.Put(s.ctx(c), ToUserTokenKey(s.ctx(c), userId, purpose), token)
+	return err
+}
+
+func (s *DatastoreStore) GetOAuthToken(userId int64, service string, c *Context) (*OAuthToken, error) {
+	token := &OAuthToken{}
+	if err := datastore.Get(s.ctx(c), ToOAuthTokenKey(s.ctx(c), userId, service), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *DatastoreStore) PutOAuthToken(userId int64, service string, token *OAuthToken, c *Context) error {
+	_, err := datastore.Put(s.ctx(c), ToOAuthTokenKey(s.ctx(c), userId, service), token)
+	return err
+}
+
+func (s *DatastoreStore) DeleteOAuthToken(userId int64, service string, c *Context) error {
+	return datastore.Delete(s.ctx(c), ToOAuthTokenKey(s.ctx(c), userId, service))
+}
+
+func (s *DatastoreStore) GetSuppression(email string, c *Context) (*Suppression, error) {
+	sup := &Suppression{}
+	if err := datastore.Get(s.ctx(c), ToSuppressionKey(s.ctx(c), email), sup); err != nil {
+		return nil, err
+	}
+	return sup, nil
+}
+
+func (s *DatastoreStore) GetSuppressions(emails []string, c *Context) (map[string]*Suppression, error) {
+	res := map[string]*Suppression{}
+	if len(emails) == 0 {
+		return res, nil
+	}
+	keys := make([]*datastore.Key, len(emails))
+	for i, email := range emails {
+		keys[i] = ToSuppressionKey(s.ctx(c), email)
+	}
+	sups := make([]Suppression, len(emails))
+	err := datastore.GetMulti(s.ctx(c), keys, sups)
+	multiErr, _ := err.(appengine.MultiError)
+	if err != nil && multiErr == nil {
+		return nil, err
+	}
+	for i, email := range emails {
+		if multiErr != nil && multiErr[i] != nil {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, multiErr[i]
+		}
+		res[email] = &sups[i]
+	}
+	return res, nil
+}
+
+func (s *DatastoreStore) PutSuppression(email string, sup *Suppression, c *Context) error {
+	_, err := datastore.Put(s.ctx(c), ToSuppressionKey(s.ctx(c), email), sup)
+	return err
+}
+
+func (s *DatastoreStore) GetApiToken(tokenHash string, c *Context) (*ApiToken, error) {
+	token := &ApiToken{}
+	if err := datastore.Get(s.ctx(c), ToApiTokenKey(s.ctx(c), tokenHash), token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *DatastoreStore) PutApiToken(tokenHash string, token *ApiToken, c *Context) error {
+	_, err := datastore.Put(s.ctx(c), ToApiTokenKey(s.ctx(c), tokenHash), token)
+	return err
+}
+
+func (s *DatastoreStore) DeleteApiToken(tokenHash string, c *Context) error {
+	return datastore.Delete(s.ctx(c), ToApiTokenKey(s.ctx(c), tokenHash))
+}
+
+func (s *DatastoreStore) GetApiTokens(userId int64, c *Context) ([]string, []ApiToken, error) {
+	tokens := []ApiToken{}
+	keys, err := datastore.NewQuery("ApiToken").Filter("UserId =", userId).GetAll(s.ctx(c), &tokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(keys))
+	for i, key := range keys {
+		hashes[i] = key.StringID()
+	}
+	return hashes, tokens, nil
+}
+
+func (s *DatastoreStore) GetWebhook(userId, webhookId int64, c *Context) (*Webhook, error) {
+	webhook := &Webhook{}
+	if err := datastore.Get(s.ctx(c), ToWebhookKey(s.ctx(c), userId, webhookId), webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *DatastoreStore) GetWebhooks(userId int64, c *Context) ([]int64, []Webhook, error) {
+	webhooks := []Webhook{}
+	keys, err := datastore.NewQuery("Webhook").Ancestor(ToUserKey(s.ctx(c), userId)).
+		Order("CreationDate").GetAll(s.ctx(c), &webhooks)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keysToIds(keys), webhooks, nil
+}
+
+func (s *DatastoreStore) NewWebhook(userId int64, webhook *Webhook, c *Context) (int64, error) {
+	aec := s.ctx(c)
+	key, err := datastore.Put(aec, datastore.NewIncompleteKey(aec, "Webhook", ToUserKey(aec, userId)), webhook)
+	if err != nil {
+		return 0, err
+	}
+	return key.IntID(), nil
+}
+
+// Pending deliveries are dropped once their webhook is gone, so it's fine to
+// delete the deliveries after the webhook, in batches.
+func (s *DatastoreStore) DeleteWebhook(userId, webhookId int64, c *Context) error {
+	aec := s.ctx(c)
+	webhookKey := ToWebhookKey(aec, userId, webhookId)
+	if err := datastore.Delete(aec, webhookKey); err != nil {
+		return err
+	}
+	for {
+		q := datastore.NewQuery("WebhookDelivery").Ancestor(webhookKey).KeysOnly().Limit(500)
+		keys, err := q.GetAll(aec, nil)
+		if err != nil {
+			return err
+		} else if len(keys) == 0 {
+			return nil
+		}
+		if err := datastore.DeleteMulti(aec, keys); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DatastoreStore) AllocateWebhookDeliveryId(userId, webhookId int64, c *Context) (int64, error) {
+	aec := s.ctx(c)
+	low, _, err := datastore.AllocateIDs(aec, "WebhookDelivery", ToWebhookKey(aec, userId, webhookId), 1)
+	return low, err
+}
+
+func (s *DatastoreStore) GetWebhookDelivery(userId, webhookId, deliveryId int64, c *Context) (*WebhookDelivery, error) {
+	aec := s.ctx(c)
+	delivery := &WebhookDelivery{}
+	if err := datastore.Get(aec, ToWebhookDeliveryKey(aec, userId, webhookId, deliveryId), delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *DatastoreStore) PutWebhookDelivery(userId, webhookId, deliveryId int64, delivery *WebhookDelivery, c *Context) error {
+	aec := s.ctx(c)
+	_, err := datastore.Put(aec, ToWebhookDeliveryKey(aec, userId, webhookId, deliveryId), delivery)
+	return err
+}
+
+func (s *DatastoreStore) GetWebhookDeliveries(userId, webhookId int64, limit int, c *Context) ([]int64, []WebhookDelivery, error) {
+	aec := s.ctx(c)
+	deliveries := []WebhookDelivery{}
+	keys, err := datastore.NewQuery("WebhookDelivery").Ancestor(ToWebhookKey(aec, userId, webhookId)).
+		Order("-CreationDate").Limit(limit).GetAll(aec, &deliveries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keysToIds(keys), deliveries, nil
+}
+
+func (s *DatastoreStore) RunInTransaction(f func(tx Store) error, c *Context) error {
+	if s.aec != nil {
+		return errNestedTransaction
+	}
+	return runInTransactionWithCache(c, func(aec appengine.Context, cw *cacheWrites) error {
+		return f(&DatastoreStore{aec: aec, cw: cw})
+	}, makeXG())
+}
+
+func keysToIds(keys []*datastore.Key) []int64 {
+	ids := make([]int64, len(keys))
+	for i, key := range keys {
+		ids[i] = key.IntID()
+	}
+	return ids
+}
+
+func init() {
+	switch kStorage {
+	case "datastore":
+		store = &DatastoreStore{}
+	case "memory":
+		store = NewMemoryStore()
+	default:
+		panic(fmt.Sprintf("Invalid kStorage: %q", kStorage))
+	}
+}
@@ -0,0 +1,121 @@
+// Background tasks. Handlers enqueue POSTs to /tasks/... through the global
+// taskQueue. On App Engine, tasks go through the Task Queue API (see
+// queue.yaml); in standalone mode, they run in-process (see LocalTaskQueue).
+
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine/taskqueue"
+)
+
+type TaskQueue interface {
+	// Enqueues a POST to the given path. An empty queueName means the default
+	// queue.
+	Add(path string, params url.Values, queueName string, c *Context) error
+}
+
+// AppEngineTaskQueue by default; standalone mode replaces it with a
+// LocalTaskQueue.
+var taskQueue TaskQueue = &AppEngineTaskQueue{}
+
+func EnqueueTask(path string, params url.Values, queueName string, c *Context) error {
+	return taskQueue.Add(path, params, queueName, c)
+}
+
+////////////////////////////////////////
+// AppEngineTaskQueue
+
+type AppEngineTaskQueue struct{}
+
+func (q *AppEngineTaskQueue) Add(path string, params url.Values, queueName string, c *Context) error {
+	t := taskqueue.NewPOSTTask(path, params)
+	t.Header.Set(kRequestIdHeader, c.RequestId())
+	_, err := taskqueue.Add(c.Aec(), t, queueName)
+	return err
+}
+
+////////////////////////////////////////
+// LocalTaskQueue
+
+// Runs each task in its own goroutine, by POSTing it to Handler. As with the
+// Task Queue API, a task whose handler fails (i.e. responds with a non-2xx
+// status) is retried with exponential backoff. Pending tasks are lost on
+// restart.
+type LocalTaskQueue struct {
+	Handler     http.Handler
+	MaxAttempts int // per task; 0 means no limit
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	wg          sync.WaitGroup
+}
+
+func NewLocalTaskQueue(handler http.Handler) *LocalTaskQueue {
+	return &LocalTaskQueue{
+		Handler:     handler,
+		MaxAttempts: 8,
+		MinBackoff:  30 * time.Second,
+		MaxBackoff:  time.Hour,
+	}
+}
+
+func (q *LocalTaskQueue) Add(path string, params url.Values, queueName string, c *Context) error {
+	c.Log().Debug("Enqueuing local task", "path", path, "queue", queueName)
+	requestId := c.RequestId()
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		backoff := q.MinBackoff
+		for attempt := 1; ; attempt++ {
+			err := q.run(path, params, queueName, requestId, attempt)
+			if err == nil {
+				return
+			}
+			if q.MaxAttempts > 0 && attempt >= q.MaxAttempts {
+				c.Log().Error("Giving up on task", "path", path, "attempts", attempt, "error", err)
+				return
+			}
+			c.Log().Warning("Task failed, retrying", "path", path, "backoff", backoff, "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > q.MaxBackoff {
+				backoff = q.MaxBackoff
+			}
+		}
+	}()
+	return nil
+}
+
+// Runs one attempt of the given task.
+func (q *LocalTaskQueue) run(path string, params url.Values, queueName, requestId string, attempt int) (err error) {
+	defer func() {
+		if data := recover(); data != nil {
+			err = fmt.Errorf("panic: %v", data)
+		}
+	}()
+	r, err := http.NewRequest("POST", path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-AppEngine-QueueName", queueName)
+	r.Header.Set("X-AppEngine-TaskExecutionCount", fmt.Sprint(attempt-1))
+	r.Header.Set(kRequestIdHeader, requestId)
+	w := httptest.NewRecorder()
+	q.Handler.ServeHTTP(w, r)
+	if w.Code < 200 || w.Code >= 300 {
+		return fmt.Errorf("status %d", w.Code)
+	}
+	return nil
+}
+
+// Blocks until all pending tasks, including ones they enqueue, have finished.
+func (q *LocalTaskQueue) Wait() {
+	q.wg.Wait()
+}
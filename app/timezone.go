@@ -0,0 +1,96 @@
+// Time zones for rendering dates. Users pick a time zone at signup (detected in
+// the browser) and can change it in settings. Each PayRequest records its
+// payee's time zone at creation, since its due date is a calendar day in that
+// zone.
+
+package app
+
+import (
+	"time"
+)
+
+// Time zones offered on the settings page. A user's current time zone is
+// always offered, even if it's not in this list.
+var timeZones = []string{
+	"Pacific/Honolulu",
+	"America/Anchorage",
+	"America/Los_Angeles",
+	"America/Denver",
+	"America/Phoenix",
+	"America/Chicago",
+	"America/New_York",
+	"America/Halifax",
+	"America/Mexico_City",
+	"America/Bogota",
+	"America/Lima",
+	"America/Santiago",
+	"America/Argentina/Buenos_Aires",
+	"America/Sao_Paulo",
+	"Atlantic/Reykjavik",
+	"Europe/London",
+	"Europe/Lisbon",
+	"Europe/Madrid",
+	"Europe/Paris",
+	"Europe/Berlin",
+	"Europe/Athens",
+	"Europe/Moscow",
+	"Africa/Lagos",
+	"Africa/Johannesburg",
+	"Africa/Nairobi",
+	"Asia/Dubai",
+	"Asia/Kolkata",
+	"Asia/Bangkok",
+	"Asia/Singapore",
+	"Asia/Shanghai",
+	"Asia/Tokyo",
+	"Asia/Seoul",
+	"Australia/Perth",
+	"Australia/Sydney",
+	"Pacific/Auckland",
+	"UTC",
+}
+
+// Returns the named time zone, or the default time zone if name is empty or
+// unknown. Names are IANA time zone names, e.g. "Europe/Paris".
+func getLocation(name string) *time.Location {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	loc, err := time.LoadLocation(kDefaultTimeZone)
+	CheckError(err)
+	return loc
+}
+
+// Returns the time zone that the given request's due date is in.
+func requestLocation(req *PayRequest) *time.Location {
+	return getLocation(req.TimeZone)
+}
+
+// Renders the date of t in the given time zone, e.g. "Jan 2". Includes the year
+// if it differs from the current year, e.g. "Jan 2, 2006".
+func renderDate(t time.Time, loc *time.Location) string {
+	if t.Equal(time.Unix(0, 0)) {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	if t.Year() != time.Now().In(loc).Year() {
+		return t.Format("Jan 2, 2006")
+	}
+	return t.Format("Jan 2")
+}
+
+// Due dates are calendar days in the payee's time zone (at the time the request
+// was made), so we render them in that zone regardless of who is looking.
+func renderDueDate(req *PayRequest) string {
+	return renderDate(req.DueDate, requestLocation(req))
+}
+
+// Returns the time zones to offer on the settings page.
+func getTimeZoneOptions(current string) []string {
+	if current == "" || ContainsString(timeZones, current) {
+		return timeZones
+	}
+	return append([]string{current}, timeZones...)
+}
@@ -0,0 +1,95 @@
+// Single-use tokens for email verification and password reset links. A token
+// has the form "<userId>.<random>", and is bound to a user and a purpose; we
+// store only its hash, in a UserToken entity. Using a token marks it used in
+// the same transaction that checks it, so a link works at most once.
+
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Returned by checkUserToken for tokens that cannot be used. The message is
+// suitable for showing to the user.
+type TokenError struct {
+	error
+}
+
+func HashUserToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func ToUserTokenKey(c appengine.Context, userId int64, purpose string) *datastore.Key {
+	return datastore.NewKey(c, "UserToken", purpose, 0, ToUserKey(c, userId))
+}
+
+// Issues a new token for the given user and purpose, invalidating any older
+// token for the same user and purpose.
+func issueUserToken(userId int64, purpose string, lifespan time.Duration, c *Context) (string, error) {
+	token := fmt.Sprintf("%d.%s", userId, base64.URLEncoding.EncodeToString(GenerateSecureRandomString()))
+	now := time.Now()
+	v := &UserToken{
+		Hash:           HashUserToken(token),
+		CreationDate:   now,
+		ExpirationDate: now.Add(lifespan),
+		UsedDate:       time.Unix(0, 0),
+	}
+	if err := store.PutUserToken(userId, purpose, v, c); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Returns the id of the user that the given token was issued to. Returns a
+// *TokenError if the token is malformed, expired, already used, or has been
+// superseded by a newer token. If consume is true, also marks the token used;
+// s should then be a transaction, and changes made on the strength of the token
+// should be made in the same transaction. linkType is used in error messages,
+// e.g. "Password reset".
+func checkUserToken(s Store, token, purpose, linkType string, consume bool, c *Context) (int64, error) {
+	expiredErr := &TokenError{makeExpiredLinkError(linkType, c)}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return 0, expiredErr
+	}
+	userId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, expiredErr
+	}
+	v, err := s.GetUserToken(userId, purpose, c)
+	if err == ErrNoSuchEntity {
+		return 0, expiredErr
+	} else if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(HashUserToken(token)), []byte(v.Hash)) != 1 {
+		// Superseded by a newer token (or forged).
+		return 0, expiredErr
+	}
+	if v.UsedDate.After(time.Unix(0, 0)) {
+		return 0, &TokenError{errors.New(c.T("%s link has already been used. Please request another.", c.T(linkType)))}
+	}
+	now := time.Now()
+	if now.After(v.ExpirationDate) {
+		return 0, expiredErr
+	}
+	if consume {
+		v.UsedDate = now
+		if err := s.PutUserToken(userId, purpose, v, c); err != nil {
+			return 0, err
+		}
+	}
+	return userId, nil
+}
@@ -2,20 +2,25 @@ package app
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"runtime/debug"
-	text_template "text/template"
+	"time"
 
 	"appengine"
+	"appengine/urlfetch"
 	"securecookie"
 )
 
 type PageData struct {
+	Locale   string
 	FullName string
 	Message  string
 	Title    template.HTML
@@ -24,12 +29,16 @@ type PageData struct {
 	Js       template.HTML
 }
 
-var tmpl = template.Must(template.ParseGlob("templates/*.html"))
-var text_tmpl = text_template.Must(text_template.ParseGlob("templates/*.txt"))
+type EmailPageData struct {
+	Locale  string
+	Title   string
+	HomeUrl string
+	Body    template.HTML
+}
 
-func fillPageData(name string, data interface{}, pd *PageData) error {
+func fillPageData(locale, name string, data interface{}, pd *PageData) error {
 	// Body is required, unlike title, css, and js.
-	html, err := ExecuteTemplate(name+"-body", data)
+	html, err := ExecuteTemplate(locale, name+"-body", data)
 	if err != nil {
 		return err
 	}
@@ -37,10 +46,10 @@ func fillPageData(name string, data interface{}, pd *PageData) error {
 
 	maybeExecuteSubTemplate := func(subTemplateName string, field *template.HTML) error {
 		fullName := name + "-" + subTemplateName
-		if tmpl.Lookup(fullName) == nil {
+		if getTemplates(locale).Lookup(fullName) == nil {
 			return nil
 		}
-		if html, err = ExecuteTemplate(fullName, data); err != nil {
+		if html, err = ExecuteTemplate(locale, fullName, data); err != nil {
 			return err
 		}
 		*field = html
@@ -76,44 +85,68 @@ func RenderPageOrDie(w http.ResponseWriter, c *Context, name string, data interf
 	}
 
 	pd := &PageData{}
-	if err := fillPageData(name, data, pd); err != nil {
+	if err := fillPageData(c.Locale(), name, data, pd); err != nil {
 		ServeError(w, err)
 		return
 	}
+	pd.Locale = c.Locale()
 	pd.FullName = fullName
 	pd.Message = c.Flash()
 
 	setContentTypeUtf8(w)
-	if err := tmpl.ExecuteTemplate(w, "base.html", pd); err != nil {
+	if err := getTemplates(c.Locale()).ExecuteTemplate(w, "base.html", pd); err != nil {
 		ServeError(w, err)
 	}
 }
 
-func RenderTemplateOrDie(w http.ResponseWriter, name string, data interface{}) {
+func RenderTemplateOrDie(w http.ResponseWriter, c *Context, name string, data interface{}) {
 	setContentTypeUtf8(w)
-	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+	if err := getTemplates(c.Locale()).ExecuteTemplate(w, name, data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 // If the returned error is not nil, it is guaranteed to have type
 // template.Error.
-func ExecuteTemplate(name string, data interface{}) (template.HTML, error) {
+func ExecuteTemplate(locale, name string, data interface{}) (template.HTML, error) {
 	buf := &bytes.Buffer{}
-	if err := tmpl.ExecuteTemplate(buf, name, data); err != nil {
+	if err := getTemplates(locale).ExecuteTemplate(buf, name, data); err != nil {
 		return "", err
 	}
 	return template.HTML(buf.String()), nil
 }
 
-func ExecuteTextTemplate(name string, data interface{}) (string, error) {
+func ExecuteTextTemplate(locale, name string, data interface{}) (string, error) {
 	buf := &bytes.Buffer{}
-	if err := text_tmpl.ExecuteTemplate(buf, name, data); err != nil {
+	if err := getTextTemplates(locale).ExecuteTemplate(buf, name, data); err != nil {
 		return "", err
 	}
 	return buf.String(), nil
 }
 
+// Renders the text and HTML versions of the named email (e.g. "email-verif").
+// The HTML version is the "<name>-body" template wrapped in email-base.html.
+// The subject should already be translated into the given locale.
+func ExecuteEmailTemplates(locale, name, subject string, data interface{}, c *Context) (text, html string, err error) {
+	locale = effectiveLocale(locale)
+	if text, err = ExecuteTextTemplate(locale, name+".txt", data); err != nil {
+		return "", "", err
+	}
+	pd := &EmailPageData{
+		Locale:  locale,
+		Title:   subject,
+		HomeUrl: prependHost("/", c),
+	}
+	if pd.Body, err = ExecuteTemplate(locale, name+"-body", data); err != nil {
+		return "", "", err
+	}
+	buf := &bytes.Buffer{}
+	if err = getTemplates(locale).ExecuteTemplate(buf, "email-base.html", pd); err != nil {
+		return "", "", err
+	}
+	return text, buf.String(), nil
+}
+
 func ServeInfo(w http.ResponseWriter, info string) {
 	setContentTypeUtf8(w)
 	w.Write([]byte(info))
@@ -129,22 +162,52 @@ func ServeError(w http.ResponseWriter, data interface{}) {
 
 type AppHandlerFunc func(http.ResponseWriter, *http.Request, *Context)
 
+// Creates the appengine.Context for each request. Replaced in standalone mode;
+// see standalone.go.
+var newAppEngineContext = appengine.NewContext
+
+// Returns the transport for outgoing HTTP requests, e.g. to PayPal. A zero
+// deadline means the default. Replaced in standalone mode, since urlfetch is
+// only available on App Engine.
+var newHttpTransport = func(deadline time.Duration, c *Context) http.RoundTripper {
+	return &urlfetch.Transport{Context: c.Aec(), Deadline: deadline}
+}
+
+// Returns the transport for webhook deliveries. On App Engine, urlfetch makes
+// requests from outside the app's network, so internal addresses are not
+// reachable. Replaced in standalone mode with a transport that checks each
+// address it dials.
+var newWebhookTransport = func(deadline time.Duration, c *Context) http.RoundTripper {
+	return &urlfetch.Transport{Context: c.Aec(), Deadline: deadline}
+}
+
+func NewHttpClient(deadline time.Duration, c *Context) *http.Client {
+	return &http.Client{Transport: newHttpTransport(deadline, c)}
+}
+
 // Wraps other http handlers. Creates context object, recovers from panics, etc.
 func WrapHandlerImpl(fn AppHandlerFunc, parseForm bool) http.HandlerFunc {
+	handler := handlerName(fn)
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		c := &Context{}
+		sw := beginRequest(w, r, handler, c)
+		w = sw
 
 		// See http://blog.golang.org/2010/08/defer-panic-and-recover.html.
 		defer func() {
 			if data := recover(); data != nil {
-				c.Aec().Errorf(fmt.Sprint(data))
+				c.Log().Error(fmt.Sprint(data))
+				panicsRecovered.Inc(c.Handler())
 				ServeError(w, data)
 			}
+			endRequest(r, sw, start, c)
 		}()
 
-		// Initialize the request context object.
-		c.SetAec(appengine.NewContext(r))
+		// Initialize the rest of the request context object.
 		CheckError(ReadSession(r, c))
+		CheckError(RefreshSession(w, c))
+		c.SetLocale(chooseLocale(r, c))
 		if msg, err := ConsumeFlash(w, r); err != nil && err != http.ErrNoCookie {
 			ServeError(w, err)
 			return
@@ -156,10 +219,7 @@ func WrapHandlerImpl(fn AppHandlerFunc, parseForm bool) http.HandlerFunc {
 			CheckError(r.ParseForm())
 		}
 
-		if appengine.IsDevAppServer() {
-			tmpl = template.Must(template.ParseGlob("templates/*.html"))
-			text_tmpl = text_template.Must(text_template.ParseGlob("templates/*.txt"))
-		}
+		loadTemplatesIfNeeded()
 		fn(w, r, c)
 	}
 }
@@ -220,10 +280,25 @@ func SaltAndHash(salt []byte, password string) []byte {
 	return h.Sum(nil)
 }
 
+// Returns a URL-safe signature for msg. Used in links that act on behalf of
+// someone who is not logged in, e.g. unsubscribe links.
+func SignString(msg string) string {
+	h := hmac.New(sha256.New, kHashKey)
+	io.WriteString(h, msg)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func CheckSignature(msg, sig string) bool {
+	return hmac.Equal([]byte(SignString(msg)), []byte(sig))
+}
+
 func AppHostname(c *Context) string {
 	if kAppHostname != "" {
 		return kAppHostname
 	}
+	if standalone != nil {
+		return standalone.Hostname
+	}
 	return appengine.DefaultVersionHostname(c.Aec())
 }
 
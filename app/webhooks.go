@@ -0,0 +1,399 @@
+// Outgoing webhooks. Users register endpoint urls in /settings; whenever one of
+// their payment requests changes state, we POST a JSON payload of the form
+//
+//   {"id": "<delivery id>", "event": "request.paid", "createdAt": "...",
+//    "request": <same as GET /api/v1/requests/<id>>}
+//
+// to each endpoint. Each payload is signed with the endpoint's secret; the
+// X-Tadue-Signature header is "sha256=" followed by the hex HMAC-SHA256 of
+// "<X-Tadue-Timestamp>.<body>". Deliveries run in the "webhooks" task queue,
+// which retries failed deliveries with exponential backoff (see queue.yaml).
+
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Webhook event names.
+const (
+	WECreated      = "request.created"
+	WEEmailed      = "request.emailed"       // payment request or reminder email sent
+	WEPaid         = "request.paid"          // paid via PayPal
+	WEMarkedPaid   = "request.marked_paid"   // marked as paid by payee or payer
+	WEMarkedUnpaid = "request.marked_unpaid" // "mark as paid" undone
+	WEDeleted      = "request.deleted"
+	WERestored     = "request.restored" // deletion undone
+)
+
+const kWebhookSecretPrefix = "whsec_"
+
+type WebhookPayload struct {
+	Id        string         `json:"id"`
+	Event     string         `json:"event"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Request   *ApiPayRequest `json:"request"`
+}
+
+func GenerateWebhookSecret() string {
+	return kWebhookSecretPrefix + base64.URLEncoding.EncodeToString(GenerateSecureRandomString())
+}
+
+// Returns the value of the X-Tadue-Signature header for the given payload.
+// Including the timestamp lets receivers reject replayed deliveries.
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp+".")
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Loopback, private and link-local networks.
+var internalNetworks = parseCIDRsOrDie("127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12",
+	"192.168.0.0/16", "169.254.0.0/16", "::1/128", "fc00::/7", "fe80::/10")
+
+func parseCIDRsOrDie(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		CheckError(err)
+		res[i] = ipNet
+	}
+	return res
+}
+
+// Reports whether webhooks may be delivered to ip. Webhook urls are supplied by
+// users, so deliveries must not reach internal addresses, e.g. a cloud metadata
+// server.
+func isWebhookAddrAllowed(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return false
+	}
+	for _, ipNet := range internalNetworks {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the user's webhook ids and webhooks, oldest first.
+func GetWebhooksOrDie(userId int64, c *Context) ([]int64, []Webhook) {
+	webhookIds, webhooks, err := store.GetWebhooks(userId, c)
+	CheckError(err)
+	return webhookIds, webhooks
+}
+
+// Decodes the given webhook code and checks that the webhook belongs to the
+// logged-in user.
+func decodeWebhookKeyOrDie(webhookCode string, c *Context) *datastore.Key {
+	c.AssertLoggedIn()
+	webhookKey, err := datastore.DecodeKey(webhookCode)
+	CheckError(err)
+	Assert(webhookKey.Kind() == "Webhook", fmt.Sprintf("Invalid key: %q", webhookCode))
+	if !webhookKey.Parent().Equal(ToUserKey(c.Aec(), c.Session().UserId)) {
+		panic(fmt.Sprintf("Unauthorized user: %d != %d", c.Session().UserId, webhookKey.Parent().IntID()))
+	}
+	return webhookKey
+}
+
+// Enqueues a task that records the given event for each of the given requests
+// and delivers it to each of the payee's webhooks. Should be called after the
+// change has been committed, so that payloads reflect it. Since the change is
+// already committed, failures are logged rather than returned.
+func doEnqueueWebhookEvents(event string, reqCodes []string, c *Context) {
+	if len(reqCodes) == 0 {
+		return
+	}
+	c.Log().Info("Enqueuing webhook events", "event", event, "reqCodes", strings.Join(reqCodes, ","))
+	v := url.Values{}
+	v.Set("event", event)
+	v.Set("reqCodes", strings.Join(reqCodes, ","))
+	v.Set("createdAt", time.Now().Format(time.RFC3339Nano))
+	if err := EnqueueTask("/tasks/fan-out-webhook-events", v, "webhooks", c); err != nil {
+		c.Log().Error("Failed to enqueue webhook events", "event", event,
+			"reqCodes", strings.Join(reqCodes, ","), "err", err)
+	}
+}
+
+// Creates a delivery of the given event to each of the payee's webhooks, and
+// enqueues them. If this task is retried after a partial failure, some
+// endpoints may receive the event twice; receivers can dedupe on the payload's
+// event, request id and createdAt.
+func handleFanOutWebhookEvents(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	event := r.FormValue("event")
+	reqCodes := strings.Split(r.FormValue("reqCodes"), ",")
+	createdAt, err := time.Parse(time.RFC3339Nano, r.FormValue("createdAt"))
+	CheckError(err)
+
+	// Look up each payee's webhooks once. Usually there's just one payee.
+	payeeWebhookIds := map[int64][]int64{}
+	for _, reqCode := range reqCodes {
+		payeeUserId, reqId := ParseReqCode(reqCode)
+		webhookIds, ok := payeeWebhookIds[payeeUserId]
+		if !ok {
+			webhookIds, _, err = store.GetWebhooks(payeeUserId, c)
+			CheckError(err)
+			payeeWebhookIds[payeeUserId] = webhookIds
+		}
+		if len(webhookIds) == 0 {
+			continue
+		}
+
+		req, err := store.GetPayRequest(payeeUserId, reqId, c)
+		CheckError(err)
+		for _, webhookId := range webhookIds {
+			// Allocate the delivery id first, so that the payload can include it.
+			deliveryId, err := store.AllocateWebhookDeliveryId(payeeUserId, webhookId, c)
+			CheckError(err)
+			deliveryCode := ToWebhookDeliveryKey(c.Aec(), payeeUserId, webhookId, deliveryId).Encode()
+			payload, err := json.Marshal(&WebhookPayload{
+				Id:        deliveryCode,
+				Event:     event,
+				CreatedAt: createdAt,
+				Request:   makeApiPayRequest(reqCode, req, c),
+			})
+			CheckError(err)
+			delivery := &WebhookDelivery{
+				Event:           event,
+				Payload:         payload,
+				CreationDate:    createdAt,
+				LastAttemptDate: time.Unix(0, 0),
+				DeliveredDate:   time.Unix(0, 0),
+			}
+			CheckError(store.PutWebhookDelivery(payeeUserId, webhookId, deliveryId, delivery, c))
+			CheckError(doEnqueueWebhookDelivery(deliveryCode, false, c))
+		}
+	}
+}
+
+// If manual is true, the delivery is attempted once regardless of its state,
+// and is not retried on failure.
+func doEnqueueWebhookDelivery(deliveryCode string, manual bool, c *Context) error {
+	c.Log().Info("Enqueuing webhook delivery", "deliveryCode", deliveryCode, "manual", manual)
+	v := url.Values{}
+	v.Set("deliveryCode", deliveryCode)
+	if manual {
+		v.Set("manual", "true")
+	}
+	return EnqueueTask("/tasks/deliver-webhook", v, "webhooks", c)
+}
+
+// POSTs the delivery's payload to the webhook url. Returns the response status
+// code, or an error if no response was received.
+func postWebhookPayload(webhook *Webhook, deliveryCode string, delivery *WebhookDelivery, c *Context) (int, error) {
+	httpReq, err := http.NewRequest("POST", webhook.Url, strings.NewReader(string(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "Tadue-Webhooks/1.0")
+	httpReq.Header.Set("X-Tadue-Event", delivery.Event)
+	httpReq.Header.Set("X-Tadue-Delivery", deliveryCode)
+	httpReq.Header.Set("X-Tadue-Timestamp", timestamp)
+	httpReq.Header.Set("X-Tadue-Signature", signWebhookPayload(webhook.Secret, timestamp, delivery.Payload))
+
+	client := &http.Client{Transport: newWebhookTransport(kWebhookTimeoutSeconds*time.Second, c)}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	// Drain (some of) the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func handleDeliverWebhook(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	deliveryCode := r.FormValue("deliveryCode")
+	manual := r.FormValue("manual") == "true"
+	deliveryKey, err := datastore.DecodeKey(deliveryCode)
+	CheckError(err)
+	userId := deliveryKey.Parent().Parent().IntID()
+	webhookId := deliveryKey.Parent().IntID()
+	deliveryId := deliveryKey.IntID()
+
+	webhook, err := store.GetWebhook(userId, webhookId, c)
+	var delivery *WebhookDelivery
+	if err == nil {
+		delivery, err = store.GetWebhookDelivery(userId, webhookId, deliveryId, c)
+	}
+	if err == ErrNoSuchEntity {
+		// The webhook was deleted since this delivery was enqueued.
+		c.Log().Info("Dropping delivery for deleted webhook", "deliveryCode", deliveryCode)
+		return
+	}
+	CheckError(err)
+	if !manual && delivery.DeliveredDate.After(time.Unix(0, 0)) {
+		// Tasks may run more than once.
+		return
+	}
+
+	statusCode, postErr := postWebhookPayload(webhook, deliveryCode, delivery, c)
+	ok := postErr == nil && statusCode >= 200 && statusCode < 300
+	if postErr != nil {
+		c.Log().Warning("Webhook delivery failed", "deliveryCode", deliveryCode, "url", webhook.Url, "error", postErr)
+	} else if !ok {
+		c.Log().Warning("Webhook delivery got error status", "deliveryCode", deliveryCode, "url", webhook.Url,
+			"statusCode", statusCode)
+	}
+
+	err = store.RunInTransaction(func(tx Store) error {
+		var err error
+		if delivery, err = tx.GetWebhookDelivery(userId, webhookId, deliveryId, c); err != nil {
+			return err
+		}
+		delivery.Attempts++
+		delivery.LastAttemptDate = time.Now()
+		delivery.StatusCode = statusCode
+		delivery.Error = ""
+		if postErr != nil {
+			delivery.Error = postErr.Error()
+		} else if !ok {
+			delivery.Error = http.StatusText(statusCode)
+		}
+		if ok {
+			delivery.DeliveredDate = delivery.LastAttemptDate
+		}
+		return tx.PutWebhookDelivery(userId, webhookId, deliveryId, delivery, c)
+	}, c)
+	CheckError(err)
+
+	// Returning an error status makes the task queue retry, with backoff.
+	if !ok && !manual && delivery.Attempts < kMaxWebhookAttempts {
+		http.Error(w, "Webhook delivery failed", http.StatusServiceUnavailable)
+	}
+}
+
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	c.AssertLoggedIn()
+	webhookUrl := ParseWebhookUrl(r.FormValue("url"))
+	userId := c.Session().UserId
+	webhookIds, _ := GetWebhooksOrDie(userId, c)
+	Assert(len(webhookIds) < kMaxWebhooks, "Too many webhooks")
+
+	webhook := &Webhook{
+		Url:          webhookUrl,
+		Secret:       GenerateWebhookSecret(),
+		CreationDate: time.Now(),
+	}
+	webhookId, err := store.NewWebhook(userId, webhook, c)
+	CheckError(err)
+	webhookKey := ToWebhookKey(c.Aec(), userId, webhookId)
+	c.Log().Info("Created webhook", "url", webhookUrl)
+	// Show the new webhook's log page, which includes its secret.
+	RedirectWithMessage(w, r, "/settings/webhooks/log?key="+webhookKey.Encode(), c.T("Webhook added."))
+}
+
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	webhookKey := decodeWebhookKeyOrDie(r.FormValue("key"), c)
+	CheckError(store.DeleteWebhook(c.Session().UserId, webhookKey.IntID(), c))
+	RedirectWithMessage(w, r, "/settings", c.T("Webhook deleted."))
+}
+
+type RenderableWebhookDelivery struct {
+	Code            string
+	Event           string
+	CreationDate    string
+	Attempts        int
+	LastAttemptDate string // empty if not yet attempted
+	StatusCode      int    // 0 if there was no response
+	Error           string
+	Delivered       bool
+}
+
+// Renders dates with times, since deliveries are often seconds apart.
+func renderDateTime(t time.Time, loc *time.Location) string {
+	return renderDate(t, loc) + " " + t.In(loc).Format("15:04:05")
+}
+
+func handleWebhookLog(w http.ResponseWriter, r *http.Request, c *Context) {
+	if steerThroughLogin(w, r, c) {
+		return
+	}
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+	webhookCode := r.FormValue("key")
+	webhookKey := decodeWebhookKeyOrDie(webhookCode, c)
+	userId := c.Session().UserId
+	webhook, err := store.GetWebhook(userId, webhookKey.IntID(), c)
+	if err == ErrNoSuchEntity {
+		Serve404(w)
+		return
+	}
+	CheckError(err)
+
+	deliveryIds, deliveries, err := store.GetWebhookDeliveries(userId, webhookKey.IntID(), kMaxWebhookDeliveriesToShow, c)
+	CheckError(err)
+	rendDeliveries := make([]RenderableWebhookDelivery, len(deliveries))
+	for i, delivery := range deliveries {
+		rendDeliveries[i] = RenderableWebhookDelivery{
+			Code:         ToWebhookDeliveryKey(c.Aec(), userId, webhookKey.IntID(), deliveryIds[i]).Encode(),
+			Event:        delivery.Event,
+			CreationDate: renderDateTime(delivery.CreationDate, c.Location()),
+			Attempts:     delivery.Attempts,
+			StatusCode:   delivery.StatusCode,
+			Error:        delivery.Error,
+			Delivered:    delivery.DeliveredDate.After(time.Unix(0, 0)),
+		}
+		if delivery.LastAttemptDate.After(time.Unix(0, 0)) {
+			rendDeliveries[i].LastAttemptDate = renderDateTime(delivery.LastAttemptDate, c.Location())
+		}
+	}
+	data := map[string]interface{}{
+		"key":        webhookCode,
+		"url":        webhook.Url,
+		"secret":     webhook.Secret,
+		"deliveries": rendDeliveries,
+	}
+	RenderPageOrDie(w, c, "webhook-log", data)
+}
+
+func handleRedeliverWebhook(w http.ResponseWriter, r *http.Request, c *Context) {
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+	deliveryCode := r.FormValue("deliveryCode")
+	deliveryKey, err := datastore.DecodeKey(deliveryCode)
+	CheckError(err)
+	Assert(deliveryKey.Kind() == "WebhookDelivery", fmt.Sprintf("Invalid key: %q", deliveryCode))
+	webhookKey := decodeWebhookKeyOrDie(deliveryKey.Parent().Encode(), c)
+	CheckError(doEnqueueWebhookDelivery(deliveryCode, true, c))
+	RedirectWithMessage(w, r, "/settings/webhooks/log?key="+webhookKey.Encode(),
+		c.T("Redelivery scheduled. Reload this page to see the result."))
+}
@@ -0,0 +1,57 @@
+// Serves Tadue on plain net/http, outside App Engine, with data in a SQLite
+// database. See app/standalone.go for what is supported, and the Makefile for
+// how to build it.
+//
+// Example:
+//   tadue -root=$HOME/tadue -hostname=tadue.example.com -smtp=localhost:25
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"app"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	addr     = flag.String("addr", ":8080", "Address to listen on.")
+	root     = flag.String("root", ".", "Repository root. Templates and static files are read from here.")
+	dbPath   = flag.String("db", "tadue.db", "SQLite database file. Relative paths are relative to -root.")
+	hostname = flag.String("hostname", "localhost:8080", "Hostname to use in links, e.g. in emails.")
+	smtpAddr = flag.String("smtp", "localhost:1025", "SMTP server for outgoing email.")
+	noCron   = flag.Bool("nocron", false, "If true, the jobs in cron.yaml are not run.")
+)
+
+func main() {
+	flag.Parse()
+	if err := os.Chdir(*root); err != nil {
+		log.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// SQLite allows only one writer at a time.
+	db.SetMaxOpenConns(1)
+
+	cronPath := "cron.yaml"
+	if *noCron {
+		cronPath = ""
+	}
+	handler, err := app.SetupStandalone(&app.StandaloneConfig{
+		Hostname: *hostname,
+		DB:       db,
+		SmtpAddr: *smtpAddr,
+		CronPath: cronPath,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Serving on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -5,6 +5,8 @@ goog.provide('tadue.form');
 tadue.form.emailRegExp = /^\S+@\S+\.\S+$/;
 tadue.form.floatRegExp = /^\$?[0-9]+(?:\.[0-9][0-9])?$/;
 tadue.form.fullNameRegExp = /^(?:\S+ )+\S+$/;
+tadue.form.dateRegExp = /^[0-9]{4}-[0-9]{2}-[0-9]{2}$/;
+tadue.form.positiveIntRegExp = /^[1-9][0-9]*$/;
 
 tadue.form.checkEmailField = function(node) {
   if (!tadue.form.emailRegExp.test(node.val())) {
@@ -49,6 +51,68 @@ tadue.form.checkDescriptionField = function(node) {
   return '';
 };
 
+// Empty is allowed, since dates are optional.
+tadue.form.checkDateField = function(node) {
+  if (node.val() !== '' && !tadue.form.dateRegExp.test(node.val())) {
+    return 'Invalid date (expected YYYY-MM-DD)';
+  }
+  return '';
+};
+
+tadue.form.checkPositiveIntField = function(node) {
+  if (!tadue.form.positiveIntRegExp.test(node.val())) {
+    return 'Must be a positive number';
+  }
+  return '';
+};
+
+// Checks a comma-separated list of positive numbers in ascending order.
+tadue.form.checkOffsetsField = function(node) {
+  var prev = 0;
+  var offsets = node.val().split(',');
+  for (var i = 0; i < offsets.length; i++) {
+    var offset = $.trim(offsets[i]);
+    if (!tadue.form.positiveIntRegExp.test(offset) || Number(offset) <= prev) {
+      return 'Must be increasing numbers, e.g. 3, 7, 14';
+    }
+    prev = Number(offset);
+  }
+  return '';
+};
+
+// Adds checks for the fields in the reminder-policy-table template, taking the
+// selected reminder mode into account.
+tadue.form.addReminderPolicyChecks = function(checks) {
+  var mode = $('#reminder-mode').val();
+  if (mode === 'every') {
+    checks['#reminder-every-days'] = tadue.form.checkPositiveIntField;
+  } else if (mode === 'offsets') {
+    checks['#reminder-offsets'] = tadue.form.checkOffsetsField;
+  }
+  if (mode === 'every' || mode === 'offsets') {
+    checks['#reminder-max-count'] = function(node) {
+      if (node.val() === '') {
+        return '';
+      }
+      return tadue.form.checkPositiveIntField(node);
+    };
+  }
+};
+
+// Shows only the reminder policy fields that apply to the selected mode.
+tadue.form.updateReminderPolicyFields = function() {
+  var mode = $('#reminder-mode').val();
+  $('.reminder-every-row').toggleClass('display-none', mode !== 'every');
+  $('.reminder-offsets-row').toggleClass('display-none', mode !== 'offsets');
+  $('.reminder-max-count-row').toggleClass(
+    'display-none', mode !== 'every' && mode !== 'offsets');
+};
+
+tadue.form.initReminderPolicyFields = function() {
+  $('#reminder-mode').change(tadue.form.updateReminderPolicyFields);
+  tadue.form.updateReminderPolicyFields();
+};
+
 tadue.form.runChecks = function(checks) {
   var valid = true;
   $.each(checks, function(nodeSelector, check) {
@@ -2,6 +2,8 @@
 
 goog.provide('tadue.payments');
 
+goog.require('tadue.form');
+
 // Called when user clicks a checkbox or performs an action (e.g. delete), and
 // at initialization time.
 tadue.payments.updateVisibleState = function() {
@@ -17,8 +19,8 @@ tadue.payments.updateVisibleState = function() {
   }
   // Make unpaid rows link to their associated payment request pages.
   $('.unpaid').click(function(e) {
-    // Do not navigate if click target is checkbox.
-    if (!$(e.target).is('input')) {
+    // Do not navigate if click target is checkbox or link.
+    if (!$(e.target).is('input, a')) {
       window.location = $(this).find('.row-pay-url').text();
     }
   });
@@ -34,13 +36,16 @@ tadue.payments.getSelectedReqCodes = function() {
 // Stores most recent window.setTimeout() return value.
 tadue.payments.timeoutID = null;
 
-tadue.payments.applyActionToReqCodes = function(url, reqCodes, undo) {
-  var data = {'reqCodes': reqCodes};
+// Returns the jqXHR object for the request. Fields in extraData (optional) are
+// sent along with the request codes. The page's query string (i.e. its filters
+// and cursor) is passed along, so that the response shows the same view.
+tadue.payments.applyActionToReqCodes = function(url, reqCodes, undo, extraData) {
+  var data = $.extend({'reqCodes': reqCodes}, extraData);
   if (undo) {
     data.undo = null;
   }
   var request = $.ajax({
-    url: url,
+    url: url + window.location.search,
     type: 'POST',
     data: data,
     dataType: 'html'
@@ -70,6 +75,7 @@ tadue.payments.applyActionToReqCodes = function(url, reqCodes, undo) {
   // TODO(sadovsky): Handle ajax failure.
   request.fail(function() {
   });
+  return request;
 };
 
 tadue.payments.applyAction = function(url) {
@@ -92,6 +98,28 @@ tadue.payments.doDelete = function() {
   tadue.payments.applyAction('/payments/delete');
 };
 
+// Called when user clicks "fix address" link for a bounced request.
+tadue.payments.fixPayerEmail = function(e) {
+  e.preventDefault();
+  var row = $(e.target).closest('tr');
+  var oldEmail = row.find('.col-email').attr('title');
+  var newEmail = window.prompt(
+    'Email to ' + oldEmail + ' bounced. Enter the correct address:', oldEmail);
+  if (newEmail === null) { return; }
+  newEmail = $.trim(newEmail);
+  if (newEmail === oldEmail) { return; }
+  if (!tadue.form.emailRegExp.test(newEmail)) {
+    window.alert('Invalid email address: ' + newEmail);
+    return;
+  }
+  var request = tadue.payments.applyActionToReqCodes(
+    '/payments/fix-payer-email', row.find('.row-req-code').val(), false,
+    {'payerEmail': newEmail});
+  request.fail(function(jqXHR) {
+    window.alert(jqXHR.responseText);
+  });
+};
+
 // Note: We use a global click handler instead of targeting checkbox elements
 // because after an action (e.g. delete) is taken, new checkboxes are created,
 // and we don't want to bind new event handlers at that point.
@@ -105,10 +133,22 @@ tadue.payments.handleClick = function(e) {
 
 tadue.payments.init = function() {
   $(document).click(tadue.payments.handleClick);
+  $(document).on('click', '.fix-payer-email', tadue.payments.fixPayerEmail);
 
   $('#mark-as-paid').click(tadue.payments.markAsPaid);
   $('#send-reminder').click(tadue.payments.sendReminder);
   $('#delete').click(tadue.payments.doDelete);
 
+  $('#toggle-more-filters').click(function(e) {
+    e.preventDefault();
+    $('#more-filters').toggleClass('display-none');
+  });
+  // Omit empty params, so that bookmarked URLs stay short.
+  $('#filter-form').submit(function() {
+    $(this).find('input, select').filter(function() {
+      return $(this).val() === '';
+    }).prop('disabled', true);
+  });
+
   tadue.payments.updateVisibleState();
 };
@@ -42,6 +42,8 @@ tadue.requestPayment.runChecks = function() {
       tadue.requestPayment.checkEmailAndAmountFields;
   });
   checks['#description'] = tadue.form.checkDescriptionField;
+  checks['#due-date'] = tadue.form.checkDateField;
+  tadue.form.addReminderPolicyChecks(checks);
 
   var valid = tadue.form.runChecks(checks);
   // Always run the signup and login checks to ensure that all error messages
@@ -142,6 +144,8 @@ tadue.requestPayment.init = function() {
 
   $('.amount-field').blur(function() { tadue.requestPayment.updateTotal(); });
   tadue.requestPayment.updateTotal();
+
+  tadue.form.initReminderPolicyFields();
 };
 
 tadue.requestPayment.initAutoComplete = function() {
@@ -8,6 +8,7 @@ tadue.settings.runChecks = function() {
   var checks = {};
   checks['#name'] = tadue.form.checkFullNameField;
   checks['#paypal-email'] = tadue.form.checkEmailField;
+  tadue.form.addReminderPolicyChecks(checks);
   return tadue.form.runChecks(checks);
 };
 
@@ -16,16 +17,21 @@ tadue.settings.runChecksOnEveryInputEvent = false;
 tadue.settings.checkForm = function() {
   if (!tadue.settings.runChecksOnEveryInputEvent) {
     tadue.settings.runChecksOnEveryInputEvent = true;
-    $('input').on('input', tadue.settings.runChecks);
+    $('#settings-form input').on('input', tadue.settings.runChecks);
   }
   return tadue.settings.runChecks();
 };
 
 tadue.settings.init = function() {
-  $('input').on('input', function() {
+  var enableButtons = function() {
     $('#save').prop('disabled', false);
     $('#cancel').prop('disabled', false);
-  });
+  };
+  $('#settings-form input').on('input', enableButtons);
+  $('#settings-form select').on('change', enableButtons);
 
-  $('#cancel').click(function() { window.location.reload(); });
+  tadue.form.initReminderPolicyFields();
+
+  // Not reload(), since this page may be the response to a POST.
+  $('#cancel').click(function() { window.location.href = '/settings'; });
 };
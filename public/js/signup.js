@@ -50,7 +50,20 @@ tadue.signup.updateSignupPayPalEmail = function() {
   $('#signup-paypal-email').get(0).disabled = tadue.signup.maybeCopyEmail();
 };
 
+// Returns the browser's IANA time zone name (e.g. "Europe/Paris"), or an empty
+// string if the browser does not support time zone detection, in which case the
+// server uses its default time zone.
+tadue.signup.detectTimeZone = function() {
+  try {
+    return Intl.DateTimeFormat().resolvedOptions().timeZone || '';
+  } catch (e) {
+    return '';
+  }
+};
+
 tadue.signup.init = function() {
+  $('#signup-time-zone').val(tadue.signup.detectTimeZone());
+
   // Handles the case where user clicked the back button.
   $('#signup-copy-email').click(tadue.signup.updateSignupPayPalEmail);
   tadue.signup.updateSignupPayPalEmail();